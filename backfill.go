@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status of a candles response to gethistorydata.
+const (
+	candlesStatusNoMoreData     = 0
+	candlesStatusCountDelivered = 1
+	candlesStatusContinued      = 2
+	candlesStatusUnavailable    = 3
+)
+
+type backfillConfig struct {
+	// PageSize is the candle count of one gethistorydata request of the full
+	// history backfill (export.candle_count -1).
+	PageSize int `yaml:"page_size"`
+	// ResponseTimeout skips a series when TRANSAQ does not answer in time.
+	ResponseTimeout time.Duration `yaml:"response_timeout"`
+}
+
+// candleSeries is one (security, candle kind) pair exported from history.
+type candleSeries struct {
+	SecId         int
+	SecCode       string
+	Period        int
+	PeriodSeconds int
+}
+
+func (series candleSeries) key() string {
+	return series.SecCode + "/" + strconv.Itoa(series.PeriodSeconds)
+}
+
+// backfillCheckpoint is the progress of a series in transaq_candle_backfill.
+type backfillCheckpoint struct {
+	SecCode       string    `ch:"sec_code"`
+	PeriodSeconds uint32    `ch:"period_seconds"`
+	Candles       uint64    `ch:"candles"`
+	Complete      uint8     `ch:"complete"`
+	Updated       time.Time `ch:"updated"`
+	Oldest        time.Time `ch:"oldest"`
+	Newest        time.Time `ch:"newest"`
+}
+
+// storedCandles are the candles of a series an interrupted backfill stored,
+// from the oldest to the newest candle of its checkpoint.
+type storedCandles struct {
+	secID  int
+	period int
+	oldest time.Time
+	newest time.Time
+}
+
+// unstored leaves the candles stored before out of event. The newest one may
+// have been stored before it closed and is written again.
+func (stored storedCandles) unstored(event historyCandlesEvent) historyCandlesEvent {
+	if !stored.oldest.Before(stored.newest) || event.Candles.SecId != stored.secID || event.Candles.Period != stored.period {
+		return event
+	}
+	items := make([]commands.Candle, 0, len(event.Candles.Items))
+	for _, candle := range event.Candles.Items {
+		date, err := time.ParseInLocation(tradeTimeLayout, candle.Date, moscowLocation)
+		if err == nil && !date.Before(stored.oldest) && date.Before(stored.newest) {
+			continue
+		}
+		items = append(items, candle)
+	}
+	event.Candles.Items = items
+	return event
+}
+
+// historyCandlesEvent is a candles response with the period of its candle
+// kind in seconds.
+type historyCandlesEvent struct {
+	Candles       commands.Candles
+	PeriodSeconds int
+}
+
+// selectCandleSeries lists the history series of the quoted securities for
+// the candle kinds allowed by export.period_seconds.
+func selectCandleSeries(export exportConfig, quoted []commands.SubSecurity, securities []commands.Security, kinds []commands.Kind) []candleSeries {
+	var series []candleSeries
+	for _, sec := range securities {
+		if !slices.ContainsFunc(quoted, func(quotation commands.SubSecurity) bool {
+			return quotation.SecId == sec.SecId
+		}) {
+			continue
+		}
+		for _, kind := range kinds {
+			if len(export.PeriodSeconds) > 0 && !slices.Contains(export.PeriodSeconds, kind.Period) {
+				continue
+			}
+			series = append(series, candleSeries{SecId: sec.SecId, SecCode: sec.SecCode, Period: kind.ID, PeriodSeconds: kind.Period})
+		}
+	}
+	return series
+}
+
+func candleKindSeconds(kinds []commands.Kind, period int) int {
+	for _, kind := range kinds {
+		if kind.ID == period {
+			return kind.Period
+		}
+	}
+	return 0
+}
+
+// candleBackfill pages gethistorydata through the history series one at a
+// time. Progress is kept in transaq_candle_backfill: after a restart series
+// that reached the start of their history only refresh the latest page. The
+// others request the candles of their checkpoint and a page more at once,
+// as TRANSAQ cannot start a series in the middle, and only the candles that
+// were not stored are written. Candles are written by the candles worker,
+// which hands every response to the running backfill afterwards.
+type candleBackfill struct {
+	config backfillConfig
+	load   func(context.Context) ([]backfillCheckpoint, error)
+	save   func(context.Context, backfillCheckpoint) error
+
+	// running is held by a run, the runs of the session and of the control
+	// API share the responses and page one after another.
+	running   sync.Mutex
+	lock      sync.Mutex
+	responses chan commands.Candles
+	done      chan struct{}
+	stored    storedCandles
+}
+
+func newCandleBackfill(config backfillConfig) *candleBackfill {
+	return &candleBackfill{config: config, load: loadBackfillCheckpoints, save: saveBackfillCheckpoint}
+}
+
+// observe passes candles written by insert on to the running backfill.
+func (backfill *candleBackfill) observe(insert func(context.Context, historyCandlesEvent) error) func(context.Context, historyCandlesEvent) error {
+	return func(handleCtx context.Context, event historyCandlesEvent) error {
+		backfill.lock.Lock()
+		responses, done, stored := backfill.responses, backfill.done, backfill.stored
+		backfill.lock.Unlock()
+		err := insert(handleCtx, stored.unstored(event))
+		if responses != nil {
+			select {
+			case <-handleCtx.Done():
+			case <-done:
+			case responses <- event.Candles:
+			}
+		}
+		return err
+	}
+}
+
+// run requests candleCount candles of every series, or the whole history
+// when candleCount is -1. It returns when all series are done or runCtx ends.
+func (backfill *candleBackfill) run(runCtx context.Context, send func(commands.Command) error, candleCount int, series []candleSeries) {
+	if candleCount == 0 || len(series) == 0 {
+		return
+	}
+	backfill.running.Lock()
+	defer backfill.running.Unlock()
+	if runCtx.Err() != nil {
+		return
+	}
+	responses, done := make(chan commands.Candles), make(chan struct{})
+	backfill.lock.Lock()
+	backfill.responses, backfill.done = responses, done
+	backfill.lock.Unlock()
+	defer func() {
+		backfill.lock.Lock()
+		backfill.responses, backfill.done = nil, nil
+		backfill.lock.Unlock()
+		close(done)
+	}()
+
+	checkpoints := map[string]backfillCheckpoint{}
+	if candleCount < 0 {
+		loaded, err := backfill.load(runCtx)
+		if err != nil {
+			log.Errorf("Load candle backfill checkpoints: %v", err)
+		}
+		for _, checkpoint := range loaded {
+			checkpoints[candleSeries{SecCode: checkpoint.SecCode, PeriodSeconds: int(checkpoint.PeriodSeconds)}.key()] = checkpoint
+		}
+	}
+	for _, item := range series {
+		if err := backfill.runSeries(runCtx, send, responses, candleCount, item, checkpoints[item.key()]); err != nil {
+			if runCtx.Err() != nil {
+				return
+			}
+			log.Warnf("Candle backfill of %s period %ds: %v", item.SecCode, item.PeriodSeconds, err)
+		}
+	}
+}
+
+func (backfill *candleBackfill) runSeries(
+	runCtx context.Context,
+	send func(commands.Command) error,
+	responses <-chan commands.Candles,
+	candleCount int,
+	series candleSeries,
+	checkpoint backfillCheckpoint,
+) error {
+	fullHistory := candleCount < 0 && checkpoint.Complete == 0
+	count := candleCount
+	if candleCount < 0 {
+		count = backfill.config.PageSize
+	}
+	firstCount := count
+	if fullHistory && checkpoint.Candles > 0 {
+		firstCount = int(checkpoint.Candles) + count
+		log.Infof("Resume candle backfill of %s period %ds after %d stored candles", series.SecCode, series.PeriodSeconds, checkpoint.Candles)
+		backfill.setStored(storedCandles{secID: series.SecId, period: series.Period, oldest: checkpoint.Oldest, newest: checkpoint.Newest})
+		defer backfill.setStored(storedCandles{})
+	}
+	candles := uint64(0)
+	var oldest, newest time.Time
+	reset, request := true, true
+	for {
+		if request {
+			requestCount := count
+			if reset {
+				requestCount = firstCount
+			}
+			if err := send(commands.Command{
+				Id:     "gethistorydata",
+				Period: series.Period,
+				SecId:  series.SecId,
+				Count:  requestCount,
+				Reset:  strconv.FormatBool(reset),
+			}); err != nil {
+				return fmt.Errorf("send gethistorydata: %w", err)
+			}
+			reset, request = false, false
+		}
+		response, err := backfill.awaitResponse(runCtx, responses, series)
+		if err != nil {
+			return err
+		}
+		candles += uint64(len(response.Items))
+		for _, candle := range response.Items {
+			if date, err := time.ParseInLocation(tradeTimeLayout, candle.Date, moscowLocation); err == nil {
+				if oldest.IsZero() || date.Before(oldest) {
+					oldest = date
+				}
+				if date.After(newest) {
+					newest = date
+				}
+			}
+		}
+		switch {
+		case response.Status == candlesStatusContinued:
+			continue
+		case response.Status == candlesStatusUnavailable:
+			return errors.New("history is not available now, retry on the next session")
+		case fullHistory && response.Status == candlesStatusCountDelivered:
+			if err := backfill.save(runCtx, backfillCheckpoint{
+				SecCode: series.SecCode, PeriodSeconds: uint32(series.PeriodSeconds), Candles: candles, Updated: time.Now(),
+				Oldest: oldest, Newest: newest,
+			}); err != nil {
+				return fmt.Errorf("save checkpoint: %w", err)
+			}
+			request = true
+			continue
+		}
+		if fullHistory {
+			if err := backfill.save(runCtx, backfillCheckpoint{
+				SecCode: series.SecCode, PeriodSeconds: uint32(series.PeriodSeconds), Candles: candles, Complete: 1, Updated: time.Now(),
+				Oldest: oldest, Newest: newest,
+			}); err != nil {
+				return fmt.Errorf("save checkpoint: %w", err)
+			}
+		}
+		if candleCount < 0 {
+			candleBackfillComplete.WithLabelValues(series.SecCode, strconv.Itoa(series.PeriodSeconds)).Set(1)
+		}
+		log.Infof("Candle backfill of %s period %ds complete: %d candles", series.SecCode, series.PeriodSeconds, candles)
+		return nil
+	}
+}
+
+func (backfill *candleBackfill) setStored(stored storedCandles) {
+	backfill.lock.Lock()
+	defer backfill.lock.Unlock()
+	backfill.stored = stored
+}
+
+func (backfill *candleBackfill) awaitResponse(runCtx context.Context, responses <-chan commands.Candles, series candleSeries) (commands.Candles, error) {
+	timeout := time.NewTimer(backfill.config.ResponseTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-runCtx.Done():
+			return commands.Candles{}, runCtx.Err()
+		case <-timeout.C:
+			return commands.Candles{}, fmt.Errorf("no candles within %s", backfill.config.ResponseTimeout)
+		case response := <-responses:
+			if response.SecId == series.SecId && response.Period == series.Period {
+				return response, nil
+			}
+		}
+	}
+}
+
+func loadBackfillCheckpoints(loadCtx context.Context) ([]backfillCheckpoint, error) {
+	var checkpoints []backfillCheckpoint
+	if err := connect.Select(loadCtx, &checkpoints, ChBackfillCheckpointSelectQuery); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// saveBackfillCheckpoint waits for the insert, a checkpoint that was not
+// stored fails the series.
+func saveBackfillCheckpoint(saveCtx context.Context, checkpoint backfillCheckpoint) error {
+	return connect.AsyncInsert(saveCtx, ChBackfillCheckpointInsertQuery, true,
+		checkpoint.SecCode,
+		checkpoint.PeriodSeconds,
+		checkpoint.Candles,
+		checkpoint.Complete,
+		checkpoint.Updated,
+		checkpoint.Oldest,
+		checkpoint.Newest,
+	)
+}
+
+func insertHistoryCandles(insertCtx context.Context, event historyCandlesEvent) (err error) {
+	if len(event.Candles.Items) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_candles", len(event.Candles.Items), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChCandlesInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare history candles batch: %w", err)
+	}
+	defer batch.Close()
+	for _, candle := range event.Candles.Items {
+		candleDate, _ := time.Parse(tradeTimeLayout, candle.Date)
+		if err := batch.Append(
+			candleDate.Format(tableTimeLayout),
+			event.Candles.SecCode,
+			uint16(event.Candles.Period),
+			float32(candle.Open),
+			float32(candle.Close),
+			float32(candle.High),
+			float32(candle.Low),
+			uint64(candle.Volume),
+			candleSourceHistory,
+			uint32(event.PeriodSeconds),
+			uint32(0),
+			float64(0),
+		); err != nil {
+			return fmt.Errorf("append %s candle %s: %w", event.Candles.SecCode, candle.Date, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send history candles batch: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+// fakeHistoryServer answers gethistorydata with the next of its responses
+// through the candles handler, as TRANSAQ does through the response loop.
+type fakeHistoryServer struct {
+	handle    func(context.Context, historyCandlesEvent) error
+	responses []commands.Candles
+	commands  []commands.Command
+}
+
+func (server *fakeHistoryServer) send(command commands.Command) error {
+	server.commands = append(server.commands, command)
+	if len(server.responses) == 0 {
+		return nil
+	}
+	response := server.responses[0]
+	server.responses = server.responses[1:]
+	go func() { _ = server.handle(context.Background(), historyCandlesEvent{Candles: response}) }()
+	return nil
+}
+
+func newTestCandleBackfill(checkpoints []backfillCheckpoint, saved *[]backfillCheckpoint) *candleBackfill {
+	backfill := newCandleBackfill(backfillConfig{PageSize: 2, ResponseTimeout: time.Second})
+	backfill.load = func(context.Context) ([]backfillCheckpoint, error) { return checkpoints, nil }
+	backfill.save = func(_ context.Context, checkpoint backfillCheckpoint) error {
+		*saved = append(*saved, checkpoint)
+		return nil
+	}
+	return backfill
+}
+
+func TestCandleBackfillPagesFullHistoryWithCheckpoints(t *testing.T) {
+	var saved []backfillCheckpoint
+	backfill := newTestCandleBackfill(nil, &saved)
+	series := candleSeries{SecId: 1, SecCode: "SBER", Period: 1, PeriodSeconds: 60}
+	page := func(status int, candles int) commands.Candles {
+		return commands.Candles{SecId: 1, Period: 1, Status: status, Items: make([]commands.Candle, candles)}
+	}
+	server := &fakeHistoryServer{
+		handle: backfill.observe(func(context.Context, historyCandlesEvent) error { return nil }),
+		responses: []commands.Candles{
+			page(candlesStatusCountDelivered, 2),
+			page(candlesStatusNoMoreData, 1),
+		},
+	}
+
+	backfill.run(context.Background(), server.send, -1, []candleSeries{series})
+
+	if len(server.commands) != 2 || server.commands[0].Reset != "true" || server.commands[1].Reset != "false" {
+		t.Fatalf("commands = %+v, want a reset page and a continued page", server.commands)
+	}
+	if len(saved) != 2 || saved[0].Complete != 0 || saved[1].Complete != 1 || saved[1].Candles != 3 {
+		t.Fatalf("checkpoints = %+v", saved)
+	}
+}
+
+func TestCandleBackfillResumesWithoutRewritingStoredCandles(t *testing.T) {
+	var saved []backfillCheckpoint
+	minute := func(clock string) time.Time {
+		at, _ := time.ParseInLocation(tradeTimeLayout, "14.08.2026 "+clock, moscowLocation)
+		return at
+	}
+	backfill := newTestCandleBackfill([]backfillCheckpoint{{
+		SecCode: "SBER", PeriodSeconds: 60, Candles: 3, Oldest: minute("10:01:00"), Newest: minute("10:03:00"),
+	}}, &saved)
+	page := func(status int, clocks ...string) commands.Candles {
+		candles := commands.Candles{SecId: 1, Period: 1, Status: status}
+		for _, clock := range clocks {
+			candles.Items = append(candles.Items, commands.Candle{Date: "14.08.2026 " + clock})
+		}
+		return candles
+	}
+	var written []string
+	server := &fakeHistoryServer{
+		handle: backfill.observe(func(_ context.Context, event historyCandlesEvent) error {
+			for _, candle := range event.Candles.Items {
+				written = append(written, candle.Date[11:])
+			}
+			return nil
+		}),
+		responses: []commands.Candles{
+			page(candlesStatusCountDelivered, "10:00:00", "10:01:00", "10:02:00", "10:03:00", "10:04:00"),
+			page(candlesStatusNoMoreData, "09:59:00"),
+		},
+	}
+
+	backfill.run(context.Background(), server.send, -1, []candleSeries{{SecId: 1, SecCode: "SBER", Period: 1, PeriodSeconds: 60}})
+
+	if len(server.commands) != 2 || server.commands[0].Count != 5 || server.commands[1].Count != 2 {
+		t.Fatalf("commands = %+v, want the stored candles and a page, then a page", server.commands)
+	}
+	if !slices.Equal(written, []string{"10:00:00", "10:03:00", "10:04:00", "09:59:00"}) {
+		t.Fatalf("written candles = %v", written)
+	}
+	last := saved[len(saved)-1]
+	if last.Complete != 1 || last.Candles != 6 || !last.Oldest.Equal(minute("09:59:00")) || !last.Newest.Equal(minute("10:04:00")) {
+		t.Fatalf("checkpoint = %+v", last)
+	}
+}
+
+func TestCandleBackfillRefreshesOnlyLatestPageOfCompleteSeries(t *testing.T) {
+	var saved []backfillCheckpoint
+	backfill := newTestCandleBackfill([]backfillCheckpoint{{SecCode: "SBER", PeriodSeconds: 60, Complete: 1}}, &saved)
+	server := &fakeHistoryServer{
+		handle: backfill.observe(func(context.Context, historyCandlesEvent) error { return nil }),
+		responses: []commands.Candles{
+			{SecId: 1, Period: 1, Status: candlesStatusCountDelivered, Items: make([]commands.Candle, 2)},
+		},
+	}
+
+	backfill.run(context.Background(), server.send, -1, []candleSeries{{SecId: 1, SecCode: "SBER", Period: 1, PeriodSeconds: 60}})
+
+	if len(server.commands) != 1 || len(saved) != 0 {
+		t.Fatalf("commands = %+v, checkpoints = %+v, want one page and no checkpoint", server.commands, saved)
+	}
+}
+
+func TestCandleBackfillSkipsSeriesWithoutResponse(t *testing.T) {
+	var saved []backfillCheckpoint
+	backfill := newTestCandleBackfill(nil, &saved)
+	backfill.config.ResponseTimeout = 10 * time.Millisecond
+	server := &fakeHistoryServer{handle: backfill.observe(func(context.Context, historyCandlesEvent) error { return nil })}
+
+	backfill.run(context.Background(), server.send, 100, []candleSeries{
+		{SecId: 1, SecCode: "SBER", Period: 1, PeriodSeconds: 60},
+		{SecId: 2, SecCode: "GAZP", Period: 1, PeriodSeconds: 60},
+	})
+
+	if len(server.commands) != 2 || server.commands[1].SecId != 2 || server.commands[1].Count != 100 {
+		t.Fatalf("commands = %+v, want both series requested", server.commands)
+	}
+}
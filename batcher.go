@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// batchFlushTimeout bounds the final flush on shutdown.
+const batchFlushTimeout = 30 * time.Second
+
+type batchConfig struct {
+	MaxRows  int           `yaml:"max_rows"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+// batcher accumulates events across TRANSAQ messages and hands them to flush
+// as one batch once MaxRows rows are pending or MaxDelay has passed since the
+// first pending event. This keeps ClickHouse from creating a part per message.
+type batcher[T any] struct {
+	name    string
+	config  batchConfig
+	rows    func(T) int
+	flushTo func(context.Context, []T) error
+
+	// lock guards the pending events only, flushes run outside of it so a
+	// slow sink does not block add.
+	lock        sync.Mutex
+	pending     []T
+	pendingRows int
+	timer       *time.Timer
+	// flushed is closed once the last batch taken is written, the next one
+	// waits for it so batches reach the sinks in order.
+	flushed chan struct{}
+}
+
+func newBatcher[T any](name string, config batchConfig, rows func(T) int, flush func(context.Context, []T) error) *batcher[T] {
+	return &batcher[T]{name: name, config: config, rows: rows, flushTo: flush}
+}
+
+func (b *batcher[T]) add(addCtx context.Context, event T) error {
+	b.lock.Lock()
+	b.pending = append(b.pending, event)
+	b.pendingRows += b.rows(event)
+	if b.pendingRows < b.config.MaxRows {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.config.MaxDelay, b.flushOnTimer)
+		}
+		b.lock.Unlock()
+		return nil
+	}
+	taken := b.takeLocked()
+	b.lock.Unlock()
+	return b.write(addCtx, taken)
+}
+
+func (b *batcher[T]) flushOnTimer() {
+	b.lock.Lock()
+	taken := b.takeLocked()
+	b.lock.Unlock()
+	if err := b.write(context.Background(), taken); err != nil {
+		log.Errorf("Flush %s batch: %v", b.name, err)
+	}
+}
+
+// flush writes out whatever is pending, it is called on shutdown.
+func (b *batcher[T]) flush(flushCtx context.Context) error {
+	b.lock.Lock()
+	taken := b.takeLocked()
+	b.lock.Unlock()
+	return b.write(flushCtx, taken)
+}
+
+// takenBatch is the pending events taken for a flush, with the flush before
+// it to wait for and the channel closed once it is written.
+type takenBatch[T any] struct {
+	events   []T
+	previous <-chan struct{}
+	done     chan struct{}
+}
+
+func (b *batcher[T]) takeLocked() takenBatch[T] {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	taken := takenBatch[T]{events: b.pending, previous: b.flushed, done: make(chan struct{})}
+	b.flushed = taken.done
+	b.pending = nil
+	b.pendingRows = 0
+	return taken
+}
+
+// write hands the taken events to flushTo after the batches taken before
+// them were written.
+func (b *batcher[T]) write(flushCtx context.Context, taken takenBatch[T]) error {
+	defer close(taken.done)
+	if taken.previous != nil {
+		<-taken.previous
+	}
+	if len(taken.events) == 0 {
+		return nil
+	}
+	return b.flushTo(flushCtx, taken.events)
+}
+
+func tradeRows(trades commands.AllTrades) int {
+	return len(trades.Items)
+}
+
+func quoteRows(quotes commands.Quotes) int {
+	return len(quotes.Items)
+}
+
+func insertTradesBatch(insertCtx context.Context, batch []commands.AllTrades) error {
+	return insertTrades(insertCtx, batch...)
+}
+
+func insertQuotesBatch(insertCtx context.Context, batch []commands.Quotes) error {
+	return insertQuotes(insertCtx, batch...)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestBatcherFlushesOnRowsDelayAndShutdown(t *testing.T) {
+	flushed := make(chan []commands.AllTrades, 4)
+	trades := newBatcher("trades", batchConfig{MaxRows: 3, MaxDelay: 20 * time.Millisecond}, tradeRows,
+		func(_ context.Context, batch []commands.AllTrades) error {
+			flushed <- batch
+			return nil
+		})
+	message := func(rows int) commands.AllTrades {
+		return commands.AllTrades{Items: make([]commands.Trade, rows)}
+	}
+
+	// Two messages reaching MaxRows are flushed together right away.
+	_ = trades.add(context.Background(), message(1))
+	_ = trades.add(context.Background(), message(2))
+	select {
+	case batch := <-flushed:
+		if len(batch) != 2 {
+			t.Fatalf("size flush messages = %d, want 2", len(batch))
+		}
+	default:
+		t.Fatal("batch was not flushed when max_rows was reached")
+	}
+
+	// A message below MaxRows is flushed once MaxDelay passes.
+	_ = trades.add(context.Background(), message(1))
+	select {
+	case batch := <-flushed:
+		if len(batch) != 1 {
+			t.Fatalf("delay flush messages = %d, want 1", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch was not flushed after max_delay")
+	}
+
+	// The shutdown flush writes the tail without waiting for the timer.
+	trades.config.MaxDelay = time.Hour
+	_ = trades.add(context.Background(), message(1))
+	if err := trades.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case batch := <-flushed:
+		if len(batch) != 1 {
+			t.Fatalf("shutdown flush messages = %d, want 1", len(batch))
+		}
+	default:
+		t.Fatal("shutdown flush lost the pending tail")
+	}
+}
+
+func TestBatcherAddsWhileFlushIsInProgress(t *testing.T) {
+	release := make(chan struct{})
+	flushed := make(chan []commands.AllTrades, 2)
+	trades := newBatcher("trades", batchConfig{MaxRows: 2, MaxDelay: time.Hour}, tradeRows,
+		func(_ context.Context, batch []commands.AllTrades) error {
+			<-release
+			flushed <- batch
+			return nil
+		})
+	message := func(tradeNo int64, rows int) commands.AllTrades {
+		items := make([]commands.Trade, rows)
+		items[0].TradeNo = tradeNo
+		return commands.AllTrades{Items: items}
+	}
+
+	go func() { _ = trades.add(context.Background(), message(1, 2)) }()
+	// Wait until the first batch was taken and its flush hangs.
+	for {
+		trades.lock.Lock()
+		taken := trades.flushed != nil
+		trades.lock.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	added := make(chan error)
+	go func() { added <- trades.add(context.Background(), message(2, 1)) }()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("add waited for the flush in progress")
+	}
+
+	shutdown := make(chan error)
+	go func() { shutdown <- trades.flush(context.Background()) }()
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if first, second := <-flushed, <-flushed; first[0].Items[0].TradeNo != 1 || second[0].Items[0].TradeNo != 2 {
+		t.Fatalf("batches out of order: %+v, %+v", first, second)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values of the source column of transaq_candles.
+const (
+	candleSourceHistory    = "history"
+	candleSourceQuotations = "quotations"
+	candleSourceTrades     = "trades"
+)
+
+// candleCloseTick is how often open candles are checked for a closed bucket.
+const candleCloseTick = time.Second
+
+type candlesConfig struct {
+	// TradePeriodSeconds lists the periods of candles built from all trades.
+	// Every period divides a day, so buckets start at Moscow midnight.
+	TradePeriodSeconds []int `yaml:"trade_period_seconds"`
+	// CloseDelay is how long a candle waits for late trades after its bucket
+	// ended before it is written.
+	CloseDelay time.Duration `yaml:"close_delay"`
+}
+
+// aggregatedCandle is a candle the exporter built itself from ticks.
+type aggregatedCandle struct {
+	Start         time.Time
+	Board         string
+	SecCode       string
+	PeriodSeconds int
+	Source        string
+	Open          float64
+	High          float64
+	Low           float64
+	Close         float64
+	Volume        int64
+	Trades        int
+	Turnover      float64
+}
+
+func (candle aggregatedCandle) vwap() float64 {
+	if candle.Volume == 0 {
+		return candle.Close
+	}
+	return candle.Turnover / float64(candle.Volume)
+}
+
+// quotationsEvent is a quotations message with the time it was received.
+// Quotations only carry the clock of the last trade, the receive time gives
+// it a date.
+type quotationsEvent struct {
+	Received time.Time
+	Items    []commands.Quotation
+}
+
+// quotationTick is the last trade a quotation reported for a security.
+// numTrades tells apart trades with the same time, price and quantity.
+type quotationTick struct {
+	at        time.Time
+	price     float64
+	quantity  int
+	numTrades int
+}
+
+// quotationTime dates the HH:MM:SS clock of a quotation by the Moscow day it
+// was received. A clock ahead of the receive time belongs to the day before,
+// as when the last trade of a day is reported after midnight.
+func quotationTime(received time.Time, clock string) (time.Time, error) {
+	parsed, err := time.Parse(time.TimeOnly, clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	received = received.In(moscowLocation)
+	at := time.Date(received.Year(), received.Month(), received.Day(),
+		parsed.Hour(), parsed.Minute(), parsed.Second(), 0, moscowLocation)
+	if at.After(received.Add(time.Hour)) {
+		at = at.AddDate(0, 0, -1)
+	}
+	return at, nil
+}
+
+type candleKey struct {
+	board         string
+	secCode       string
+	periodSeconds int
+}
+
+// candleAggregator builds OHLCV candles of several periods from ticks. A
+// candle is handed to emit once a tick of the next bucket arrives or once
+// its bucket plus the close delay has passed.
+type candleAggregator struct {
+	source     string
+	periods    []int
+	closeDelay time.Duration
+	emit       func(context.Context, []aggregatedCandle) error
+	// update, when set, receives the open candles a message changed.
+	update func([]aggregatedCandle)
+	now    func() time.Time
+
+	lock sync.Mutex
+	open map[candleKey]*aggregatedCandle
+	// closed is the start of the last emitted bucket, ticks that are older
+	// would overwrite a written candle with a partial one and are dropped.
+	closed        map[candleKey]time.Time
+	lastTradeNo   map[string]int64
+	lastQuotation map[string]quotationTick
+	timer         *time.Timer
+}
+
+func newCandleAggregator(source string, periods []int, closeDelay time.Duration, emit func(context.Context, []aggregatedCandle) error) *candleAggregator {
+	return &candleAggregator{
+		source:        source,
+		periods:       periods,
+		closeDelay:    closeDelay,
+		emit:          emit,
+		now:           time.Now,
+		open:          map[candleKey]*aggregatedCandle{},
+		closed:        map[candleKey]time.Time{},
+		lastTradeNo:   map[string]int64{},
+		lastQuotation: map[string]quotationTick{},
+	}
+}
+
+// bucketStart returns the start of the period long bucket holding at,
+// counted from Moscow midnight.
+func bucketStart(at time.Time, period time.Duration) time.Time {
+	at = at.In(moscowLocation)
+	midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, moscowLocation)
+	return midnight.Add(at.Sub(midnight).Truncate(period))
+}
+
+// addTrades feeds an all trades message. TRANSAQ may resend trades after a
+// resubscription, trades not newer than the last seen trade number of the
+// security are skipped.
+func (aggregator *candleAggregator) addTrades(addCtx context.Context, trades commands.AllTrades) error {
+	if len(aggregator.periods) == 0 {
+		return nil
+	}
+	aggregator.lock.Lock()
+	var closed []aggregatedCandle
+	touched := map[string]bool{}
+	for _, trade := range trades.Items {
+		tradeTime, err := time.ParseInLocation(tradeTimeLayout, trade.Time, moscowLocation)
+		if err != nil {
+			log.Debugf("Skip trade %d with time %q in candles: %v", trade.TradeNo, trade.Time, err)
+			continue
+		}
+		security := trade.Board + ":" + trade.SecCode
+		if lastTradeNo, ok := aggregator.lastTradeNo[security]; ok && trade.TradeNo <= lastTradeNo {
+			continue
+		}
+		aggregator.lastTradeNo[security] = trade.TradeNo
+		closed = aggregator.addTickLocked(closed, trade.Board, trade.SecCode, tradeTime, trade.Price, int64(trade.Quantity), 1)
+		touched[security] = true
+	}
+	aggregator.scheduleLocked()
+	updated := aggregator.openCandlesLocked(touched)
+	aggregator.lock.Unlock()
+	aggregator.publishUpdated(updated)
+	return aggregator.emitClosed(addCtx, closed)
+}
+
+// addQuotations feeds the last trade of every quotation that reports one.
+// The quotations are the states merged by quotationStates, a delta leaves out
+// the last price of a trade at the same price. A state whose last trade did
+// not change, as when only other fields changed or on resubscription, and a
+// trade older than the last one are skipped.
+func (aggregator *candleAggregator) addQuotations(addCtx context.Context, event quotationsEvent) error {
+	aggregator.lock.Lock()
+	var closed []aggregatedCandle
+	touched := map[string]bool{}
+	for _, quotation := range event.Items {
+		if quotation.Last <= 0 || quotation.Time == "" {
+			continue
+		}
+		at, err := quotationTime(event.Received, quotation.Time)
+		if err != nil {
+			log.Debugf("Skip quotation of %s with time %q in candles: %v", quotation.SecCode, quotation.Time, err)
+			continue
+		}
+		tick := quotationTick{at: at, price: quotation.Last, quantity: quotation.Quantity, numTrades: quotation.NumTrades}
+		security := quotation.Board + ":" + quotation.SecCode
+		if last, ok := aggregator.lastQuotation[security]; ok && (tick == last || at.Before(last.at)) {
+			continue
+		}
+		aggregator.lastQuotation[security] = tick
+		closed = aggregator.addTickLocked(closed, quotation.Board, quotation.SecCode, at, quotation.Last, int64(quotation.Quantity), 1)
+		touched[security] = true
+	}
+	aggregator.scheduleLocked()
+	updated := aggregator.openCandlesLocked(touched)
+	aggregator.lock.Unlock()
+	aggregator.publishUpdated(updated)
+	return aggregator.emitClosed(addCtx, closed)
+}
+
+func (aggregator *candleAggregator) addTickLocked(
+	closed []aggregatedCandle,
+	board, secCode string,
+	at time.Time,
+	price float64,
+	volume int64,
+	trades int,
+) []aggregatedCandle {
+	for _, periodSeconds := range aggregator.periods {
+		key := candleKey{board: board, secCode: secCode, periodSeconds: periodSeconds}
+		start := bucketStart(at, time.Duration(periodSeconds)*time.Second)
+		if closedStart, ok := aggregator.closed[key]; ok && !start.After(closedStart) {
+			continue
+		}
+		candle := aggregator.open[key]
+		if candle != nil && candle.Start.Before(start) {
+			closed = append(closed, *candle)
+			aggregator.closed[key] = candle.Start
+			candle = nil
+		}
+		if candle == nil {
+			candle = &aggregatedCandle{
+				Start:         start,
+				Board:         board,
+				SecCode:       secCode,
+				PeriodSeconds: periodSeconds,
+				Source:        aggregator.source,
+				Open:          price,
+				High:          price,
+				Low:           price,
+			}
+			aggregator.open[key] = candle
+		}
+		candle.High = max(candle.High, price)
+		candle.Low = min(candle.Low, price)
+		candle.Close = price
+		candle.Volume += volume
+		candle.Trades += trades
+		candle.Turnover += price * float64(volume)
+	}
+	return closed
+}
+
+func (aggregator *candleAggregator) scheduleLocked() {
+	if aggregator.timer == nil && len(aggregator.open) > 0 {
+		aggregator.timer = time.AfterFunc(candleCloseTick, aggregator.closeOnTimer)
+	}
+}
+
+func (aggregator *candleAggregator) closeOnTimer() {
+	aggregator.lock.Lock()
+	aggregator.timer = nil
+	closed := aggregator.closeLocked(func(candle *aggregatedCandle) bool {
+		end := candle.Start.Add(time.Duration(candle.PeriodSeconds)*time.Second + aggregator.closeDelay)
+		return !aggregator.now().Before(end)
+	})
+	aggregator.scheduleLocked()
+	aggregator.lock.Unlock()
+	if err := aggregator.emitClosed(context.Background(), closed); err != nil {
+		log.Errorf("Write %s candles: %v", aggregator.source, err)
+	}
+}
+
+// flush writes out the open candles, it is called on shutdown.
+func (aggregator *candleAggregator) flush(flushCtx context.Context) error {
+	aggregator.lock.Lock()
+	if aggregator.timer != nil {
+		aggregator.timer.Stop()
+		aggregator.timer = nil
+	}
+	closed := aggregator.closeLocked(func(*aggregatedCandle) bool { return true })
+	aggregator.lock.Unlock()
+	return aggregator.emitClosed(flushCtx, closed)
+}
+
+// reset drops the open candles without writing them. Their buckets count as
+// written, so the rest of such a bucket does not produce a partial candle.
+func (aggregator *candleAggregator) reset() {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	for key, candle := range aggregator.open {
+		aggregator.closed[key] = candle.Start
+	}
+	clear(aggregator.open)
+	clear(aggregator.lastQuotation)
+}
+
+func (aggregator *candleAggregator) closeLocked(done func(*aggregatedCandle) bool) []aggregatedCandle {
+	var closed []aggregatedCandle
+	for key, candle := range aggregator.open {
+		if !done(candle) {
+			continue
+		}
+		closed = append(closed, *candle)
+		aggregator.closed[key] = candle.Start
+		delete(aggregator.open, key)
+	}
+	return closed
+}
+
+// openCandlesLocked copies the open candles of the touched securities for
+// update.
+func (aggregator *candleAggregator) openCandlesLocked(touched map[string]bool) []aggregatedCandle {
+	if aggregator.update == nil || len(touched) == 0 {
+		return nil
+	}
+	var updated []aggregatedCandle
+	for key, candle := range aggregator.open {
+		if touched[key.board+":"+key.secCode] {
+			updated = append(updated, *candle)
+		}
+	}
+	return updated
+}
+
+func (aggregator *candleAggregator) publishUpdated(updated []aggregatedCandle) {
+	if len(updated) > 0 {
+		aggregator.update(updated)
+	}
+}
+
+func (aggregator *candleAggregator) emitClosed(emitCtx context.Context, closed []aggregatedCandle) error {
+	if len(closed) == 0 {
+		return nil
+	}
+	return aggregator.emit(emitCtx, closed)
+}
+
+func candleRows(candles []aggregatedCandle) int {
+	return len(candles)
+}
+
+func insertCandlesBatch(insertCtx context.Context, batch [][]aggregatedCandle) (err error) {
+	rows := 0
+	for _, candles := range batch {
+		rows += len(candles)
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_candles", rows, started, err) }()
+	candlesBatch, err := connect.PrepareBatch(insertCtx, ChCandlesInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare candles batch: %w", err)
+	}
+	defer candlesBatch.Close()
+	for _, candles := range batch {
+		for _, candle := range candles {
+			if err := candlesBatch.Append(
+				candle.Start.In(moscowLocation).Format(tableTimeLayout),
+				candle.SecCode,
+				uint16(0),
+				float32(candle.Open),
+				float32(candle.Close),
+				float32(candle.High),
+				float32(candle.Low),
+				uint64(candle.Volume),
+				candle.Source,
+				uint32(candle.PeriodSeconds),
+				uint32(candle.Trades),
+				candle.vwap(),
+			); err != nil {
+				return fmt.Errorf("append %s candle %s: %w", candle.SecCode, candle.Start, err)
+			}
+		}
+	}
+	if err := candlesBatch.Send(); err != nil {
+		return fmt.Errorf("send candles batch: %w", err)
+	}
+	return nil
+}
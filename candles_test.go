@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestCandleAggregatorClosesBucketOnNextTrade(t *testing.T) {
+	var emitted []aggregatedCandle
+	aggregator := newCandleAggregator(candleSourceTrades, []int{60, 300}, time.Hour, func(_ context.Context, candles []aggregatedCandle) error {
+		emitted = append(emitted, candles...)
+		return nil
+	})
+	defer func() { _ = aggregator.flush(context.Background()) }()
+
+	trade := func(tradeNo int64, clock string, price float64, quantity int) commands.Trade {
+		return commands.Trade{SecCode: "SBER", Board: "TQBR", TradeNo: tradeNo, Time: "14.08.2026 " + clock, Price: price, Quantity: quantity}
+	}
+	if err := aggregator.addTrades(context.Background(), commands.AllTrades{Items: []commands.Trade{
+		trade(1, "10:00:05", 100, 1),
+		trade(2, "10:00:30", 103, 3),
+		trade(2, "10:00:30", 103, 3), // resent after resubscription
+		trade(3, "10:00:59", 101, 1),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(emitted) != 0 {
+		t.Fatalf("emitted before bucket close: %+v", emitted)
+	}
+	if err := aggregator.addTrades(context.Background(), commands.AllTrades{Items: []commands.Trade{
+		trade(4, "10:01:00", 99, 2),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(emitted) != 1 {
+		t.Fatalf("emitted = %+v, want one 1m candle", emitted)
+	}
+	candle := emitted[0]
+	wantStart := time.Date(2026, time.August, 14, 10, 0, 0, 0, moscowLocation)
+	if !candle.Start.Equal(wantStart) || candle.PeriodSeconds != 60 || candle.Source != candleSourceTrades {
+		t.Fatalf("candle = %+v", candle)
+	}
+	if candle.Open != 100 || candle.High != 103 || candle.Low != 100 || candle.Close != 101 || candle.Volume != 5 || candle.Trades != 3 {
+		t.Fatalf("candle OHLCV = %+v", candle)
+	}
+	if vwap := candle.vwap(); vwap != (100+103*3+101)/5.0 {
+		t.Fatalf("vwap = %v", vwap)
+	}
+
+	// A trade of the 1m bucket already written must not start a partial
+	// candle, the 5m candle is still open and takes it.
+	if err := aggregator.addTrades(context.Background(), commands.AllTrades{Items: []commands.Trade{
+		{SecCode: "SBER", Board: "TQBR", TradeNo: 5, Time: "14.08.2026 10:00:58", Price: 1, Quantity: 1},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	emitted = nil
+	if err := aggregator.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(emitted) != 2 {
+		t.Fatalf("flushed = %+v, want the open 1m and 5m candles", emitted)
+	}
+	for _, candle := range emitted {
+		if candle.PeriodSeconds == 60 && candle.Low == 1 {
+			t.Fatalf("late trade got into %+v", candle)
+		}
+	}
+}
+
+func TestCandleAggregatorClosesBucketOnTimer(t *testing.T) {
+	emitted := make(chan []aggregatedCandle, 1)
+	aggregator := newCandleAggregator(candleSourceTrades, []int{1}, 0, func(_ context.Context, candles []aggregatedCandle) error {
+		emitted <- candles
+		return nil
+	})
+	aggregator.now = func() time.Time { return time.Date(2026, time.August, 14, 10, 0, 2, 0, moscowLocation) }
+	if err := aggregator.addTrades(context.Background(), commands.AllTrades{Items: []commands.Trade{
+		{SecCode: "SBER", Board: "TQBR", TradeNo: 1, Time: "14.08.2026 10:00:00", Price: 100, Quantity: 1},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case candles := <-emitted:
+		if len(candles) != 1 || candles[0].PeriodSeconds != 1 {
+			t.Fatalf("candles = %+v", candles)
+		}
+	case <-time.After(5 * candleCloseTick):
+		t.Fatal("candle was not closed by the timer")
+	}
+}
+
+func TestBucketStartCountsFromMoscowMidnight(t *testing.T) {
+	at := time.Date(2026, time.August, 14, 0, 30, 0, 0, time.UTC) // 03:30 MSK
+	if start := bucketStart(at, 24*time.Hour); !start.Equal(time.Date(2026, time.August, 14, 0, 0, 0, 0, moscowLocation)) {
+		t.Fatalf("day bucket = %s", start)
+	}
+	if start := bucketStart(at, time.Hour); !start.Equal(time.Date(2026, time.August, 14, 3, 0, 0, 0, moscowLocation)) {
+		t.Fatalf("hour bucket = %s", start)
+	}
+}
+
+func TestQuotationCandlesRollOverByQuotationTime(t *testing.T) {
+	var emitted []aggregatedCandle
+	aggregator := newCandleAggregator(candleSourceQuotations, []int{60}, time.Hour, func(_ context.Context, candles []aggregatedCandle) error {
+		emitted = append(emitted, candles...)
+		return nil
+	})
+	defer func() { _ = aggregator.flush(context.Background()) }()
+
+	received := time.Date(2026, time.August, 14, 10, 2, 0, 0, moscowLocation)
+	quotation := func(clock string, last float64, quantity int) commands.Quotation {
+		return commands.Quotation{SecCode: "SBER", Board: "TQBR", Time: clock, Last: last, Quantity: quantity}
+	}
+	for _, items := range [][]commands.Quotation{
+		{quotation("10:00:10", 100, 1), {SecCode: "SBER", Board: "TQBR", Bid: 99}},
+		{quotation("10:00:40", 102, 2)},
+		{quotation("10:00:40", 102, 2)}, // snapshot after resubscription
+		// No quotation ends at hh:mm:00, the next minute closes the bar.
+		{quotation("10:01:05", 101, 1)},
+	} {
+		if err := aggregator.addQuotations(context.Background(), quotationsEvent{Received: received, Items: items}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(emitted) != 1 {
+		t.Fatalf("emitted = %+v, want the 10:00 bar", emitted)
+	}
+	bar := emitted[0]
+	if !bar.Start.Equal(time.Date(2026, time.August, 14, 10, 0, 0, 0, moscowLocation)) ||
+		bar.Open != 100 || bar.High != 102 || bar.Low != 100 || bar.Close != 102 || bar.Volume != 3 {
+		t.Fatalf("bar = %+v", bar)
+	}
+}
+
+func TestQuotationCandlesCountTradesOfMergedStates(t *testing.T) {
+	var emitted []aggregatedCandle
+	aggregator := newCandleAggregator(candleSourceQuotations, []int{60}, time.Hour, func(_ context.Context, candles []aggregatedCandle) error {
+		emitted = append(emitted, candles...)
+		return nil
+	})
+	states := newQuotationStates()
+	received := time.Date(2026, time.August, 14, 10, 2, 0, 0, moscowLocation)
+	for _, delta := range []commands.Quotation{
+		{SecCode: "SBER", Board: "TQBR", Time: "10:00:10", Last: 100, Quantity: 1, NumTrades: 10},
+		// The same price is left out of the delta.
+		{SecCode: "SBER", Board: "TQBR", Time: "10:00:20", Quantity: 3, NumTrades: 11},
+		// A trade with the same time, price and quantity.
+		{SecCode: "SBER", Board: "TQBR", NumTrades: 12},
+		{SecCode: "SBER", Board: "TQBR", Bid: 99},
+		{SecCode: "SBER", Board: "TQBR", Time: "10:01:05", Last: 101, Quantity: 1, NumTrades: 13},
+	} {
+		merged := states.merge(quotationsEvent{Received: received, Items: []commands.Quotation{delta}})
+		if err := aggregator.addQuotations(context.Background(), merged); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(emitted) != 1 || emitted[0].Trades != 3 || emitted[0].Volume != 7 || emitted[0].Close != 100 {
+		t.Fatalf("emitted = %+v, want the 10:00 bar of 3 trades and volume 7", emitted)
+	}
+}
+
+func TestQuotationCandlesResetDropsIncompleteMinute(t *testing.T) {
+	var emitted []aggregatedCandle
+	aggregator := newCandleAggregator(candleSourceQuotations, []int{60}, time.Hour, func(_ context.Context, candles []aggregatedCandle) error {
+		emitted = append(emitted, candles...)
+		return nil
+	})
+	received := time.Date(2026, time.August, 14, 10, 0, 30, 0, moscowLocation)
+	add := func(clock string, last float64) {
+		t.Helper()
+		if err := aggregator.addQuotations(context.Background(), quotationsEvent{Received: received, Items: []commands.Quotation{
+			{SecCode: "SBER", Board: "TQBR", Time: clock, Last: last, Quantity: 1},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("10:00:10", 100)
+	aggregator.reset()
+	add("10:00:50", 101)
+	add("10:01:10", 102)
+	if err := aggregator.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(emitted) != 1 || emitted[0].Open != 102 {
+		t.Fatalf("emitted = %+v, want only the 10:01 bar", emitted)
+	}
+}
+
+func TestQuotationTimeHandlesDayBoundary(t *testing.T) {
+	received := time.Date(2026, time.August, 15, 0, 0, 3, 0, moscowLocation)
+	at, err := quotationTime(received, "23:59:58")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, time.August, 14, 23, 59, 58, 0, moscowLocation); !at.Equal(want) {
+		t.Fatalf("quotation time = %s, want %s", at, want)
+	}
+	if at, _ := quotationTime(received, "00:00:01"); at.Day() != 15 {
+		t.Fatalf("quotation time = %s, want the receive day", at)
+	}
+}
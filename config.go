@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvKeyConfigFile         = "CONFIG_FILE"
+	EnvKeyClickHouseURL      = "CLICKHOUSE_URL"
+	EnvKeyPostgresURL        = "POSTGRES_URL"
+	EnvKeyExportSecBoards    = "EXPORT_SEC_BOARDS"
+	EnvKeyExportSecCodes     = "EXPORT_SEC_CODES"
+	EnvKeyExportAllTrades    = "EXPORT_ALL_TRADES"
+	EnvKeyExportPeriods      = "EXPORT_PERIOD_SECONDS"
+	EnvKeyExportCandleCount  = "EXPORT_CANDLE_COUNT"
+	EnvKeyExportSecInfoNames = "EXPORT_SEC_INFO_NAMES"
+	EnvKeySpoolDir           = "SPOOL_DIR"
+	EnvKeyHTTPListen         = "HTTP_LISTEN"
+	EnvKeySinks              = "SINKS"
+	EnvKeyJSONLDir           = "JSONL_DIR"
+	EnvKeyParquetDir         = "PARQUET_DIR"
+	EnvKeyKafkaBrokers       = "KAFKA_BROKERS"
+	EnvKeyGRPCListen         = "GRPC_LISTEN"
+	EnvKeyControlToken       = "CONTROL_TOKEN"
+
+	// allTradesPositionsTicker is a pseudo ticker in export.all_trades which adds
+	// every security with an open position to the all trades subscription.
+	allTradesPositionsTicker = "positions"
+)
+
+// knownSecBoards lists the TRANSAQ boards the exporter is known to work with.
+// A typo in the board list silently exports nothing, so unknown boards are
+// rejected at startup.
+var knownSecBoards = []string{
+	"CETS", "EQDB", "EQRP", "FOB", "FUT", "MTQR", "OPT", "SMAL", "SPEQ",
+	"TQBR", "TQCB", "TQDE", "TQIF", "TQIR", "TQOB", "TQOD", "TQPI", "TQRD", "TQTD", "TQTE", "TQTF",
+}
+
+// knownCandlePeriods are the candle kinds offered by TRANSAQ servers, in seconds.
+var knownCandlePeriods = []int{60, 300, 900, 3600, 86400, 604800}
+
+type exporterConfig struct {
+	// Sinks lists where the exported data is written, see knownSinks.
+	Sinks      []string         `yaml:"sinks"`
+	ClickHouse clickHouseConfig `yaml:"clickhouse"`
+	Postgres   postgresConfig   `yaml:"postgres"`
+	JSONL      jsonlConfig      `yaml:"jsonl"`
+	Parquet    parquetConfig    `yaml:"parquet"`
+	Kafka      kafkaConfig      `yaml:"kafka"`
+	Export     exportConfig     `yaml:"export"`
+	Spool      spoolConfig      `yaml:"spool"`
+	Retry      retryConfig      `yaml:"retry"`
+	DeadLetter deadLetterConfig `yaml:"dead_letter"`
+	HTTP       httpConfig       `yaml:"http"`
+	GRPC       grpcConfig       `yaml:"grpc"`
+	WebSocket  websocketConfig  `yaml:"websocket"`
+	Control    controlConfig    `yaml:"control"`
+	Health     healthConfig     `yaml:"health"`
+	Batch      batchConfig      `yaml:"batch"`
+	Candles    candlesConfig    `yaml:"candles"`
+	Backfill   backfillConfig   `yaml:"backfill"`
+	Gaps       gapsConfig       `yaml:"gaps"`
+	TradeGaps  tradeGapsConfig  `yaml:"trade_gaps"`
+	OrderBook  orderBookConfig  `yaml:"orderbook"`
+}
+
+// httpConfig is the listen address of the /metrics, /healthz and /readyz
+// endpoints. An empty address disables the HTTP server.
+type httpConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type clickHouseConfig struct {
+	URL string `yaml:"url"`
+}
+
+// postgresConfig is the DSN of the PostgreSQL/TimescaleDB database written by
+// the postgres sink.
+type postgresConfig struct {
+	URL string `yaml:"url"`
+}
+
+type exportConfig struct {
+	SecBoards     []string `yaml:"sec_boards"`
+	SecCodes      []string `yaml:"sec_codes"`
+	AllTrades     []string `yaml:"all_trades"`
+	PeriodSeconds []int    `yaml:"period_seconds"`
+	CandleCount   int      `yaml:"candle_count"`
+	SecInfoNames  []string `yaml:"sec_info_names"`
+}
+
+// spoolConfig enables the on-disk spool for events ClickHouse did not accept.
+// An empty dir disables spooling.
+type spoolConfig struct {
+	Dir            string        `yaml:"dir"`
+	SegmentSizeMB  int64         `yaml:"segment_size_mb"`
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+}
+
+func defaultExporterConfig() exporterConfig {
+	return exporterConfig{
+		Sinks:      []string{sinkClickHouse},
+		ClickHouse: clickHouseConfig{URL: "tcp://127.0.0.1:9000"},
+		JSONL:      jsonlConfig{MaxSizeMB: 256},
+		Parquet:    parquetConfig{RollInterval: 15 * time.Minute},
+		Kafka:      kafkaConfig{TopicPrefix: "transaq.", DeliveryTimeout: 30 * time.Second},
+		Export: exportConfig{
+			SecBoards:   []string{"TQBR", "TQCB", "FUT"},
+			CandleCount: ExportCandleCount,
+		},
+		Spool: spoolConfig{
+			SegmentSizeMB:  64,
+			ReplayInterval: 10 * time.Second,
+		},
+		HTTP:      httpConfig{Listen: ":9310"},
+		GRPC:      grpcConfig{BufferSize: 1024},
+		WebSocket: websocketConfig{BufferSize: 256},
+		Health: healthConfig{
+			StaleAfter:   5 * time.Minute,
+			QueueLimit:   100000,
+			TradingStart: "07:00",
+			TradingEnd:   "23:50",
+		},
+		Batch: batchConfig{
+			MaxRows:  10000,
+			MaxDelay: time.Second,
+		},
+		Candles: candlesConfig{
+			CloseDelay: 2 * time.Second,
+		},
+		Backfill: backfillConfig{
+			PageSize:        5000,
+			ResponseTimeout: time.Minute,
+		},
+		OrderBook: orderBookConfig{
+			Interval: 10 * time.Second,
+			Depth:    10,
+		},
+		Gaps: gapsConfig{
+			Interval: time.Hour,
+			Lookback: 72 * time.Hour,
+			// Main and evening sessions without the futures clearings.
+			Sessions: []string{"10:00-14:00", "14:05-18:40", "19:05-23:50"},
+		},
+		Retry: retryConfig{
+			Attempts: 5,
+			MinDelay: 500 * time.Millisecond,
+			MaxDelay: 30 * time.Second,
+		},
+	}
+}
+
+// loadConfig reads the YAML file at path (if any), applies environment
+// overrides and validates the result. An empty path means defaults plus
+// environment, which keeps env-only deployments working.
+func loadConfig(path string) (exporterConfig, error) {
+	config := defaultExporterConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("read config: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return config, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return config, err
+	}
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+func (config *exporterConfig) applyEnv(lookup func(string) (string, bool)) error {
+	if value, ok := lookup(EnvKeyClickHouseURL); ok && value != "" {
+		config.ClickHouse.URL = value
+	}
+	if value, ok := lookup(EnvKeyPostgresURL); ok && value != "" {
+		config.Postgres.URL = value
+	}
+	if value, ok := lookup(EnvKeySpoolDir); ok && value != "" {
+		config.Spool.Dir = value
+	}
+	if value, ok := lookup(EnvKeyJSONLDir); ok && value != "" {
+		config.JSONL.Dir = value
+	}
+	if value, ok := lookup(EnvKeyParquetDir); ok && value != "" {
+		config.Parquet.Dir = value
+	}
+	if value, ok := lookup(EnvKeyHTTPListen); ok && value != "" {
+		config.HTTP.Listen = value
+	}
+	if value, ok := lookup(EnvKeyGRPCListen); ok && value != "" {
+		config.GRPC.Listen = value
+	}
+	if value, ok := lookup(EnvKeyControlToken); ok && value != "" {
+		config.Control.Token = value
+	}
+	for key, target := range map[string]*[]string{
+		EnvKeyExportSecBoards:    &config.Export.SecBoards,
+		EnvKeyExportSecCodes:     &config.Export.SecCodes,
+		EnvKeyExportAllTrades:    &config.Export.AllTrades,
+		EnvKeyExportSecInfoNames: &config.Export.SecInfoNames,
+		EnvKeySinks:              &config.Sinks,
+		EnvKeyKafkaBrokers:       &config.Kafka.Brokers,
+	} {
+		if value, ok := lookup(key); ok && value != "" {
+			*target = splitList(value)
+		}
+	}
+	if value, ok := lookup(EnvKeyExportPeriods); ok && value != "" {
+		config.Export.PeriodSeconds = config.Export.PeriodSeconds[:0]
+		for _, item := range splitList(value) {
+			period, err := strconv.Atoi(item)
+			if err != nil {
+				return fmt.Errorf("%s: bad period %q", EnvKeyExportPeriods, item)
+			}
+			config.Export.PeriodSeconds = append(config.Export.PeriodSeconds, period)
+		}
+	}
+	if value, ok := lookup(EnvKeyExportCandleCount); ok && value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: bad candle count %q", EnvKeyExportCandleCount, value)
+		}
+		config.Export.CandleCount = count
+	}
+	return nil
+}
+
+func (config *exporterConfig) validate() error {
+	var errs []error
+	if len(config.Sinks) == 0 {
+		errs = append(errs, errors.New("sinks is empty"))
+	}
+	for i, name := range config.Sinks {
+		if !slices.Contains(knownSinks, name) {
+			errs = append(errs, fmt.Errorf("sinks: unknown sink %q (known: %s)", name, strings.Join(knownSinks, ",")))
+		} else if slices.Contains(config.Sinks[:i], name) {
+			errs = append(errs, fmt.Errorf("sinks: %q is listed twice", name))
+		}
+	}
+	if config.sinkEnabled(sinkClickHouse) {
+		if isPostgresURL(config.ClickHouse.URL) {
+			errs = append(errs, fmt.Errorf("clickhouse.url %q is a PostgreSQL DSN, set it as postgres.url", config.ClickHouse.URL))
+		} else if _, err := clickhouse.ParseDSN(config.ClickHouse.URL); err != nil {
+			errs = append(errs, fmt.Errorf("clickhouse.url %q: %w", config.ClickHouse.URL, err))
+		}
+	}
+	if config.sinkEnabled(sinkPostgres) {
+		if !isPostgresURL(config.Postgres.URL) {
+			errs = append(errs, fmt.Errorf("postgres.url %q, want a postgres:// or postgresql:// DSN", config.Postgres.URL))
+		} else if _, err := pgxpool.ParseConfig(config.Postgres.URL); err != nil {
+			errs = append(errs, fmt.Errorf("postgres.url %q: %w", config.Postgres.URL, err))
+		}
+	}
+	if config.sinkEnabled(sinkJSONL) && (config.JSONL.Dir == "" || config.JSONL.MaxSizeMB <= 0) {
+		errs = append(errs, fmt.Errorf("jsonl: dir %q and max_size_mb %d, want a directory and a positive size", config.JSONL.Dir, config.JSONL.MaxSizeMB))
+	}
+	if config.sinkEnabled(sinkParquet) && config.Parquet.Dir == "" {
+		errs = append(errs, errors.New("parquet.dir is empty"))
+	}
+	if config.Parquet.RollInterval < 0 {
+		errs = append(errs, fmt.Errorf("parquet.roll_interval %s, want a non-negative interval", config.Parquet.RollInterval))
+	}
+	if config.GRPC.Listen != "" && config.GRPC.BufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("grpc.buffer_size %d, want a positive size", config.GRPC.BufferSize))
+	}
+	if config.HTTP.Listen != "" && config.WebSocket.BufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("websocket.buffer_size %d, want a positive size", config.WebSocket.BufferSize))
+	}
+	if config.sinkEnabled(sinkKafka) && (len(config.Kafka.Brokers) == 0 || config.Kafka.DeliveryTimeout <= 0) {
+		errs = append(errs, fmt.Errorf("kafka: brokers %v and delivery_timeout %s, want brokers and a positive timeout", config.Kafka.Brokers, config.Kafka.DeliveryTimeout))
+	}
+	if len(config.Export.SecBoards) == 0 {
+		errs = append(errs, errors.New("export.sec_boards is empty"))
+	}
+	for _, board := range config.Export.SecBoards {
+		if !slices.Contains(knownSecBoards, board) {
+			errs = append(errs, fmt.Errorf("export.sec_boards: unknown board %q (known: %s)", board, strings.Join(knownSecBoards, ",")))
+		}
+	}
+	for _, period := range config.Export.PeriodSeconds {
+		if !slices.Contains(knownCandlePeriods, period) {
+			errs = append(errs, fmt.Errorf("export.period_seconds: unsupported period %d (supported: %v)", period, knownCandlePeriods))
+		}
+	}
+	if config.Export.CandleCount < -1 {
+		errs = append(errs, fmt.Errorf("export.candle_count: %d, want -1 (full history), 0 (disabled) or a positive count", config.Export.CandleCount))
+	}
+	if config.Spool.Dir != "" {
+		if config.Spool.SegmentSizeMB <= 0 {
+			errs = append(errs, fmt.Errorf("spool.segment_size_mb: %d, want a positive size", config.Spool.SegmentSizeMB))
+		}
+		if config.Spool.ReplayInterval <= 0 {
+			errs = append(errs, fmt.Errorf("spool.replay_interval: %s, want a positive duration", config.Spool.ReplayInterval))
+		}
+	}
+	for key, clock := range map[string]string{
+		"health.trading_start": config.Health.TradingStart,
+		"health.trading_end":   config.Health.TradingEnd,
+	} {
+		if _, err := time.Parse("15:04", clock); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q, want HH:MM", key, clock))
+		}
+	}
+	if config.Batch.MaxRows < 1 || config.Batch.MaxDelay <= 0 {
+		errs = append(errs, fmt.Errorf("batch: max_rows %d and max_delay %s, want positive values", config.Batch.MaxRows, config.Batch.MaxDelay))
+	}
+	for _, period := range config.Candles.TradePeriodSeconds {
+		if period < 1 || 86400%period != 0 {
+			errs = append(errs, fmt.Errorf("candles.trade_period_seconds: %d, want a positive divisor of 86400", period))
+		}
+	}
+	if config.Candles.CloseDelay < 0 {
+		errs = append(errs, fmt.Errorf("candles.close_delay: %s, want a non-negative duration", config.Candles.CloseDelay))
+	}
+	if config.Backfill.PageSize < 1 || config.Backfill.ResponseTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("backfill: page_size %d and response_timeout %s, want positive values", config.Backfill.PageSize, config.Backfill.ResponseTimeout))
+	}
+	if config.OrderBook.Interval > 0 && config.OrderBook.Depth < 1 {
+		errs = append(errs, fmt.Errorf("orderbook.depth: %d, want at least 1", config.OrderBook.Depth))
+	}
+	if config.TradeGaps.MaxSilence < 0 {
+		errs = append(errs, fmt.Errorf("trade_gaps.max_silence: %s, want a non-negative duration", config.TradeGaps.MaxSilence))
+	}
+	if config.Gaps.Interval > 0 || config.TradeGaps.MaxSilence > 0 {
+		if config.Gaps.Lookback <= 0 {
+			errs = append(errs, fmt.Errorf("gaps.lookback: %s, want a positive duration", config.Gaps.Lookback))
+		}
+		if _, err := newTradingCalendar(config.Gaps); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.Retry.Attempts < 1 {
+		errs = append(errs, fmt.Errorf("retry.attempts: %d, want at least 1", config.Retry.Attempts))
+	}
+	if config.Retry.MinDelay <= 0 || config.Retry.MaxDelay < config.Retry.MinDelay {
+		errs = append(errs, fmt.Errorf("retry: min_delay %s and max_delay %s, want 0 < min_delay <= max_delay", config.Retry.MinDelay, config.Retry.MaxDelay))
+	}
+	return errors.Join(errs...)
+}
+
+func (config exporterConfig) sinkEnabled(name string) bool {
+	return slices.Contains(config.Sinks, name)
+}
+
+// clickHouseEnabled reports whether data goes to ClickHouse.
+func (config exporterConfig) clickHouseEnabled() bool {
+	return config.sinkEnabled(sinkClickHouse)
+}
+
+// reloadedConfig applies the part of a reloaded config that takes effect
+// without a restart, the export section. The other sections are bound to the
+// sinks, servers and workers built at startup, their changes are reported and
+// the running values are kept.
+func reloadedConfig(running, loaded exporterConfig) exporterConfig {
+	runningValue, loadedValue := reflect.ValueOf(running), reflect.ValueOf(loaded)
+	for i := range runningValue.NumField() {
+		field := runningValue.Type().Field(i)
+		if field.Name != "Export" && !reflect.DeepEqual(runningValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			log.Warnf("%s change requires an exporter restart, keeping the running settings", field.Tag.Get("yaml"))
+		}
+	}
+	running.Export = loaded.Export
+	return running
+}
+
+// allTradesSecCodes returns the tickers from export.all_trades without the
+// positions pseudo ticker.
+func (config exportConfig) allTradesSecCodes() []string {
+	secCodes := make([]string, 0, len(config.AllTrades))
+	for _, secCode := range config.AllTrades {
+		if secCode != allTradesPositionsTicker {
+			secCodes = append(secCodes, secCode)
+		}
+	}
+	return secCodes
+}
+
+func (config exportConfig) allTradesPositions() bool {
+	return slices.Contains(config.AllTrades, allTradesPositionsTicker)
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
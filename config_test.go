@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeTestConfig(t, `
+clickhouse:
+  url: tcp://clickhouse:9000
+export:
+  sec_boards: [TQBR]
+  all_trades: [positions, SBER, GAZP]
+  period_seconds: [60]
+`)
+	t.Setenv(EnvKeyExportSecBoards, "TQBR,FUT")
+	t.Setenv(EnvKeyExportCandleCount, "-1")
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClickHouse.URL != "tcp://clickhouse:9000" {
+		t.Fatalf("clickhouse url = %q", config.ClickHouse.URL)
+	}
+	if !slices.Equal(config.Export.SecBoards, []string{"TQBR", "FUT"}) {
+		t.Fatalf("sec boards = %v", config.Export.SecBoards)
+	}
+	if config.Export.CandleCount != -1 {
+		t.Fatalf("candle count = %d", config.Export.CandleCount)
+	}
+	if !config.Export.allTradesPositions() {
+		t.Fatal("positions pseudo ticker was not detected")
+	}
+	if !slices.Equal(config.Export.allTradesSecCodes(), []string{"SBER", "GAZP"}) {
+		t.Fatalf("all trades = %v", config.Export.allTradesSecCodes())
+	}
+}
+
+func TestLoadConfigPostgresAlongsideClickHouse(t *testing.T) {
+	config, err := loadConfig(writeTestConfig(t, "sinks: [clickhouse, postgres]\npostgres:\n  url: postgres://exporter@127.0.0.1:5432/market\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.clickHouseEnabled() || !config.sinkEnabled(sinkPostgres) {
+		t.Fatalf("sinks = %v", config.Sinks)
+	}
+}
+
+func TestReloadedConfigAppliesOnlyExport(t *testing.T) {
+	running := defaultExporterConfig()
+	loaded := defaultExporterConfig()
+	loaded.Export.SecCodes = []string{"SBER"}
+	loaded.Batch.MaxRows = running.Batch.MaxRows * 2
+	loaded.ClickHouse.URL = "tcp://127.0.0.2:9000"
+
+	next := reloadedConfig(running, loaded)
+	if !slices.Equal(next.Export.SecCodes, []string{"SBER"}) {
+		t.Fatalf("export = %+v", next.Export)
+	}
+	if next.Batch != running.Batch || next.ClickHouse != running.ClickHouse {
+		t.Fatalf("restart-only sections changed: batch %+v, clickhouse %+v", next.Batch, next.ClickHouse)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	for name, test := range map[string]struct {
+		content string
+		want    string
+	}{
+		"unknown board":    {content: "export:\n  sec_boards: [TQBX]\n", want: `unknown board "TQBX"`},
+		"bad period":       {content: "export:\n  period_seconds: [61]\n", want: "unsupported period 61"},
+		"bad dsn":          {content: "clickhouse:\n  url: \"tcp://[::1\"\n", want: "clickhouse.url"},
+		"unknown key":      {content: "export:\n  sec_board: [TQBR]\n", want: "sec_board"},
+		"bad candle cnt":   {content: "export:\n  candle_count: -5\n", want: "export.candle_count"},
+		"uneven candle":    {content: "candles:\n  trade_period_seconds: [7]\n", want: "candles.trade_period_seconds"},
+		"unknown sink":     {content: "sinks: [clickhouse, csv]\n", want: `unknown sink "csv"`},
+		"postgres no url":  {content: "sinks: [postgres]\n", want: "postgres.url"},
+		"postgres in ch":   {content: "clickhouse:\n  url: postgres://exporter@127.0.0.1:5432/market\n", want: "set it as postgres.url"},
+		"no sinks":         {content: "sinks: []\n", want: "sinks is empty"},
+		"jsonl no dir":     {content: "sinks: [jsonl]\n", want: "jsonl: dir"},
+		"parquet no dir":   {content: "sinks: [parquet]\n", want: "parquet.dir is empty"},
+		"grpc no buffer":   {content: "grpc:\n  listen: \":9320\"\n  buffer_size: 0\n", want: "grpc.buffer_size 0"},
+		"kafka no brokers": {content: "sinks: [kafka]\n", want: "kafka: brokers [] and delivery_timeout 30s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, test.content))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("loadConfig error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
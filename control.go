@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	tcClient "github.com/kmlebedev/txmlconnector/client"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscription kinds of the control API paths.
+const (
+	controlKindQuotations = "quotations"
+	controlKindAllTrades  = "all_trades"
+)
+
+// controlTimeout is how long a control request waits for a session.
+const controlTimeout = 10 * time.Second
+
+var (
+	errNoSession         = errors.New("no TRANSAQ session with restored subscriptions")
+	errUnknownSecurity   = errors.New("unknown security")
+	errUnknownCandleKind = errors.New("no candle kind")
+	errBackfillDisabled  = errors.New("candle backfill is disabled")
+)
+
+// controlConfig enables the control API on the HTTP listener. A non-empty
+// token is required as a bearer token.
+type controlConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Token   string `yaml:"token"`
+}
+
+// controlSession is the live session a control request runs in.
+type controlSession struct {
+	client *tcClient.TCClient
+	// backfill pages history candles of series next to the session.
+	backfill func(candleCount int, series []candleSeries) error
+}
+
+// controlRequest is run by processTransaq between TRANSAQ responses, so it
+// sees and changes the subscriptions like restore and reload do.
+type controlRequest struct {
+	run   func(controlSession) (any, error)
+	reply chan controlReply
+}
+
+type controlReply struct {
+	value any
+	err   error
+}
+
+// controlRequests hands the requests of the control API to the session.
+var controlRequests = make(chan controlRequest)
+
+// subscriptionChanges are the subscriptions changed through the control
+// API, true for subscribed, by board:sec_code. They are applied over the
+// selection of the config on every restore and reload, so they survive
+// reconnects and SIGHUP until the exporter restarts.
+type subscriptionChanges struct {
+	quotations map[string]bool
+	allTrades  map[string]bool
+}
+
+var controlChanges = subscriptionChanges{quotations: map[string]bool{}, allTrades: map[string]bool{}}
+
+func (changes subscriptionChanges) apply(selection *securitySelection, securities []commands.Security) {
+	for _, sec := range securities {
+		key := sec.Board + ":" + sec.SecCode
+		if subscribed, ok := changes.quotations[key]; ok {
+			selection.quotations = slices.DeleteFunc(selection.quotations, func(quotation commands.SubSecurity) bool {
+				return quotation.SecId == sec.SecId
+			})
+			if subscribed {
+				selection.quotations = append(selection.quotations, commands.SubSecurity{SecId: sec.SecId})
+			}
+		}
+		if subscribed, ok := changes.allTrades[key]; ok {
+			selection.allTrades = slices.DeleteFunc(selection.allTrades, func(secID int) bool { return secID == sec.SecId })
+			if subscribed {
+				selection.allTrades = append(selection.allTrades, sec.SecId)
+			}
+		}
+	}
+}
+
+// runInSession waits for the session to run a control request. A session
+// that is not connected or still restoring does not take requests.
+func runInSession(requestCtx context.Context, run func(controlSession) (any, error)) (any, error) {
+	request := controlRequest{run: run, reply: make(chan controlReply, 1)}
+	waitCtx, cancel := context.WithTimeout(requestCtx, controlTimeout)
+	defer cancel()
+	select {
+	case <-waitCtx.Done():
+		return nil, errNoSession
+	case controlRequests <- request:
+	}
+	select {
+	case <-requestCtx.Done():
+		return nil, requestCtx.Err()
+	case reply := <-request.reply:
+		return reply.value, reply.err
+	}
+}
+
+type subscribedSecurity struct {
+	SecId   int    `json:"secid"`
+	Board   string `json:"board"`
+	SecCode string `json:"sec_code"`
+}
+
+type subscriptionsView struct {
+	Quotations []subscribedSecurity `json:"quotations"`
+	AllTrades  []subscribedSecurity `json:"all_trades"`
+}
+
+func currentSubscriptions(securities []commands.Security) subscriptionsView {
+	view := subscriptionsView{Quotations: []subscribedSecurity{}, AllTrades: []subscribedSecurity{}}
+	for _, sec := range securities {
+		subscribed := subscribedSecurity{SecId: sec.SecId, Board: sec.Board, SecCode: sec.SecCode}
+		if slices.ContainsFunc(quotations, func(quotation commands.SubSecurity) bool { return quotation.SecId == sec.SecId }) {
+			view.Quotations = append(view.Quotations, subscribed)
+		}
+		if slices.Contains(allTrades.Items, sec.SecId) {
+			view.AllTrades = append(view.AllTrades, subscribed)
+		}
+	}
+	return view
+}
+
+func findSecurity(securities []commands.Security, board, secCode string) (commands.Security, error) {
+	for _, sec := range securities {
+		if sec.Board == board && sec.SecCode == secCode {
+			return sec, nil
+		}
+	}
+	return commands.Security{}, fmt.Errorf("%w %s:%s", errUnknownSecurity, board, secCode)
+}
+
+// changeSubscription subscribes or unsubscribes a security and remembers the
+// change for the next sessions. Only a change of state is sent to TRANSAQ.
+func changeSubscription(kind, board, secCode string, subscribe bool) func(controlSession) (any, error) {
+	return func(session controlSession) (any, error) {
+		securities := session.client.Data.Securities.Items
+		sec, err := findSecurity(securities, board, secCode)
+		if err != nil {
+			return nil, err
+		}
+		command := commands.Command{Id: "unsubscribe"}
+		if subscribe {
+			command.Id = "subscribe"
+		}
+		var subscribed bool
+		switch kind {
+		case controlKindQuotations:
+			subscribed = slices.ContainsFunc(quotations, func(quotation commands.SubSecurity) bool { return quotation.SecId == sec.SecId })
+			command.Quotations = []commands.SubSecurity{{SecId: sec.SecId}}
+		case controlKindAllTrades:
+			subscribed = slices.Contains(allTrades.Items, sec.SecId)
+			command.AllTrades.Items = []int{sec.SecId}
+		}
+		if subscribed != subscribe {
+			if err := session.client.SendCommand(command); err != nil {
+				return nil, fmt.Errorf("%s: %w", command.Id, err)
+			}
+		}
+		key := board + ":" + secCode
+		switch kind {
+		case controlKindQuotations:
+			controlChanges.quotations[key] = subscribe
+			quotations = subSecuritiesMissing(quotations, command.Quotations)
+			if subscribe {
+				quotations = append(quotations, command.Quotations...)
+			}
+			historySeries = selectCandleSeries(settings.Load().Export, quotations, securities, session.client.Data.CandleKinds.Items)
+		case controlKindAllTrades:
+			controlChanges.allTrades[key] = subscribe
+			allTrades.Items = slices.DeleteFunc(allTrades.Items, func(secID int) bool { return secID == sec.SecId })
+			if subscribe {
+				allTrades.Items = append(allTrades.Items, sec.SecId)
+			}
+		}
+		log.Infof("Control API: %s %s of %s", command.Id, kind, key)
+		return currentSubscriptions(securities), nil
+	}
+}
+
+// startBackfill pages candleCount history candles of a security and period,
+// or its whole history when candleCount is -1.
+func startBackfill(board, secCode string, periodSeconds, candleCount int) func(controlSession) (any, error) {
+	return func(session controlSession) (any, error) {
+		sec, err := findSecurity(session.client.Data.Securities.Items, board, secCode)
+		if err != nil {
+			return nil, err
+		}
+		for _, kind := range session.client.Data.CandleKinds.Items {
+			if kind.Period == periodSeconds {
+				log.Infof("Control API: backfill %d candles of %s:%s period %ds", candleCount, board, secCode, periodSeconds)
+				return nil, session.backfill(candleCount, []candleSeries{{SecId: sec.SecId, SecCode: sec.SecCode, Period: kind.ID, PeriodSeconds: kind.Period}})
+			}
+		}
+		return nil, fmt.Errorf("%w of %d seconds", errUnknownCandleKind, periodSeconds)
+	}
+}
+
+func requestSecInfo(board, secCode string) func(controlSession) (any, error) {
+	return func(session controlSession) (any, error) {
+		sec, err := findSecurity(session.client.Data.Securities.Items, board, secCode)
+		if err != nil {
+			return nil, err
+		}
+		if err := session.client.SendCommand(commands.Command{Id: "get_securities_info", SecId: sec.SecId}); err != nil {
+			return nil, fmt.Errorf("get securities info for %d: %w", sec.SecId, err)
+		}
+		return nil, nil
+	}
+}
+
+// handleControl runs a control request in the session and writes its result
+// as JSON, or status when it has none.
+func handleControl(writer http.ResponseWriter, request *http.Request, status int, run func(controlSession) (any, error)) {
+	value, err := runInSession(request.Context(), run)
+	switch {
+	case errors.Is(err, errUnknownSecurity), errors.Is(err, errUnknownCandleKind):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNoSession):
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errBackfillDisabled):
+		http.Error(writer, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+	case value == nil:
+		writer.WriteHeader(status)
+	default:
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		_ = json.NewEncoder(writer).Encode(value)
+	}
+}
+
+func handleListSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	handleControl(writer, request, http.StatusOK, func(session controlSession) (any, error) {
+		return currentSubscriptions(session.client.Data.Securities.Items), nil
+	})
+}
+
+func handleChangeSubscription(writer http.ResponseWriter, request *http.Request) {
+	kind := request.PathValue("kind")
+	if kind != controlKindQuotations && kind != controlKindAllTrades {
+		http.Error(writer, fmt.Sprintf("unknown subscription %q, want %s or %s", kind, controlKindQuotations, controlKindAllTrades), http.StatusNotFound)
+		return
+	}
+	subscribe := request.Method == http.MethodPut
+	handleControl(writer, request, http.StatusOK, changeSubscription(kind, request.PathValue("board"), request.PathValue("sec_code"), subscribe))
+}
+
+func handleBackfill(writer http.ResponseWriter, request *http.Request) {
+	periodSeconds, err := strconv.Atoi(request.PathValue("period_seconds"))
+	if err != nil {
+		http.Error(writer, "bad period_seconds", http.StatusBadRequest)
+		return
+	}
+	candleCount := settings.Load().Backfill.PageSize
+	if value := request.URL.Query().Get("count"); value != "" {
+		if candleCount, err = strconv.Atoi(value); err != nil || candleCount == 0 || candleCount < -1 {
+			http.Error(writer, "bad count, want a positive number or -1 for the whole history", http.StatusBadRequest)
+			return
+		}
+	}
+	handleControl(writer, request, http.StatusAccepted, startBackfill(request.PathValue("board"), request.PathValue("sec_code"), periodSeconds, candleCount))
+}
+
+func handleSecInfo(writer http.ResponseWriter, request *http.Request) {
+	handleControl(writer, request, http.StatusAccepted, requestSecInfo(request.PathValue("board"), request.PathValue("sec_code")))
+}
+
+// controlAuthorized requires the control token when one is configured.
+func controlAuthorized(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// handleControlRoutes adds the control API to mux.
+func handleControlRoutes(mux *http.ServeMux, config controlConfig) {
+	mux.HandleFunc("GET /subscriptions", controlAuthorized(config.Token, handleListSubscriptions))
+	mux.HandleFunc("PUT /subscriptions/{kind}/{board}/{sec_code}", controlAuthorized(config.Token, handleChangeSubscription))
+	mux.HandleFunc("DELETE /subscriptions/{kind}/{board}/{sec_code}", controlAuthorized(config.Token, handleChangeSubscription))
+	mux.HandleFunc("POST /backfill/{board}/{sec_code}/{period_seconds}", controlAuthorized(config.Token, handleBackfill))
+	mux.HandleFunc("POST /securities/{board}/{sec_code}/info", controlAuthorized(config.Token, handleSecInfo))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tcClient "github.com/kmlebedev/txmlconnector/client"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	pb "github.com/kmlebedev/txmlconnector/proto"
+	"google.golang.org/grpc"
+)
+
+type countingConnectServiceClient struct {
+	fakeConnectServiceClient
+	sent atomic.Int32
+}
+
+func (fake *countingConnectServiceClient) SendCommand(
+	sendCtx context.Context,
+	request *pb.SendCommandRequest,
+	options ...grpc.CallOption,
+) (*pb.SendCommandResponse, error) {
+	fake.sent.Add(1)
+	return fake.fakeConnectServiceClient.SendCommand(sendCtx, request, options...)
+}
+
+func TestControlAPIChangesSubscriptionsOfSession(t *testing.T) {
+	previousSettings, previousQuotations, previousAllTrades, previousChanges := settings.Load(), quotations, allTrades, controlChanges
+	defer func() {
+		settings.Store(previousSettings)
+		quotations, allTrades, controlChanges = previousQuotations, previousAllTrades, previousChanges
+	}()
+	config := *previousSettings
+	config.Control = controlConfig{Enabled: true, Token: "secret"}
+	settings.Store(&config)
+	quotations, allTrades = []commands.SubSecurity{}, commands.SubAllTrades{}
+	controlChanges = subscriptionChanges{quotations: map[string]bool{}, allTrades: map[string]bool{}}
+
+	rpc := &countingConnectServiceClient{}
+	client := newTestTCClient(rpc)
+	client.Data.Securities.Items = []commands.Security{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Active: "true"},
+		{SecId: 2, Board: "TQBR", SecCode: "GAZP", Active: "true"},
+	}
+	processCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- processTransaq(processCtx, client, transaqSessionConfig{
+			restore:  func(*tcClient.TCClient) error { return nil },
+			controls: controlRequests,
+		})
+	}()
+	client.ServerStatusChan <- commands.ServerStatus{Connected: "true"}
+
+	server := httptest.NewServer(newHTTPMux(nil))
+	defer server.Close()
+	call := func(method, path string) (int, subscriptionsView) {
+		request, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		var view subscriptionsView
+		if response.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(response.Body).Decode(&view); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.StatusCode, view
+	}
+
+	if response, err := http.Get(server.URL + "/subscriptions"); err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("request without token: %v %v", response.Status, err)
+	}
+	status, view := call(http.MethodPut, "/subscriptions/all_trades/TQBR/SBER")
+	if status != http.StatusOK || len(view.AllTrades) != 1 || view.AllTrades[0].SecCode != "SBER" {
+		t.Fatalf("subscribe = %d %+v", status, view)
+	}
+	if status, _ := call(http.MethodPut, "/subscriptions/all_trades/TQBR/SBER"); status != http.StatusOK || rpc.sent.Load() != 1 {
+		t.Fatalf("repeated subscribe = %d, %d commands sent", status, rpc.sent.Load())
+	}
+	if status, _ := call(http.MethodPut, "/subscriptions/quotations/TQBR/GAZP"); status != http.StatusOK {
+		t.Fatalf("subscribe quotations = %d", status)
+	}
+	if status, _ := call(http.MethodPut, "/subscriptions/quotations/TQBR/LKOH"); status != http.StatusNotFound {
+		t.Fatalf("unknown security = %d", status)
+	}
+	if status, _ := call(http.MethodPost, "/backfill/TQBR/GAZP/60"); status != http.StatusNotFound {
+		t.Fatalf("backfill without candle kind = %d", status)
+	}
+	status, view = call(http.MethodDelete, "/subscriptions/all_trades/TQBR/SBER")
+	if status != http.StatusOK || len(view.AllTrades) != 0 || len(view.Quotations) != 1 || rpc.sent.Load() != 3 {
+		t.Fatalf("unsubscribe = %d %+v, %d commands sent", status, view, rpc.sent.Load())
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("processTransaq error = %v", err)
+	}
+
+	// The next session restores the subscriptions changed at runtime.
+	quotations, allTrades = []commands.SubSecurity{}, commands.SubAllTrades{}
+	if err := restoreSubscriptions(client); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(quotations, []commands.SubSecurity{{SecId: 2}}) || len(allTrades.Items) != 0 {
+		t.Fatalf("restored quotations %+v, all trades %+v", quotations, allTrades.Items)
+	}
+}
+
+func TestControlRequestWithoutSessionIsUnavailable(t *testing.T) {
+	requestCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := runInSession(requestCtx, func(controlSession) (any, error) { return nil, nil })
+	if !errors.Is(err, errNoSession) {
+		t.Fatalf("err = %v", err)
+	}
+}
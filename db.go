@@ -3,23 +3,44 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/kmlebedev/txmlconnector/client/commands"
 )
 
+// moscowLocation is the exchange time zone TRANSAQ reports times in.
+var moscowLocation, _ = time.LoadLocation("Europe/Moscow")
+
 const (
-	EnvKeyLogLevel          = "LOG_LEVEL"
-	ExportCandleCount       = 0
-	asyncInsertWait         = false
-	tradeTimeLayout         = "02.01.2006 15:04:05"
-	dateLayout              = "02.01.2006" // DD.MM.YYYY
-	tableTimeLayout         = "2006-01-02 15:04:05"
-	ChCandlesInsertQuery    = "INSERT INTO transaq_candles"
-	ChSecuritiesInsertQuery = "INSERT INTO transaq_securities"
-	ChTradesInsertQuery     = "INSERT INTO transaq_trades"
-	ChSecInfoInsertQuery    = "INSERT INTO transaq_securities_info VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	ChQuotesInsert          = "INSERT INTO transaq_quotes"
+	EnvKeyLogLevel                  = "LOG_LEVEL"
+	ExportCandleCount               = 0
+	asyncInsertWait                 = false
+	tradeTimeLayout                 = "02.01.2006 15:04:05"
+	dateLayout                      = "02.01.2006" // DD.MM.YYYY
+	tableTimeLayout                 = "2006-01-02 15:04:05"
+	ChCandlesInsertQuery            = "INSERT INTO transaq_candles (date, sec_code, period, open, close, high, low, volume, source, period_seconds, trades, vwap)"
+	ChSecuritiesInsertQuery         = "INSERT INTO transaq_securities"
+	ChTradesInsertQuery             = "INSERT INTO transaq_trades"
+	ChSecInfoInsertQuery            = "INSERT INTO transaq_securities_info VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	ChSecInfoUpdInsertQuery         = "INSERT INTO transaq_securities_info_upd VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	ChQuotesInsert                  = "INSERT INTO transaq_quotes"
+	ChDeadLetterInsertQuery         = "INSERT INTO transaq_dead_letter VALUES (?, ?, ?, ?)"
+	ChOrdersInsertQuery             = "INSERT INTO transaq_orders"
+	ChStopOrdersInsertQuery         = "INSERT INTO transaq_stoporders"
+	ChMyTradesInsertQuery           = "INSERT INTO transaq_my_trades"
+	ChSecPositionsInsert            = "INSERT INTO transaq_sec_positions"
+	ChMoneyPositionsInsert          = "INSERT INTO transaq_money_positions"
+	ChFortsPositionsInsert          = "INSERT INTO transaq_forts_positions"
+	ChUnitedLimitsInsert            = "INSERT INTO transaq_united_limits"
+	ChPortfolioInsert               = "INSERT INTO transaq_portfolio"
+	ChBackfillCheckpointInsertQuery = "INSERT INTO transaq_candle_backfill VALUES (?, ?, ?, ?, ?, ?, ?)"
+	ChBackfillCheckpointSelectQuery = "SELECT sec_code, period_seconds, candles, complete, updated, oldest, newest FROM transaq_candle_backfill FINAL"
+	ChCandleDatesSelectQuery        = "SELECT DISTINCT date FROM transaq_candles WHERE sec_code = ? AND period = ? AND source = ? AND date >= ?"
+	ChTradeGapsInsertQuery          = "INSERT INTO transaq_trade_gaps VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	ChOrderBookSnapshotsInsertQuery = "INSERT INTO transaq_orderbook_snapshots VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	ChQuotationsInsertQuery         = "INSERT INTO transaq_quotations"
 
 	candlesDDL = `CREATE TABLE IF NOT EXISTS transaq_candles (
 		date   DateTime('Europe/Moscow'),
@@ -29,9 +50,54 @@ const (
 		close  Float32,
 		high   Float32,
 		low    Float32,
-		volume UInt64
+		volume UInt64,
+		source LowCardinality(String) DEFAULT 'history',
+		period_seconds UInt32,
+		trades UInt32,
+		vwap Float64
 	) ENGINE = ReplacingMergeTree()
-	ORDER BY (date, sec_code, period)`
+	ORDER BY (date, sec_code, period, source, period_seconds)`
+
+	tradeGapsDDL = `CREATE TABLE IF NOT EXISTS transaq_trade_gaps (
+		detected DateTime64(3, 'Europe/Moscow'),
+		board LowCardinality(String),
+		sec_code LowCardinality(String),
+		reason LowCardinality(String),
+		from_tradeno Int64,
+		to_tradeno Int64,
+		from_time DateTime('Europe/Moscow'),
+		to_time DateTime('Europe/Moscow')
+	) ENGINE = MergeTree()
+	ORDER BY (sec_code, to_time)`
+
+	// transaq_candle_backfill keeps the progress of the full history backfill
+	// per series, complete is set once TRANSAQ has no older candles. oldest
+	// and newest are the dates of the candles stored so far.
+	candleBackfillDDL = `CREATE TABLE IF NOT EXISTS transaq_candle_backfill (
+		sec_code LowCardinality(String),
+		period_seconds UInt32,
+		candles UInt64,
+		complete UInt8,
+		updated DateTime64(3, 'Europe/Moscow'),
+		oldest DateTime('Europe/Moscow'),
+		newest DateTime('Europe/Moscow')
+	) ENGINE = ReplacingMergeTree(updated)
+	ORDER BY (sec_code, period_seconds)`
+
+	// candlesMigrationDDL brings tables created before the candles were built
+	// from trades to the current schema. Keys may only be extended with
+	// columns added by the same statement, it is a no-op once applied. The
+	// defaults give the rows of older versions their key values: candles with
+	// period 1 were written both from quotations and as minute history and
+	// cannot be told apart, they are kept as quotation bars and the minute
+	// history is paged again by the backfill. The other periods are the
+	// candle kinds of TRANSAQ servers, see knownCandlePeriods.
+	candlesMigrationDDL = `ALTER TABLE transaq_candles
+		ADD COLUMN IF NOT EXISTS source LowCardinality(String) DEFAULT if(period = 1, 'quotations', 'history'),
+		ADD COLUMN IF NOT EXISTS period_seconds UInt32 DEFAULT transform(period, [1, 2, 3, 4, 5, 6], [60, 300, 900, 3600, 86400, 604800], 0),
+		ADD COLUMN IF NOT EXISTS trades UInt32,
+		ADD COLUMN IF NOT EXISTS vwap Float64,
+		MODIFY ORDER BY (date, sec_code, period, source, period_seconds)`
 
 	securitiesDDL = `CREATE TABLE IF NOT EXISTS transaq_securities (
 		secid   UInt16,
@@ -96,6 +162,24 @@ const (
 	) ENGINE = ReplacingMergeTree()
 	ORDER BY (sec_code, market, regnumber, isin)`
 
+	// transaq_securities_info_upd keeps every sec_info_upd message merged
+	// into the state of the security, see secInfoUpdStates.
+	securitiesInfoUpdDDL = `CREATE TABLE IF NOT EXISTS transaq_securities_info_upd (
+		received DateTime64(3, 'Europe/Moscow'),
+		secid UInt16,
+		market UInt8,
+		sec_code LowCardinality(FixedString(16)),
+		minprice Float64,
+		maxprice Float64,
+		buy_deposit Float64,
+		sell_deposit Float64,
+		bgo_c Float64,
+		bgo_nc Float64,
+		bgo_buy Float64,
+		point_cost Float64
+	) ENGINE = MergeTree()
+	ORDER BY (sec_code, received)`
+
 	quotesDDL = `CREATE TABLE IF NOT EXISTS transaq_quotes (
         time 	 DateTime('Europe/Moscow'),
 		secid    UInt16,
@@ -109,30 +193,283 @@ const (
     ) ENGINE = ReplacingMergeTree()
 	ORDER BY (sec_code, board, price, source)
     `
+
+	// transaq_quotations keeps the merged L1 state of a security after every
+	// quotations update, last_time is the time of the last trade.
+	quotationsDDL = `CREATE TABLE IF NOT EXISTS transaq_quotations (
+		received DateTime64(3, 'Europe/Moscow'),
+		secid UInt16,
+		board LowCardinality(String),
+		sec_code LowCardinality(String),
+		bid Float64,
+		biddepth Int64,
+		biddeptht Int64,
+		numbids Int64,
+		offer Float64,
+		offerdepth Int64,
+		offerdeptht Int64,
+		numoffers Int64,
+		last Float64,
+		quantity Int64,
+		last_time Nullable(DateTime('Europe/Moscow')),
+		change Float64,
+		open Float64,
+		high Float64,
+		low Float64,
+		waprice Float64,
+		numtrades Int64,
+		voltoday Int64,
+		valtoday Float64,
+		openpositions Int64,
+		deltapositions Int64,
+		yield Float64,
+		accruedintvalue Float64,
+		status LowCardinality(String),
+		tradingstatus LowCardinality(String)
+	) ENGINE = MergeTree()
+	ORDER BY (sec_code, board, received)`
+
+	orderBookSnapshotsDDL = `CREATE TABLE IF NOT EXISTS transaq_orderbook_snapshots (
+		time DateTime64(3, 'Europe/Moscow'),
+		secid UInt16,
+		board LowCardinality(String),
+		sec_code LowCardinality(String),
+		bid_prices Array(Float64),
+		bid_volumes Array(Int64),
+		ask_prices Array(Float64),
+		ask_volumes Array(Int64),
+		best_bid Float64,
+		best_ask Float64,
+		spread Float64,
+		imbalance Float64
+	) ENGINE = MergeTree()
+	ORDER BY (sec_code, board, time)`
+
+	deadLetterDDL = `CREATE TABLE IF NOT EXISTS transaq_dead_letter (
+		time    DateTime64(3, 'Europe/Moscow'),
+		kind    LowCardinality(String),
+		payload String,
+		error   String
+	) ENGINE = MergeTree()
+	ORDER BY (kind, time)`
+
+	// Every order update is kept as a row: the status and the unfilled
+	// balance are part of the key, so only repeated identical updates merge.
+	ordersDDL = `CREATE TABLE IF NOT EXISTS transaq_orders (
+		received DateTime64(3, 'Europe/Moscow'),
+		transactionid UInt64,
+		orderno Int64,
+		secid UInt16,
+		board LowCardinality(String),
+		sec_code LowCardinality(FixedString(16)),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		status LowCardinality(String),
+		buysell LowCardinality(FixedString(1)),
+		time DateTime('Europe/Moscow'),
+		withdrawtime DateTime('Europe/Moscow'),
+		price Float64,
+		quantity UInt32,
+		balance UInt32,
+		value Float64,
+		result String
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (transactionid, status, balance)`
+
+	stopOrdersDDL = `CREATE TABLE IF NOT EXISTS transaq_stoporders (
+		received DateTime64(3, 'Europe/Moscow'),
+		transactionid UInt64,
+		activeorderno Int64,
+		secid UInt16,
+		board LowCardinality(String),
+		sec_code LowCardinality(FixedString(16)),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		status LowCardinality(String),
+		buysell LowCardinality(FixedString(1)),
+		canceller String,
+		alltradeno Int64,
+		validbefore String,
+		author String,
+		accepttime DateTime('Europe/Moscow'),
+		linkedorderno Int64,
+		expdate DateTime('Europe/Moscow'),
+		result String
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (transactionid, status)`
+
+	myTradesDDL = `CREATE TABLE IF NOT EXISTS transaq_my_trades (
+		time DateTime('Europe/Moscow'),
+		tradeno Int64,
+		orderno Int64,
+		secid UInt16,
+		board LowCardinality(String),
+		sec_code LowCardinality(FixedString(16)),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		buysell LowCardinality(FixedString(1)),
+		price Float64,
+		quantity UInt32,
+		value Float64,
+		comission Float64,
+		yield Float64,
+		accruedint Float64,
+		tradetype LowCardinality(String),
+		settlecode LowCardinality(String),
+		brokerref String,
+		currentpos Int64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (sec_code, tradeno)`
+
+	secPositionsDDL = `CREATE TABLE IF NOT EXISTS transaq_sec_positions (
+		snapshot DateTime64(3, 'Europe/Moscow'),
+		secid UInt16,
+		market UInt8,
+		sec_code LowCardinality(FixedString(16)),
+		register LowCardinality(String),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		shortname String,
+		saldoin Float64,
+		bought Float64,
+		sold Float64,
+		saldo Float64,
+		ordbuy Float64,
+		ordsell Float64,
+		amount Float64,
+		equity Float64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (client, union, sec_code, register, snapshot)`
+
+	moneyPositionsDDL = `CREATE TABLE IF NOT EXISTS transaq_money_positions (
+		snapshot DateTime64(3, 'Europe/Moscow'),
+		asset LowCardinality(String),
+		register LowCardinality(String),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		shortname String,
+		saldoin Float64,
+		bought Float64,
+		sold Float64,
+		saldo Float64,
+		ordbuy Float64,
+		ordbuycond Float64,
+		comission Float64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (client, union, asset, register, snapshot)`
+
+	fortsPositionsDDL = `CREATE TABLE IF NOT EXISTS transaq_forts_positions (
+		snapshot DateTime64(3, 'Europe/Moscow'),
+		secid UInt16,
+		sec_code LowCardinality(FixedString(16)),
+		client LowCardinality(String),
+		union LowCardinality(String),
+		startnet Int64,
+		openbuys Int64,
+		opensells Int64,
+		totalnet Int64,
+		todaybuy Int64,
+		todaysell Int64,
+		optmargin Float64,
+		varmargin Float64,
+		expirationpos Int64,
+		netto Float64,
+		kgo Float64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (client, union, sec_code, snapshot)`
+
+	unitedLimitsDDL = `CREATE TABLE IF NOT EXISTS transaq_united_limits (
+		snapshot DateTime64(3, 'Europe/Moscow'),
+		union LowCardinality(String),
+		open_equity Float64,
+		equity Float64,
+		requirements Float64,
+		free Float64,
+		varmargin Float64,
+		finres Float64,
+		go Float64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (union, snapshot)`
+
+	portfolioDDL = `CREATE TABLE IF NOT EXISTS transaq_portfolio (
+		snapshot DateTime64(3, 'Europe/Moscow'),
+		source LowCardinality(String),
+		union LowCardinality(String),
+		open_equity Float64,
+		equity Float64,
+		init_req Float64,
+		maint_req Float64,
+		vm_current Float64,
+		finres Float64,
+		go Float64
+	) ENGINE = ReplacingMergeTree()
+	ORDER BY (union, source, snapshot)`
 )
 
-func insertQuotes(insertCtx context.Context, quotes commands.Quotes) error {
-	if len(quotes.Items) == 0 {
+// insertSecurities writes the securities list TRANSAQ sent in one batch.
+func insertSecurities(insertCtx context.Context, securities []commands.Security) (err error) {
+	started := time.Now()
+	defer func() { observeInsert("transaq_securities", len(securities), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChSecuritiesInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare securities batch: %w", err)
+	}
+	defer batch.Close()
+	for _, sec := range securities {
+		if err := batch.Append(uint16(sec.SecId),
+			sec.SecCode,
+			sec.InstrClass,
+			sec.Board,
+			uint8(sec.Market),
+			sec.ShortName,
+			uint8(sec.Decimals),
+			float32(sec.MinStep),
+			uint32(sec.LotSize),
+			uint16(sec.LotDivider),
+			float32(sec.PointCost),
+			sec.SecType,
+			uint8(sec.QuotesType)); err != nil {
+			return fmt.Errorf("append security %s: %w", sec.SecCode, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send securities batch: %w", err)
+	}
+	return nil
+}
+
+// insertQuotes writes one or more quotes messages with a single ClickHouse
+// batch. Each message keeps its own receive time.
+func insertQuotes(insertCtx context.Context, messages ...commands.Quotes) (err error) {
+	rows := 0
+	for _, quotes := range messages {
+		rows += len(quotes.Items)
+	}
+	if rows == 0 {
 		return nil
 	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_quotes", rows, started, err) }()
 	batch, err := connect.PrepareBatch(insertCtx, ChQuotesInsert)
 	if err != nil {
 		return fmt.Errorf("prepare quotes batch: %w", err)
 	}
 	defer batch.Close()
-	for _, quote := range quotes.Items {
-		if err := batch.Append(
-			fmt.Sprint(quotes.Time.Format(tableTimeLayout)),
-			quote.SecId,
-			quote.Board,
-			quote.SecCode,
-			quote.Price,
-			quote.Source,
-			quote.Yield,
-			quote.Buy,
-			quote.Sell,
-		); err != nil {
-			return fmt.Errorf("append quote %d: %w", quote.SecId, err)
+	for _, quotes := range messages {
+		for _, quote := range quotes.Items {
+			if err := batch.Append(
+				fmt.Sprint(quotes.Time.Format(tableTimeLayout)),
+				quote.SecId,
+				quote.Board,
+				quote.SecCode,
+				quote.Price,
+				quote.Source,
+				quote.Yield,
+				quote.Buy,
+				quote.Sell,
+			); err != nil {
+				return fmt.Errorf("append quote %d: %w", quote.SecId, err)
+			}
 		}
 	}
 	if err := batch.Send(); err != nil {
@@ -141,30 +478,40 @@ func insertQuotes(insertCtx context.Context, quotes commands.Quotes) error {
 	return nil
 }
 
-func insertTrades(insertCtx context.Context, trades commands.AllTrades) error {
-	if len(trades.Items) == 0 {
+// insertTrades writes one or more all trades messages with a single
+// ClickHouse batch.
+func insertTrades(insertCtx context.Context, messages ...commands.AllTrades) (err error) {
+	rows := 0
+	for _, trades := range messages {
+		rows += len(trades.Items)
+	}
+	if rows == 0 {
 		return nil
 	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_trades", rows, started, err) }()
 	batch, err := connect.PrepareBatch(insertCtx, ChTradesInsertQuery)
 	if err != nil {
 		return fmt.Errorf("prepare trades batch: %w", err)
 	}
 	defer batch.Close()
-	for _, trade := range trades.Items {
-		tradeTime, _ := time.Parse(tradeTimeLayout, trade.Time)
-		if err := batch.Append(
-			fmt.Sprint(tradeTime.Format(tableTimeLayout)),
-			trade.SecId,
-			trade.SecCode,
-			trade.TradeNo,
-			trade.Board,
-			trade.Price,
-			trade.Quantity,
-			trade.BuySell,
-			trade.OpenInterest,
-			trade.Period,
-		); err != nil {
-			return fmt.Errorf("append trade %d: %w", trade.TradeNo, err)
+	for _, trades := range messages {
+		for _, trade := range trades.Items {
+			tradeTime, _ := time.Parse(tradeTimeLayout, trade.Time)
+			if err := batch.Append(
+				fmt.Sprint(tradeTime.Format(tableTimeLayout)),
+				trade.SecId,
+				trade.SecCode,
+				trade.TradeNo,
+				trade.Board,
+				trade.Price,
+				trade.Quantity,
+				trade.BuySell,
+				trade.OpenInterest,
+				trade.Period,
+			); err != nil {
+				return fmt.Errorf("append trade %d: %w", trade.TradeNo, err)
+			}
 		}
 	}
 	if err := batch.Send(); err != nil {
@@ -173,11 +520,13 @@ func insertTrades(insertCtx context.Context, trades commands.AllTrades) error {
 	return nil
 }
 
-func insertSecInfo(insertCtx context.Context, secInfo commands.SecInfo) error {
+func insertSecInfo(insertCtx context.Context, secInfo commands.SecInfo) (err error) {
+	started := time.Now()
+	defer func() { observeInsert("transaq_securities_info", 1, started, err) }()
 	matDate, _ := time.Parse(dateLayout, secInfo.MatDate)
 	couponDate, _ := time.Parse(dateLayout, secInfo.CouponDate)
 	buybackDate, _ := time.Parse(dateLayout, secInfo.BuybackDate)
-	return connect.AsyncInsert(insertCtx, ChSecInfoInsertQuery, asyncInsertWait,
+	err = connect.AsyncInsert(insertCtx, ChSecInfoInsertQuery, asyncInsertWait,
 		secInfo.SecId,
 		secInfo.SecName,
 		secInfo.SecCode,
@@ -207,4 +556,65 @@ func insertSecInfo(insertCtx context.Context, secInfo commands.SecInfo) error {
 		fmt.Sprint(buybackDate.Format(tableTimeLayout)),
 		secInfo.CurrencyId,
 	)
+	return err
+}
+
+// secInfoUpdEvent is a sec_info_upd message stamped with the time the
+// exporter handled it, so spooled updates keep their place in the history.
+type secInfoUpdEvent struct {
+	Received time.Time
+	Update   commands.SecInfoUpd
+}
+
+// secInfoUpdStates merges sec_info_upd messages into the full state of
+// every security. TRANSAQ only sends the fields that changed, a field missing
+// from a message keeps its last value. Until a field was sent once after the
+// exporter started it is 0, and like for quotations a change to 0 cannot be
+// told from a missing field and keeps the last value.
+type secInfoUpdStates struct {
+	lock   sync.Mutex
+	states map[int]commands.SecInfoUpd
+}
+
+func newSecInfoUpdStates() *secInfoUpdStates {
+	return &secInfoUpdStates{states: map[int]commands.SecInfoUpd{}}
+}
+
+// merge applies an update and returns the merged state of its security.
+func (set *secInfoUpdStates) merge(update commands.SecInfoUpd) commands.SecInfoUpd {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	state := set.states[update.SecId]
+	mergeValue(&state.SecId, update.SecId)
+	mergeValue(&state.Market, update.Market)
+	mergeValue(&state.SecCode, update.SecCode)
+	mergeValue(&state.MinPrice, update.MinPrice)
+	mergeValue(&state.MaxPrice, update.MaxPrice)
+	mergeValue(&state.BuyDeposit, update.BuyDeposit)
+	mergeValue(&state.SellDeposit, update.SellDeposit)
+	mergeValue(&state.BgoC, update.BgoC)
+	mergeValue(&state.BgoNc, update.BgoNc)
+	mergeValue(&state.BgoBuy, update.BgoBuy)
+	mergeValue(&state.PointCost, update.PointCost)
+	set.states[update.SecId] = state
+	return state
+}
+
+func insertSecInfoUpd(insertCtx context.Context, update secInfoUpdEvent) (err error) {
+	started := time.Now()
+	defer func() { observeInsert("transaq_securities_info_upd", 1, started, err) }()
+	return connect.AsyncInsert(insertCtx, ChSecInfoUpdInsertQuery, asyncInsertWait,
+		update.Received,
+		uint16(update.Update.SecId),
+		uint8(update.Update.Market),
+		update.Update.SecCode,
+		float64(update.Update.MinPrice),
+		float64(update.Update.MaxPrice),
+		float64(update.Update.BuyDeposit),
+		float64(update.Update.SellDeposit),
+		float64(update.Update.BgoC),
+		float64(update.Update.BgoNc),
+		float64(update.Update.BgoBuy),
+		float64(update.Update.PointCost),
+	)
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,8 +14,9 @@ import (
 
 type recordingConn struct {
 	driver.Conn
-	query string
-	batch *recordingBatch
+	query   string
+	batch   *recordingBatch
+	batches map[string]*recordingBatch
 }
 
 func (conn *recordingConn) PrepareBatch(
@@ -22,6 +26,10 @@ func (conn *recordingConn) PrepareBatch(
 ) (driver.Batch, error) {
 	conn.query = stringQuery
 	conn.batch = &recordingBatch{}
+	if conn.batches == nil {
+		conn.batches = map[string]*recordingBatch{}
+	}
+	conn.batches[stringQuery] = conn.batch
 	return conn.batch, nil
 }
 
@@ -101,3 +109,137 @@ func TestInsertQuotesUsesOneBatchForWholeMessage(t *testing.T) {
 		t.Fatal("quote batch was not sent")
 	}
 }
+
+func TestInsertTradesWritesSeveralMessagesInOneBatch(t *testing.T) {
+	previousConnect := connect
+	recorder := &recordingConn{}
+	connect = recorder
+	defer func() { connect = previousConnect }()
+
+	err := insertTradesBatch(context.Background(), []commands.AllTrades{
+		{Items: []commands.Trade{{SecId: 1, TradeNo: 10, Time: "14.08.2026 12:00:00"}}},
+		{Items: []commands.Trade{{SecId: 2, TradeNo: 20, Time: "14.08.2026 12:00:01"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.batch.rows) != 2 || !recorder.batch.sent {
+		t.Fatalf("batch rows = %d sent = %v, want 2 rows sent once", len(recorder.batch.rows), recorder.batch.sent)
+	}
+}
+
+func TestInsertOrdersKeepsEveryStatusTransition(t *testing.T) {
+	previousConnect := connect
+	recorder := &recordingConn{}
+	connect = recorder
+	defer func() { connect = previousConnect }()
+
+	received := time.Date(2026, time.August, 14, 12, 0, 0, 0, time.UTC)
+	err := insertOrders(context.Background(), ordersEvent{Received: received, Orders: commands.Orders{
+		Items: []commands.Order{
+			{TransactionId: 7, Status: "active", Quantity: 10, Balance: 10},
+			{TransactionId: 7, Status: "active", Quantity: 10, Balance: 4},
+		},
+		StopOrders: []commands.StopOrder{{TransactionId: 8, Status: "watching"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := recorder.batches[ChOrdersInsertQuery]
+	if orders == nil || len(orders.rows) != 2 || !orders.sent {
+		t.Fatalf("orders batch = %+v", orders)
+	}
+	if orders.rows[0][0] != received {
+		t.Fatalf("order received = %v", orders.rows[0][0])
+	}
+	stopOrders := recorder.batches[ChStopOrdersInsertQuery]
+	if stopOrders == nil || len(stopOrders.rows) != 1 || !stopOrders.sent {
+		t.Fatalf("stop orders batch = %+v", stopOrders)
+	}
+}
+
+func TestInsertPositionsWritesOneSnapshotPerPositionKind(t *testing.T) {
+	previousConnect := connect
+	recorder := &recordingConn{}
+	connect = recorder
+	defer func() { connect = previousConnect }()
+
+	snapshot := time.Date(2026, time.August, 14, 12, 0, 0, 0, time.UTC)
+	err := insertPositions(context.Background(), positionsEvent{Snapshot: snapshot, Positions: commands.Positions{
+		SecPositions:  []commands.SecPosition{{SecId: 1, SecCode: "SBER", Saldo: 10}},
+		MoneyPosition: []commands.MoneyPosition{{Asset: "RUB", Saldo: 1000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secPositions := recorder.batches[ChSecPositionsInsert]
+	if secPositions == nil || len(secPositions.rows) != 1 || !secPositions.sent {
+		t.Fatalf("sec positions batch = %+v", secPositions)
+	}
+	if secPositions.rows[0][0] != snapshot {
+		t.Fatalf("sec position snapshot = %v", secPositions.rows[0][0])
+	}
+	if money := recorder.batches[ChMoneyPositionsInsert]; money == nil || len(money.rows) != 1 {
+		t.Fatalf("money positions batch = %+v", money)
+	}
+	if forts := recorder.batches[ChFortsPositionsInsert]; forts != nil {
+		t.Fatalf("empty forts positions were inserted: %+v", forts)
+	}
+}
+
+func TestInsertSecInfoUpdKeepsReceiveTime(t *testing.T) {
+	previousConnect := connect
+	recorder := &asyncInsertConn{}
+	connect = recorder
+	defer func() { connect = previousConnect }()
+
+	received := time.Date(2026, time.August, 14, 12, 0, 0, 0, time.UTC)
+	err := insertSecInfoUpd(context.Background(), secInfoUpdEvent{Received: received, Update: commands.SecInfoUpd{
+		SecId: 30338, Market: 4, SecCode: "CR9BC5", BuyDeposit: 1500,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.args) != 1 {
+		t.Fatalf("inserts = %d, want 1", len(recorder.args))
+	}
+	row := recorder.args[0]
+	if row[0] != received || row[3] != "CR9BC5" || row[6] != float64(1500) {
+		t.Fatalf("row = %v", row)
+	}
+}
+
+func TestSecInfoUpdStatesKeepUnsentFields(t *testing.T) {
+	states := newSecInfoUpdStates()
+	states.merge(commands.SecInfoUpd{SecId: 30338, Market: 4, SecCode: "CR9BC5", MinPrice: 80, MaxPrice: 90, BuyDeposit: 1500})
+	merged := states.merge(commands.SecInfoUpd{SecId: 30338, BuyDeposit: 1700})
+	want := commands.SecInfoUpd{SecId: 30338, Market: 4, SecCode: "CR9BC5", MinPrice: 80, MaxPrice: 90, BuyDeposit: 1700}
+	if merged != want {
+		t.Fatalf("merged = %+v, want %+v", merged, want)
+	}
+}
+
+func TestCandlesMigrationGivesOlderRowsTheCurrentKey(t *testing.T) {
+	orderBy := regexp.MustCompile(`ORDER BY \(([^)]*)\)`)
+	created, migrated := orderBy.FindStringSubmatch(candlesDDL), orderBy.FindStringSubmatch(candlesMigrationDDL)
+	if created == nil || migrated == nil || created[1] != migrated[1] {
+		t.Fatalf("migrated key %q, created key %q", migrated, created)
+	}
+	// Rows of older versions have no source and period_seconds, both are key
+	// columns and must be derived from period for the rows to dedup with the
+	// ones written now.
+	if !strings.Contains(candlesMigrationDDL, "source LowCardinality(String) DEFAULT if(period = 1, '"+candleSourceQuotations+"', '"+candleSourceHistory+"')") {
+		t.Fatalf("source default of older rows:\n%s", candlesMigrationDDL)
+	}
+	seconds := regexp.MustCompile(`period_seconds UInt32 DEFAULT transform\(period, \[[^\]]*\], \[([^\]]*)\], 0\)`).FindStringSubmatch(candlesMigrationDDL)
+	if seconds == nil {
+		t.Fatalf("period_seconds default of older rows:\n%s", candlesMigrationDDL)
+	}
+	periods := []string{}
+	for _, period := range knownCandlePeriods {
+		periods = append(periods, strconv.Itoa(period))
+	}
+	if seconds[1] != strings.Join(periods, ", ") {
+		t.Fatalf("period_seconds of kinds = [%s], want %v", seconds[1], knownCandlePeriods)
+	}
+}
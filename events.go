@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 
 	tcClient "github.com/kmlebedev/txmlconnector/client"
 	"github.com/kmlebedev/txmlconnector/client/commands"
@@ -12,28 +14,135 @@ import (
 const eventQueueWarningSize = 1024
 
 type transaqEventHandlers struct {
-	allTrades  func(context.Context, commands.AllTrades) error
-	quotes     func(context.Context, commands.Quotes) error
-	secInfo    func(context.Context, commands.SecInfo) error
-	secInfoUpd func(context.Context, commands.SecInfoUpd) error
+	allTrades      func(context.Context, commands.AllTrades) error
+	quotes         func(context.Context, commands.Quotes) error
+	quotations     func(context.Context, quotationsEvent) error
+	historyCandles func(context.Context, historyCandlesEvent) error
+	secInfo        func(context.Context, commands.SecInfo) error
+	secInfoUpd     func(context.Context, commands.SecInfoUpd) error
+	orders         func(context.Context, ordersEvent) error
+	myTrades       func(context.Context, commands.ClientTrades) error
+	positions      func(context.Context, positionsEvent) error
+	portfolio      func(context.Context, portfolioEvent) error
+	// reset drops state built from a stream that has a gap now, it is called
+	// when a session ends.
+	reset func()
+	// flush writes out events the handlers hold back for batching. It is
+	// called once on shutdown, after the last session has ended.
+	flush func(context.Context) error
+	// orderBooks are rebuilt by the quotes handler, HTTP writes their
+	// snapshots on request.
+	orderBooks *orderBooks
 }
 
-func defaultTransaqEventHandlers() transaqEventHandlers {
+// defaultTransaqEventHandlers batches and merges the events and writes them
+// to out.
+func defaultTransaqEventHandlers(out sink) transaqEventHandlers {
+	config := settings.Load()
+	trades := newBatcher("trades", config.Batch, tradeRows, discardNil(out.trades))
+	quotes := newBatcher("quotes", config.Batch, quoteRows, discardNil(out.quotes))
+	quotations := newBatcher("quotations", config.Batch, quotationRows, discardNil(out.quotations))
+	quotationStates := newQuotationStates()
+	secInfoUpd := discardNil(out.secInfoUpd)
+	secInfoUpdStates := newSecInfoUpdStates()
+	candles := newBatcher("candles", config.Batch, candleRows, discardNil(out.candles))
+	closedCandles := func(addCtx context.Context, closed []aggregatedCandle) error {
+		liveData.publishCandles(closed)
+		return candles.add(addCtx, closed)
+	}
+	tradeCandles := newCandleAggregator(candleSourceTrades, config.Candles.TradePeriodSeconds, config.Candles.CloseDelay, closedCandles)
+	quotationCandles := newCandleAggregator(candleSourceQuotations, []int{60}, config.Candles.CloseDelay, closedCandles)
+	tradeCandles.update = liveDashboard.publishCandles
+	quotationCandles.update = liveDashboard.publishCandles
+	// The calendar was validated with the config.
+	calendar, _ := newTradingCalendar(config.Gaps)
+	sequence := newTradeSequence(config.TradeGaps, calendar)
+	orderBookSet := newOrderBooks(config.OrderBook, discardNil(out.orderBook))
 	return transaqEventHandlers{
-		allTrades: insertTrades,
-		quotes:    insertQuotes,
-		secInfo:   insertSecInfo,
-		secInfoUpd: func(_ context.Context, update commands.SecInfoUpd) error {
-			log.Debugf("secInfoUpd %+v", update)
-			return nil
+		allTrades: observeTrades(observeTradeGaps(sequence, discardNil(out.tradeGaps),
+			func(handleCtx context.Context, allTrades commands.AllTrades) error {
+				liveData.publishTrades(allTrades)
+				liveDashboard.publishTrades(allTrades)
+				return errors.Join(tradeCandles.addTrades(handleCtx, allTrades), trades.add(handleCtx, allTrades))
+			})),
+		quotes: func(handleCtx context.Context, message commands.Quotes) error {
+			orderBookSet.apply(message)
+			liveData.publishQuotes(message)
+			if liveDashboard.active() {
+				liveDashboard.publishBest(orderBookSet.tops(message))
+			}
+			return quotes.add(handleCtx, message)
+		},
+		quotations: func(handleCtx context.Context, event quotationsEvent) error {
+			merged := quotationStates.merge(event)
+			return errors.Join(
+				quotationCandles.addQuotations(handleCtx, merged),
+				quotations.add(handleCtx, merged),
+			)
+		},
+		historyCandles: discardNil(out.historyCandles),
+		secInfo:        out.secInfo,
+		orders:         out.orders,
+		myTrades:       out.myTrades,
+		positions:      out.positions,
+		portfolio:      out.portfolio,
+		secInfoUpd: func(handleCtx context.Context, update commands.SecInfoUpd) error {
+			return secInfoUpd(handleCtx, secInfoUpdEvent{Received: time.Now(), Update: secInfoUpdStates.merge(update)})
+		},
+		reset: func() {
+			// A disconnect leaves an incomplete minute in memory. Do not merge
+			// fresh quotations into a candle with a gap in the source stream.
+			quotationCandles.reset()
+			sequence.sessionEnded()
+			orderBookSet.reset()
+			quotationStates.reset()
 		},
+		flush: func(flushCtx context.Context) error {
+			// Open candles go to the candles batcher, so it is flushed last.
+			return errors.Join(
+				trades.flush(flushCtx),
+				quotes.flush(flushCtx),
+				quotations.flush(flushCtx),
+				orderBookSet.close(flushCtx),
+				tradeCandles.flush(flushCtx),
+				quotationCandles.flush(flushCtx),
+				candles.flush(flushCtx),
+			)
+		},
+		orderBooks: orderBookSet,
 	}
 }
 
+// observeTrades tracks the exchange time of the last trade per security.
+func observeTrades(handle func(context.Context, commands.AllTrades) error) func(context.Context, commands.AllTrades) error {
+	return func(handleCtx context.Context, trades commands.AllTrades) error {
+		for _, trade := range trades.Items {
+			if tradeTime, err := time.ParseInLocation(tradeTimeLayout, trade.Time, moscowLocation); err == nil {
+				lastTradeTimestamp.WithLabelValues(trade.Board, trade.SecCode).Set(float64(tradeTime.Unix()))
+			}
+		}
+		return handle(handleCtx, trades)
+	}
+}
+
+// resilientInsert retries transient insert failures, then spools what is
+// still failing and moves permanent failures to the dead letter.
+func resilientInsert[T any](kind string, insert func(context.Context, T) error) func(context.Context, T) error {
+	return deadLettered(kind, false, spooled(eventSpool, kind, retried(kind, settings.Load().Retry, insert)))
+}
+
 type transaqEventWorkers struct {
 	cancel         context.CancelFunc
 	waitGroup      sync.WaitGroup
 	serverStatuses <-chan commands.ServerStatus
+	// Responses processTransaq reads from client.Data are copied into these
+	// channels, so ClickHouse writes do not block the response loop.
+	quotations     chan<- quotationsEvent
+	historyCandles chan<- historyCandlesEvent
+	orders         chan<- ordersEvent
+	myTrades       chan<- commands.ClientTrades
+	positions      chan<- positionsEvent
+	portfolio      chan<- portfolioEvent
 }
 
 func startTransaqEventWorkers(
@@ -53,9 +162,36 @@ func startTransaqEventWorkers(
 	startQueuedWorker(workerCtx, &workers.waitGroup, "quotes", client.QuotesChan, handlers.quotes)
 	startQueuedWorker(workerCtx, &workers.waitGroup, "security info", client.SecInfoChan, handlers.secInfo)
 	startQueuedWorker(workerCtx, &workers.waitGroup, "security update", client.SecInfoUpdChan, handlers.secInfoUpd)
+	historyCandles := make(chan historyCandlesEvent)
+	workers.historyCandles = historyCandles
+	startQueuedWorker(workerCtx, &workers.waitGroup, "history candles", historyCandles, handlers.historyCandles)
+	quotations := make(chan quotationsEvent)
+	workers.quotations = quotations
+	startQueuedWorker(workerCtx, &workers.waitGroup, "quotations", quotations, handlers.quotations)
+	orders := make(chan ordersEvent)
+	workers.orders = orders
+	startQueuedWorker(workerCtx, &workers.waitGroup, "orders", orders, handlers.orders)
+	myTrades := make(chan commands.ClientTrades)
+	workers.myTrades = myTrades
+	startQueuedWorker(workerCtx, &workers.waitGroup, "my trades", myTrades, handlers.myTrades)
+	positions := make(chan positionsEvent)
+	workers.positions = positions
+	startQueuedWorker(workerCtx, &workers.waitGroup, "positions", positions, handlers.positions)
+	portfolio := make(chan portfolioEvent)
+	workers.portfolio = portfolio
+	startQueuedWorker(workerCtx, &workers.waitGroup, "portfolio", portfolio, handlers.portfolio)
 	return workers
 }
 
+// dispatch hands a response over to its worker. The worker queue always
+// accepts, so this only waits while the session is running.
+func dispatch[T any](dispatchCtx context.Context, worker chan<- T, event T) {
+	select {
+	case <-dispatchCtx.Done():
+	case worker <- event:
+	}
+}
+
 func (workers *transaqEventWorkers) stop() {
 	workers.cancel()
 	workers.waitGroup.Wait()
@@ -89,6 +225,7 @@ func startQueuedWorker[T any](
 				if err := handle(workerCtx, event); err != nil && workerCtx.Err() == nil {
 					log.Errorf("Process TRANSAQ %s event: %v", name, err)
 				}
+				health.eventProcessed()
 			}
 		}
 	}()
@@ -114,6 +251,12 @@ func startBufferedChannel[T any](
 
 		queue := make([]T, 0)
 		nextWarning := eventQueueWarningSize
+		depth := queueDepth.WithLabelValues(name)
+		setDepth := func(size int) {
+			depth.Set(float64(size))
+			health.setQueueDepth(name, size)
+		}
+		defer setDepth(0)
 		for {
 			var output chan<- T
 			var first T
@@ -133,7 +276,9 @@ func startBufferedChannel[T any](
 					}
 					continue
 				}
+				eventsReceived.WithLabelValues(name).Inc()
 				queue = append(queue, event)
+				setDepth(len(queue))
 				if len(queue) >= nextWarning {
 					log.Warnf("TRANSAQ %s queue reached %d events", name, len(queue))
 					nextWarning *= 2
@@ -142,6 +287,7 @@ func startBufferedChannel[T any](
 				var zero T
 				queue[0] = zero
 				queue = queue[1:]
+				setDepth(len(queue))
 			}
 		}
 	}()
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// gapReportLimit caps the missing bars listed per series in the log.
+const gapReportLimit = 10
+
+type gapsConfig struct {
+	// Interval between scans of the history candles, 0 disables the job.
+	Interval time.Duration `yaml:"interval"`
+	// Lookback is how far back a scan looks for missing bars.
+	Lookback time.Duration `yaml:"lookback"`
+	// Sessions are the Moscow trading hours of a working day, "HH:MM-HH:MM".
+	// Bars overlapping them are expected to exist.
+	Sessions []string `yaml:"sessions"`
+	// Holidays are the MOEX non-trading working days, "YYYY-MM-DD".
+	Holidays []string `yaml:"holidays"`
+}
+
+type tradingSession struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// tradingCalendar tells which candles should exist on MOEX.
+type tradingCalendar struct {
+	sessions []tradingSession
+	holidays map[string]bool
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func newTradingCalendar(config gapsConfig) (tradingCalendar, error) {
+	calendar := tradingCalendar{holidays: map[string]bool{}}
+	var errs []error
+	for _, session := range config.Sessions {
+		startClock, endClock, found := strings.Cut(session, "-")
+		start, startErr := parseClock(startClock)
+		end, endErr := parseClock(endClock)
+		if !found || startErr != nil || endErr != nil || end <= start {
+			errs = append(errs, fmt.Errorf("gaps.sessions: %q, want HH:MM-HH:MM", session))
+			continue
+		}
+		calendar.sessions = append(calendar.sessions, tradingSession{start: start, end: end})
+	}
+	for _, holiday := range config.Holidays {
+		if _, err := time.Parse(time.DateOnly, holiday); err != nil {
+			errs = append(errs, fmt.Errorf("gaps.holidays: %q, want YYYY-MM-DD", holiday))
+			continue
+		}
+		calendar.holidays[holiday] = true
+	}
+	return calendar, errors.Join(errs...)
+}
+
+func (calendar tradingCalendar) isTradingDay(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	return !calendar.holidays[day.Format(time.DateOnly)]
+}
+
+// sameSession reports whether both times fall into one trading session.
+func (calendar tradingCalendar) sameSession(first, second time.Time) bool {
+	first, second = first.In(moscowLocation), second.In(moscowLocation)
+	if first.YearDay() != second.YearDay() || first.Year() != second.Year() || !calendar.isTradingDay(first) {
+		return false
+	}
+	day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, moscowLocation)
+	for _, session := range calendar.sessions {
+		start, end := day.Add(session.start), day.Add(session.end)
+		if !first.Before(start) && !second.Before(start) && first.Before(end) && second.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedBars lists the starts of the closed bars of a period between from
+// and to that overlap a trading session. Day bars start at midnight, longer
+// periods are not checked.
+func (calendar tradingCalendar) expectedBars(from, to time.Time, periodSeconds int) []time.Time {
+	period := time.Duration(periodSeconds) * time.Second
+	if period <= 0 || period > 24*time.Hour {
+		return nil
+	}
+	from, to = from.In(moscowLocation), to.In(moscowLocation)
+	var bars []time.Time
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, moscowLocation); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !calendar.isTradingDay(day) {
+			continue
+		}
+		dayBars := []time.Time{day}
+		if period < 24*time.Hour {
+			dayBars = dayBars[:0]
+			for _, session := range calendar.sessions {
+				for bar := bucketStart(day.Add(session.start), period); bar.Before(day.Add(session.end)); bar = bar.Add(period) {
+					if !slices.Contains(dayBars, bar) {
+						dayBars = append(dayBars, bar)
+					}
+				}
+			}
+		}
+		for _, bar := range dayBars {
+			if !bar.Before(from) && !bar.Add(period).After(to) {
+				bars = append(bars, bar)
+			}
+		}
+	}
+	return bars
+}
+
+// missingBars returns the expected bars that are not stored.
+func missingBars(expected, stored []time.Time) []time.Time {
+	have := make(map[int64]bool, len(stored))
+	for _, bar := range stored {
+		have[bar.Unix()] = true
+	}
+	var missing []time.Time
+	for _, bar := range expected {
+		if !have[bar.Unix()] {
+			missing = append(missing, bar)
+		}
+	}
+	return missing
+}
+
+// candleGapRepair scans the stored history candles for bars missing during
+// trading sessions and asks TRANSAQ for enough of the latest candles to
+// cover the oldest of them. Bars still missing after that had no trades or
+// are not available from the server, they are reported once and not asked
+// for again.
+type candleGapRepair struct {
+	config   gapsConfig
+	calendar tradingCalendar
+	backfill *candleBackfill
+	load     func(context.Context, candleSeries, time.Time) ([]time.Time, error)
+	now      func() time.Time
+	// unfilled holds the bars per series key a repair could not fill, as
+	// Unix seconds. Sessions run one after another, so it needs no lock.
+	unfilled map[string]map[int64]bool
+}
+
+func newCandleGapRepair(config gapsConfig, backfill *candleBackfill) *candleGapRepair {
+	// The calendar was validated with the config.
+	calendar, _ := newTradingCalendar(config)
+	return &candleGapRepair{config: config, calendar: calendar, backfill: backfill, load: loadCandleDates, now: time.Now, unfilled: map[string]map[int64]bool{}}
+}
+
+// run scans all series every config.Interval until runCtx ends.
+func (repair *candleGapRepair) run(runCtx context.Context, send func(commands.Command) error, series []candleSeries) {
+	if repair.config.Interval <= 0 || len(series) == 0 {
+		return
+	}
+	ticker := time.NewTicker(repair.config.Interval)
+	defer ticker.Stop()
+	for {
+		for _, item := range series {
+			if err := repair.repairSeries(runCtx, send, item); err != nil {
+				if runCtx.Err() != nil {
+					return
+				}
+				log.Warnf("Repair candle gaps of %s period %ds: %v", item.SecCode, item.PeriodSeconds, err)
+			}
+		}
+		select {
+		case <-runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (repair *candleGapRepair) repairSeries(repairCtx context.Context, send func(commands.Command) error, series candleSeries) error {
+	now := repair.now()
+	from := now.Add(-repair.config.Lookback)
+	expected := repair.calendar.expectedBars(from, now, series.PeriodSeconds)
+	if len(expected) == 0 {
+		return nil
+	}
+	stored, err := repair.load(repairCtx, series, from)
+	if err != nil {
+		return fmt.Errorf("load stored candles: %w", err)
+	}
+	// Bars older than the lookback are not scanned any more.
+	unfilled := repair.unfilled[series.key()]
+	maps.DeleteFunc(unfilled, func(bar int64, _ bool) bool { return bar < from.Unix() })
+	missing := slices.DeleteFunc(missingBars(expected, stored), func(bar time.Time) bool { return unfilled[bar.Unix()] })
+	gapLabels := []string{series.SecCode, strconv.Itoa(series.PeriodSeconds)}
+	if len(missing) == 0 {
+		candleGapsMissing.WithLabelValues(gapLabels...).Set(float64(len(unfilled)))
+		return nil
+	}
+
+	count := len(repair.calendar.expectedBars(missing[0], now, series.PeriodSeconds))
+	log.Infof("Candle gaps of %s period %ds: %d bars missing since %s, request %d candles",
+		series.SecCode, series.PeriodSeconds, len(missing), missing[0].Format(tableTimeLayout), count)
+	repair.backfill.run(repairCtx, send, count, []candleSeries{series})
+	if repairCtx.Err() != nil {
+		return repairCtx.Err()
+	}
+
+	if stored, err = repair.load(repairCtx, series, from); err != nil {
+		return fmt.Errorf("load repaired candles: %w", err)
+	}
+	remaining := missingBars(missing, stored)
+	if len(remaining) > 0 && unfilled == nil {
+		unfilled = map[int64]bool{}
+		repair.unfilled[series.key()] = unfilled
+	}
+	for _, bar := range remaining {
+		unfilled[bar.Unix()] = true
+	}
+	candleGapsMissing.WithLabelValues(gapLabels...).Set(float64(len(unfilled)))
+	log.Infof("Candle gaps of %s period %ds: %d repaired, %d still missing",
+		series.SecCode, series.PeriodSeconds, len(missing)-len(remaining), len(remaining))
+	if len(remaining) > 0 {
+		report := make([]string, 0, gapReportLimit)
+		for _, bar := range remaining[:min(len(remaining), gapReportLimit)] {
+			report = append(report, bar.Format(tableTimeLayout))
+		}
+		log.Warnf("Candle bars of %s period %ds still missing, not requested again: %s", series.SecCode, series.PeriodSeconds, strings.Join(report, ", "))
+	}
+	return nil
+}
+
+func loadCandleDates(loadCtx context.Context, series candleSeries, from time.Time) ([]time.Time, error) {
+	var rows []struct {
+		Date time.Time `ch:"date"`
+	}
+	if err := connect.Select(loadCtx, &rows, ChCandleDatesSelectQuery,
+		series.SecCode, uint16(series.Period), candleSourceHistory, from.In(moscowLocation).Format(tableTimeLayout),
+	); err != nil {
+		return nil, err
+	}
+	dates := make([]time.Time, 0, len(rows))
+	for _, row := range rows {
+		dates = append(dates, row.Date)
+	}
+	return dates, nil
+}
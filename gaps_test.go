@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestTradingCalendarExpectsBarsOnlyInSessions(t *testing.T) {
+	calendar, err := newTradingCalendar(gapsConfig{
+		Sessions: []string{"10:00-12:00", "12:05-13:00"},
+		Holidays: []string{"2026-08-17"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday 11:00 to Monday (holiday) 13:00.
+	from := time.Date(2026, time.August, 14, 11, 0, 0, 0, moscowLocation)
+	to := time.Date(2026, time.August, 17, 13, 0, 0, 0, moscowLocation)
+	bars := calendar.expectedBars(from, to, 3600)
+	want := []time.Time{
+		time.Date(2026, time.August, 14, 11, 0, 0, 0, moscowLocation),
+		time.Date(2026, time.August, 14, 12, 0, 0, 0, moscowLocation),
+	}
+	if len(bars) != len(want) || !bars[0].Equal(want[0]) || !bars[1].Equal(want[1]) {
+		t.Fatalf("hour bars = %v, want %v", bars, want)
+	}
+	if minutes := calendar.expectedBars(from, to, 60); len(minutes) != 60+55 {
+		t.Fatalf("minute bars = %d, want 115", len(minutes))
+	}
+	if days := calendar.expectedBars(from.AddDate(0, 0, -1), to, 86400); len(days) != 1 {
+		t.Fatalf("day bars = %v, want only Friday", days)
+	}
+}
+
+func TestTradingCalendarRejectsBadSessions(t *testing.T) {
+	if _, err := newTradingCalendar(gapsConfig{Sessions: []string{"18:00-10:00"}}); err == nil {
+		t.Fatal("inverted session was accepted")
+	}
+}
+
+func TestCandleGapRepairRequestsMissingBarsAndReportsRest(t *testing.T) {
+	now := time.Date(2026, time.August, 14, 10, 5, 0, 0, moscowLocation)
+	stored := []time.Time{
+		time.Date(2026, time.August, 14, 10, 0, 0, 0, moscowLocation),
+		time.Date(2026, time.August, 14, 10, 4, 0, 0, moscowLocation),
+	}
+	var saved []backfillCheckpoint
+	backfill := newTestCandleBackfill(nil, &saved)
+	repair := newCandleGapRepair(gapsConfig{Lookback: time.Hour, Sessions: []string{"10:00-18:40"}}, backfill)
+	repair.now = func() time.Time { return now }
+	loads := 0
+	repair.load = func(context.Context, candleSeries, time.Time) ([]time.Time, error) {
+		loads++
+		if loads > 1 {
+			// The repair brought 10:01 and 10:03, 10:02 had no trades.
+			return append(stored,
+				time.Date(2026, time.August, 14, 10, 1, 0, 0, moscowLocation),
+				time.Date(2026, time.August, 14, 10, 3, 0, 0, moscowLocation),
+			), nil
+		}
+		return stored, nil
+	}
+	server := &fakeHistoryServer{
+		handle: backfill.observe(func(context.Context, historyCandlesEvent) error { return nil }),
+		responses: []commands.Candles{
+			{SecId: 1, Period: 1, Status: candlesStatusCountDelivered, Items: make([]commands.Candle, 3)},
+		},
+	}
+
+	series := candleSeries{SecId: 1, SecCode: "SBER", Period: 1, PeriodSeconds: 60}
+	if err := repair.repairSeries(context.Background(), server.send, series); err != nil {
+		t.Fatal(err)
+	}
+	// 10:01 to 10:04 are the latest four closed bars.
+	if len(server.commands) != 1 || server.commands[0].Count != 4 || server.commands[0].Reset != "true" {
+		t.Fatalf("commands = %+v", server.commands)
+	}
+	if loads != 2 {
+		t.Fatalf("loads = %d, want a scan before and after the repair", loads)
+	}
+
+	// 10:02 could not be filled and is not requested again.
+	if err := repair.repairSeries(context.Background(), server.send, series); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.commands) != 1 {
+		t.Fatalf("unfilled bar requested again: %+v", server.commands)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/transaq-clickhouse-exporter/marketdata"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative marketdata/marketdata.proto
+
+// grpcConfig enables the MarketData streaming service of marketdata.proto.
+// An empty listen address disables the gRPC server.
+type grpcConfig struct {
+	Listen string `yaml:"listen"`
+	// BufferSize is the number of messages held for a subscriber, a
+	// subscriber falling further behind is disconnected.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// liveSubscriber is one open stream. slow is closed when the subscriber was
+// dropped for not keeping up.
+type liveSubscriber[T any] struct {
+	filters []*marketdata.SecurityFilter
+	events  chan T
+	slow    chan struct{}
+}
+
+func (subscriber *liveSubscriber[T]) matches(board, secCode string) bool {
+	if len(subscriber.filters) == 0 {
+		return true
+	}
+	for _, filter := range subscriber.filters {
+		if (filter.GetBoard() == "" || filter.GetBoard() == board) && (filter.GetSecCode() == "" || filter.GetSecCode() == secCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// liveStream hands the events of one kind to its subscribers. Publishing
+// never waits for a subscriber, so a stalled client cannot hold back the
+// event workers and the sinks.
+type liveStream[T any] struct {
+	name        string
+	lock        sync.Mutex
+	subscribers map[*liveSubscriber[T]]struct{}
+}
+
+func newLiveStream[T any](name string) *liveStream[T] {
+	return &liveStream[T]{name: name, subscribers: map[*liveSubscriber[T]]struct{}{}}
+}
+
+func (stream *liveStream[T]) subscribe(filters []*marketdata.SecurityFilter, bufferSize int) *liveSubscriber[T] {
+	subscriber := &liveSubscriber[T]{filters: filters, events: make(chan T, bufferSize), slow: make(chan struct{})}
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.subscribers[subscriber] = struct{}{}
+	grpcSubscribers.WithLabelValues(stream.name).Inc()
+	return subscriber
+}
+
+func (stream *liveStream[T]) unsubscribe(subscriber *liveSubscriber[T]) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if _, ok := stream.subscribers[subscriber]; ok {
+		delete(stream.subscribers, subscriber)
+		grpcSubscribers.WithLabelValues(stream.name).Dec()
+	}
+}
+
+// publish sends an event of a security to the subscribers asking for it. The
+// message is only built when there is one.
+func (stream *liveStream[T]) publish(board, secCode string, build func() T) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	var event T
+	built := false
+	for subscriber := range stream.subscribers {
+		if !subscriber.matches(board, secCode) {
+			continue
+		}
+		if !built {
+			event, built = build(), true
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(stream.subscribers, subscriber)
+			close(subscriber.slow)
+			grpcSubscribers.WithLabelValues(stream.name).Dec()
+			grpcSlowSubscribers.WithLabelValues(stream.name).Inc()
+			log.Warnf("Disconnect slow %s subscriber, %d messages behind", stream.name, cap(subscriber.events))
+		}
+	}
+}
+
+// serveStream sends the events of a stream to one client until it goes away
+// or falls behind.
+func serveStream[T any](stream *liveStream[*T], request *marketdata.StreamRequest, server grpc.ServerStreamingServer[T]) error {
+	subscriber := stream.subscribe(request.GetSecurities(), settings.Load().GRPC.BufferSize)
+	defer stream.unsubscribe(subscriber)
+	for {
+		select {
+		case <-server.Context().Done():
+			return status.FromContextError(server.Context().Err()).Err()
+		case <-subscriber.slow:
+			return status.Errorf(codes.ResourceExhausted, "%s subscriber fell %d messages behind", stream.name, cap(subscriber.events))
+		case event := <-subscriber.events:
+			if err := server.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// liveMarketData fans the events the event workers receive out to the
+// gRPC subscribers.
+type liveMarketData struct {
+	marketdata.UnimplementedMarketDataServer
+	trades  *liveStream[*marketdata.Trade]
+	quotes  *liveStream[*marketdata.Quote]
+	candles *liveStream[*marketdata.Candle]
+}
+
+// liveData is the live market data of the running exporter.
+var liveData = newLiveMarketData()
+
+func newLiveMarketData() *liveMarketData {
+	return &liveMarketData{
+		trades:  newLiveStream[*marketdata.Trade]("trades"),
+		quotes:  newLiveStream[*marketdata.Quote]("quotes"),
+		candles: newLiveStream[*marketdata.Candle]("candles"),
+	}
+}
+
+func (live *liveMarketData) StreamTrades(request *marketdata.StreamRequest, server grpc.ServerStreamingServer[marketdata.Trade]) error {
+	return serveStream(live.trades, request, server)
+}
+
+func (live *liveMarketData) StreamQuotes(request *marketdata.StreamRequest, server grpc.ServerStreamingServer[marketdata.Quote]) error {
+	return serveStream(live.quotes, request, server)
+}
+
+func (live *liveMarketData) StreamCandles(request *marketdata.StreamRequest, server grpc.ServerStreamingServer[marketdata.Candle]) error {
+	return serveStream(live.candles, request, server)
+}
+
+func (live *liveMarketData) publishTrades(trades commands.AllTrades) {
+	for _, trade := range trades.Items {
+		live.trades.publish(trade.Board, trade.SecCode, func() *marketdata.Trade {
+			tradeTime, _ := time.ParseInLocation(tradeTimeLayout, trade.Time, moscowLocation)
+			return &marketdata.Trade{
+				Time:         timestamppb.New(tradeTime),
+				Secid:        int32(trade.SecId),
+				Board:        trade.Board,
+				SecCode:      trade.SecCode,
+				TradeNo:      trade.TradeNo,
+				Price:        trade.Price,
+				Quantity:     int32(trade.Quantity),
+				BuySell:      trade.BuySell,
+				OpenInterest: int32(trade.OpenInterest),
+				Period:       trade.Period,
+			}
+		})
+	}
+}
+
+func (live *liveMarketData) publishQuotes(quotes commands.Quotes) {
+	for _, quote := range quotes.Items {
+		live.quotes.publish(quote.Board, quote.SecCode, func() *marketdata.Quote {
+			return &marketdata.Quote{
+				Time:    timestamppb.New(quotes.Time),
+				Secid:   int32(quote.SecId),
+				Board:   quote.Board,
+				SecCode: quote.SecCode,
+				Price:   quote.Price,
+				Source:  quote.Source,
+				Yield:   int32(quote.Yield),
+				Buy:     int32(quote.Buy),
+				Sell:    int32(quote.Sell),
+			}
+		})
+	}
+}
+
+func (live *liveMarketData) publishCandles(candles []aggregatedCandle) {
+	for _, candle := range candles {
+		live.candles.publish(candle.Board, candle.SecCode, func() *marketdata.Candle {
+			return &marketdata.Candle{
+				Start:         timestamppb.New(candle.Start),
+				Board:         candle.Board,
+				SecCode:       candle.SecCode,
+				PeriodSeconds: int32(candle.PeriodSeconds),
+				Source:        candle.Source,
+				Open:          candle.Open,
+				High:          candle.High,
+				Low:           candle.Low,
+				Close:         candle.Close,
+				Volume:        candle.Volume,
+				Trades:        int32(candle.Trades),
+				Vwap:          candle.vwap(),
+			}
+		})
+	}
+}
+
+// serveGRPC runs the MarketData service until serveCtx is done.
+func serveGRPC(serveCtx context.Context, listen string, live *liveMarketData) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Errorf("gRPC server: %v", err)
+		return
+	}
+	server := grpc.NewServer()
+	marketdata.RegisterMarketDataServer(server, live)
+	go func() {
+		<-serveCtx.Done()
+		server.Stop()
+	}()
+	log.Infof("Serve gRPC on %s", listen)
+	if err := server.Serve(listener); err != nil {
+		log.Errorf("gRPC server: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/transaq-clickhouse-exporter/marketdata"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestStreamTradesSendsFilteredSecurities(t *testing.T) {
+	live := newLiveMarketData()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	marketdata.RegisterMarketDataServer(server, live)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	streamCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := marketdata.NewMarketDataClient(conn).StreamTrades(streamCtx, &marketdata.StreamRequest{
+		Securities: []*marketdata.SecurityFilter{{Board: "TQBR", SecCode: "SBER"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for subscribers(live.trades) == 0 {
+		if streamCtx.Err() != nil {
+			t.Fatal("stream did not subscribe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	live.publishTrades(commands.AllTrades{Items: []commands.Trade{
+		{Board: "TQBR", SecCode: "GAZP", TradeNo: 1, Time: "14.08.2026 12:00:00"},
+		{Board: "SMAL", SecCode: "SBER", TradeNo: 2, Time: "14.08.2026 12:00:00"},
+		{Board: "TQBR", SecCode: "SBER", TradeNo: 3, Time: "14.08.2026 12:00:01", Price: 300},
+	}})
+
+	trade, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.GetTradeNo() != 3 || trade.GetPrice() != 300 || !trade.GetTime().AsTime().Equal(time.Date(2026, 8, 14, 12, 0, 1, 0, moscowLocation)) {
+		t.Fatalf("trade = %v", trade)
+	}
+}
+
+func TestLiveStreamDisconnectsSlowSubscriber(t *testing.T) {
+	stream := newLiveStream[*marketdata.Quote]("quotes")
+	slow := stream.subscribe(nil, 1)
+	other := stream.subscribe([]*marketdata.SecurityFilter{{SecCode: "GAZP"}}, 1)
+	for range 2 {
+		stream.publish("TQBR", "SBER", func() *marketdata.Quote { return &marketdata.Quote{SecCode: "SBER"} })
+	}
+
+	select {
+	case <-slow.slow:
+	default:
+		t.Fatal("slow subscriber still connected")
+	}
+	if len(slow.events) != 1 || len(other.events) != 0 || subscribers(stream) != 1 {
+		t.Fatalf("buffered %d and %d, %d subscribers", len(slow.events), len(other.events), subscribers(stream))
+	}
+	stream.unsubscribe(slow)
+	stream.unsubscribe(other)
+	if subscribers(stream) != 0 {
+		t.Fatal("subscriber left after unsubscribe")
+	}
+}
+
+func subscribers[T any](stream *liveStream[T]) int {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return len(stream.subscribers)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type healthConfig struct {
+	// StaleAfter is how long the exporter may go without processing an event
+	// during trading hours before /healthz fails.
+	StaleAfter time.Duration `yaml:"stale_after"`
+	// QueueLimit fails /healthz when any event worker queue grows beyond it.
+	QueueLimit   int    `yaml:"queue_limit"`
+	TradingStart string `yaml:"trading_start"`
+	TradingEnd   string `yaml:"trading_end"`
+}
+
+// exporterHealth collects what processTransaq and the event workers know
+// about the exporter state for the /healthz and /readyz endpoints.
+type exporterHealth struct {
+	lock                  sync.Mutex
+	sinksReady            bool
+	connected             bool
+	subscriptionsRestored bool
+	lastEvent             time.Time
+	queueDepths           map[string]int
+}
+
+var health = &exporterHealth{lastEvent: time.Now(), queueDepths: map[string]int{}}
+
+type healthStatus struct {
+	OK                    bool           `json:"ok"`
+	Reasons               []string       `json:"reasons,omitempty"`
+	SinksReady            bool           `json:"sinks_ready"`
+	Connected             bool           `json:"connected"`
+	SubscriptionsRestored bool           `json:"subscriptions_restored"`
+	LastEvent             time.Time      `json:"last_event"`
+	QueueDepths           map[string]int `json:"queue_depths"`
+}
+
+func (h *exporterHealth) setSinksReady(ready bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sinksReady = ready
+}
+
+func (h *exporterHealth) setSession(connected, subscriptionsRestored bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.connected = connected
+	h.subscriptionsRestored = subscriptionsRestored
+}
+
+func (h *exporterHealth) eventProcessed() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastEvent = time.Now()
+}
+
+func (h *exporterHealth) setQueueDepth(queue string, depth int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.queueDepths[queue] = depth
+}
+
+func (h *exporterHealth) snapshot() healthStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return healthStatus{
+		SinksReady:            h.sinksReady,
+		Connected:             h.connected,
+		SubscriptionsRestored: h.subscriptionsRestored,
+		LastEvent:             h.lastEvent,
+		QueueDepths:           maps.Clone(h.queueDepths),
+	}
+}
+
+// readiness is ready once the sinks are open, the TRANSAQ server reported
+// connected=true and subscriptions were restored in the current session.
+func (h *exporterHealth) readiness() healthStatus {
+	status := h.snapshot()
+	if !status.SinksReady {
+		status.Reasons = append(status.Reasons, "sinks are not open")
+	}
+	if !status.Connected {
+		status.Reasons = append(status.Reasons, "TRANSAQ server is not connected")
+	}
+	if !status.SubscriptionsRestored {
+		status.Reasons = append(status.Reasons, "subscriptions are not restored")
+	}
+	status.OK = len(status.Reasons) == 0
+	return status
+}
+
+// liveness fails when no event was processed for too long during trading
+// hours or when a worker queue keeps growing behind ClickHouse.
+func (h *exporterHealth) liveness(config healthConfig, now time.Time) healthStatus {
+	status := h.snapshot()
+	if config.StaleAfter > 0 && isTradingTime(config, now) && now.Sub(status.LastEvent) > config.StaleAfter {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("no events processed since %s", status.LastEvent.Format(time.RFC3339)))
+	}
+	if config.QueueLimit > 0 {
+		for queue, depth := range status.QueueDepths {
+			if depth > config.QueueLimit {
+				status.Reasons = append(status.Reasons, fmt.Sprintf("%s queue holds %d events", queue, depth))
+			}
+		}
+	}
+	status.OK = len(status.Reasons) == 0
+	return status
+}
+
+// isTradingTime reports whether now falls into the configured trading hours
+// of a Moscow working day.
+func isTradingTime(config healthConfig, now time.Time) bool {
+	moscowNow := now.In(moscowLocation)
+	if moscowNow.Weekday() == time.Saturday || moscowNow.Weekday() == time.Sunday {
+		return false
+	}
+	clock := moscowNow.Format("15:04")
+	return clock >= config.TradingStart && clock < config.TradingEnd
+}
+
+func writeHealthStatus(writer http.ResponseWriter, status healthStatus) {
+	writer.Header().Set("Content-Type", "application/json")
+	if !status.OK {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(writer).Encode(status)
+}
+
+func handleHealthz(writer http.ResponseWriter, _ *http.Request) {
+	writeHealthStatus(writer, health.liveness(settings.Load().Health, time.Now()))
+}
+
+func handleReadyz(writer http.ResponseWriter, _ *http.Request) {
+	writeHealthStatus(writer, health.readiness())
+}
+
+// runSystemdWatchdog sends READY=1 once the exporter is ready and WATCHDOG=1
+// while it is alive, when started by systemd with WatchdogSec.
+func runSystemdWatchdog(done <-chan struct{}) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	watchdogUsec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if socket == "" || err != nil || watchdogUsec <= 0 {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Warnf("systemd notify socket: %v", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	ticker := time.NewTicker(time.Duration(watchdogUsec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	notifiedReady := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !notifiedReady && health.readiness().OK {
+			_, _ = conn.Write([]byte("READY=1"))
+			notifiedReady = true
+		}
+		if health.liveness(settings.Load().Health, time.Now()).OK {
+			_, _ = conn.Write([]byte("WATCHDOG=1"))
+		}
+	}
+}
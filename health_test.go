@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExporterHealthReadiness(t *testing.T) {
+	state := &exporterHealth{queueDepths: map[string]int{}}
+	if state.readiness().OK {
+		t.Fatal("ready before the sinks were opened")
+	}
+	state.setSinksReady(true)
+	state.setSession(true, false)
+	if status := state.readiness(); status.OK || len(status.Reasons) != 1 {
+		t.Fatalf("readiness while restoring = %+v", status)
+	}
+	state.setSession(true, true)
+	if status := state.readiness(); !status.OK {
+		t.Fatalf("readiness = %+v", status)
+	}
+}
+
+func TestExporterHealthLiveness(t *testing.T) {
+	config := healthConfig{StaleAfter: 5 * time.Minute, QueueLimit: 10, TradingStart: "07:00", TradingEnd: "23:50"}
+	// Friday 14 August 2026, 12:00 Moscow time.
+	tradingNow := time.Date(2026, time.August, 14, 9, 0, 0, 0, time.UTC)
+	state := &exporterHealth{lastEvent: tradingNow.Add(-time.Minute), queueDepths: map[string]int{}}
+	if status := state.liveness(config, tradingNow); !status.OK {
+		t.Fatalf("liveness = %+v", status)
+	}
+	if state.liveness(config, tradingNow.Add(10*time.Minute)).OK {
+		t.Fatal("alive without events during trading hours")
+	}
+	if status := state.liveness(config, tradingNow.Add(24*time.Hour)); !status.OK {
+		t.Fatalf("liveness on Saturday = %+v", status)
+	}
+	state.setQueueDepth("all trades", 11)
+	if state.liveness(config, tradingNow).OK {
+		t.Fatal("alive with an overflowing queue")
+	}
+}
+
+func TestReadyzReportsServiceUnavailable(t *testing.T) {
+	previousHealth := health
+	defer func() { health = previousHealth }()
+	health = &exporterHealth{queueDepths: map[string]int{}}
+
+	recorder := httptest.NewRecorder()
+	newHTTPMux(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz status = %d", recorder.Code)
+	}
+}
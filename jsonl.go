@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Streams of the JSON Lines sink, one directory each.
+const (
+	jsonlStreamTrades     = "trades"
+	jsonlStreamQuotes     = "quotes"
+	jsonlStreamCandles    = "candles"
+	jsonlStreamSecurities = "securities"
+	jsonlStreamSecInfo    = "sec_info"
+)
+
+type jsonlConfig struct {
+	// Dir holds a directory per stream.
+	Dir string `yaml:"dir"`
+	// MaxSizeMB rotates a file once it grows beyond this size.
+	MaxSizeMB int64 `yaml:"max_size_mb"`
+}
+
+// jsonlStream appends the records of one data type to
+// <dir>/<stream>/<stream>-<trading day>.<n>.jsonl. A file is closed and
+// compressed to .jsonl.gz when it outgrows the size limit, when the Moscow
+// trading day changes and on shutdown. Compression runs in the background,
+// writes go on to the next file meanwhile.
+type jsonlStream struct {
+	dir     string
+	name    string
+	maxSize int64
+	now     func() time.Time
+
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	day    string
+	size   int64
+
+	// compressing tracks the compression of closed files, compressErrs
+	// collects their failures for close.
+	compressing  sync.WaitGroup
+	compressErrs []error
+}
+
+func newJSONLStream(dir, name string, maxSize int64) (*jsonlStream, error) {
+	stream := &jsonlStream{dir: filepath.Join(dir, name), name: name, maxSize: maxSize, now: time.Now}
+	if err := os.MkdirAll(stream.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %s stream directory: %w", name, err)
+	}
+	// Files left open by a crash are rotated as they are.
+	leftovers, err := filepath.Glob(filepath.Join(stream.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		if err := compressFile(path); err != nil {
+			return nil, fmt.Errorf("compress %s: %w", path, err)
+		}
+	}
+	return stream, nil
+}
+
+// writeJSONL appends rows to the stream, a line each.
+func writeJSONL[T any](stream *jsonlStream, rows []T) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert(stream.name+".jsonl", len(rows), started, err) }()
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("encode %s record: %w", stream.name, err)
+		}
+		if err := stream.prepareLocked(int64(len(line) + 1)); err != nil {
+			return err
+		}
+		if _, err := stream.writer.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("write %s: %w", stream.file.Name(), err)
+		}
+		stream.size += int64(len(line) + 1)
+	}
+	if err := stream.writer.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", stream.file.Name(), err)
+	}
+	return nil
+}
+
+// prepareLocked rotates the current file if the next line does not belong
+// there and opens a file when there is none.
+func (stream *jsonlStream) prepareLocked(lineSize int64) error {
+	day := stream.now().In(moscowLocation).Format(time.DateOnly)
+	if stream.file != nil && (day != stream.day || stream.size > 0 && stream.size+lineSize > stream.maxSize) {
+		if err := stream.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if stream.file != nil {
+		return nil
+	}
+	sequence, err := stream.nextSequence(day)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stream.dir, fmt.Sprintf("%s-%s.%d.jsonl", stream.name, day, sequence))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open %s stream file: %w", stream.name, err)
+	}
+	stream.file, stream.writer, stream.day, stream.size = file, bufio.NewWriter(file), day, 0
+	return nil
+}
+
+// nextSequence numbers the files of a day after the ones already there.
+func (stream *jsonlStream) nextSequence(day string) (int, error) {
+	prefix := stream.name + "-" + day + "."
+	existing, err := filepath.Glob(filepath.Join(stream.dir, prefix+"*"))
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	for _, path := range existing {
+		number, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(path), prefix), ".")
+		if sequence, err := strconv.Atoi(number); err == nil && sequence >= next {
+			next = sequence + 1
+		}
+	}
+	return next, nil
+}
+
+func (stream *jsonlStream) rotateLocked() error {
+	if stream.file == nil {
+		return nil
+	}
+	path := stream.file.Name()
+	flushErr := stream.writer.Flush()
+	closeErr := stream.file.Close()
+	stream.file, stream.writer = nil, nil
+	if flushErr != nil || closeErr != nil {
+		return fmt.Errorf("close %s: %w", path, errors.Join(flushErr, closeErr))
+	}
+	// A file left uncompressed by a crash is compressed on the next start.
+	stream.compressing.Add(1)
+	go func() {
+		defer stream.compressing.Done()
+		if err := compressFile(path); err != nil {
+			log.Errorf("Compress %s: %v", path, err)
+			stream.lock.Lock()
+			stream.compressErrs = append(stream.compressErrs, fmt.Errorf("compress %s: %w", path, err))
+			stream.lock.Unlock()
+		}
+	}()
+	return nil
+}
+
+// close rotates the current file and waits for the compression of all.
+func (stream *jsonlStream) close() error {
+	stream.lock.Lock()
+	err := stream.rotateLocked()
+	stream.lock.Unlock()
+	stream.compressing.Wait()
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return errors.Join(append([]error{err}, stream.compressErrs...)...)
+}
+
+// compressFile replaces path with path.gz.
+func compressFile(path string) (err error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := target.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(path + ".gz")
+		}
+	}()
+	compressor := gzip.NewWriter(target)
+	if _, err := io.Copy(compressor, source); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	if err := target.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// openJSONLSink writes trades, quotes, candles, securities and security info
+// to JSON Lines files under config.Dir.
+func openJSONLSink(config jsonlConfig) (sink, error) {
+	streams := map[string]*jsonlStream{}
+	closeStreams := func() error {
+		var errs []error
+		for _, stream := range streams {
+			errs = append(errs, stream.close())
+		}
+		return errors.Join(errs...)
+	}
+	for _, name := range []string{jsonlStreamTrades, jsonlStreamQuotes, jsonlStreamCandles, jsonlStreamSecurities, jsonlStreamSecInfo} {
+		stream, err := newJSONLStream(config.Dir, name, config.MaxSizeMB<<20)
+		if err != nil {
+			_ = closeStreams()
+			return sink{}, err
+		}
+		streams[name] = stream
+	}
+	return sink{
+		name: sinkJSONL,
+		trades: func(_ context.Context, batch []commands.AllTrades) error {
+			return writeJSONL(streams[jsonlStreamTrades], tradeRecords(batch))
+		},
+		quotes: func(_ context.Context, batch []commands.Quotes) error {
+			return writeJSONL(streams[jsonlStreamQuotes], quoteRecords(batch))
+		},
+		candles: func(_ context.Context, batch [][]aggregatedCandle) error {
+			return writeJSONL(streams[jsonlStreamCandles], candleRecords(batch))
+		},
+		historyCandles: func(_ context.Context, event historyCandlesEvent) error {
+			return writeJSONL(streams[jsonlStreamCandles], historyCandleRecords(event))
+		},
+		securities: func(_ context.Context, securities []commands.Security) error {
+			return writeJSONL(streams[jsonlStreamSecurities], securityRecords(securities))
+		},
+		secInfo: func(_ context.Context, secInfo commands.SecInfo) error {
+			return writeJSONL(streams[jsonlStreamSecInfo], []secInfoRow{secInfoRecord(secInfo)})
+		},
+		close: closeStreams,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func readJSONLGzip(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		record := map[string]any{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestJSONLStreamRotatesBySizeAndTradingDay(t *testing.T) {
+	dir := t.TempDir()
+	stream, err := newJSONLStream(dir, jsonlStreamTrades, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 8, 14, 23, 0, 0, 0, moscowLocation)
+	stream.now = func() time.Time { return now }
+	trade := func(tradeNo int64) commands.AllTrades {
+		return commands.AllTrades{Items: []commands.Trade{
+			{SecId: 1, Board: "TQBR", SecCode: "SBER", TradeNo: tradeNo, Time: "14.08.2026 23:00:00", Price: 100, Quantity: 1},
+		}}
+	}
+	// Each line is longer than half of the limit: one line per file.
+	if err := writeJSONL(stream, tradeRecords([]commands.AllTrades{trade(1), trade(2)})); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if err := writeJSONL(stream, tradeRecords([]commands.AllTrades{trade(3)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, tradeNo := range map[string]float64{
+		"trades-2026-08-14.1.jsonl.gz": 1,
+		"trades-2026-08-14.2.jsonl.gz": 2,
+		"trades-2026-08-15.1.jsonl.gz": 3,
+	} {
+		records := readJSONLGzip(t, filepath.Join(dir, jsonlStreamTrades, path))
+		if len(records) != 1 || records[0]["trade_no"] != tradeNo || records[0]["sec_code"] != "SBER" {
+			t.Fatalf("%s = %v", path, records)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, jsonlStreamTrades, "*.jsonl")); len(leftovers) != 0 {
+		t.Fatalf("uncompressed files left: %v", leftovers)
+	}
+}
+
+func TestJSONLSinkCompressesLeftoversAndContinuesNumbering(t *testing.T) {
+	dir := t.TempDir()
+	streamDir := filepath.Join(dir, jsonlStreamCandles)
+	if err := os.MkdirAll(streamDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Now().In(moscowLocation).Format(time.DateOnly)
+	leftover := filepath.Join(streamDir, "candles-"+day+".1.jsonl")
+	if err := os.WriteFile(leftover, []byte("{\"sec_code\":\"SBER\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := openJSONLSink(jsonlConfig{Dir: dir, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.historyCandles(context.Background(), historyCandlesEvent{
+		Candles:       commands.Candles{SecCode: "GAZP", Period: 1, Items: []commands.Candle{{Date: "14.08.2026 10:00:00", Close: 150}}},
+		PeriodSeconds: 60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := readJSONLGzip(t, leftover+".gz"); len(records) != 1 || records[0]["sec_code"] != "SBER" {
+		t.Fatalf("leftover = %v", records)
+	}
+	records := readJSONLGzip(t, filepath.Join(streamDir, "candles-"+day+".2.jsonl.gz"))
+	if len(records) != 1 || records[0]["sec_code"] != "GAZP" || records[0]["source"] != candleSourceHistory || records[0]["period_seconds"] != float64(60) {
+		t.Fatalf("candles = %v", records)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Topics of the Kafka sink, after kafka.topic_prefix.
+const (
+	kafkaTopicTrades  = "trades"
+	kafkaTopicQuotes  = "quotes"
+	kafkaTopicCandles = "candles"
+	kafkaTopicSecInfo = "sec_info"
+)
+
+type kafkaConfig struct {
+	Brokers     []string `yaml:"brokers"`
+	TopicPrefix string   `yaml:"topic_prefix"`
+	// DeliveryTimeout bounds the wait for the acknowledgement of a batch, a
+	// batch not acknowledged by then is retried like a failed insert.
+	DeliveryTimeout time.Duration `yaml:"delivery_timeout"`
+}
+
+// kafkaMessage is a record before it is produced, the key is board:sec_code.
+type kafkaMessage struct {
+	board   string
+	secCode string
+	value   any
+}
+
+// kafkaProducer publishes JSON messages to a topic per data type.
+type kafkaProducer struct {
+	client *kgo.Client
+	prefix string
+
+	// boards remembers the board of each exported security, security info
+	// does not carry one.
+	lock   sync.Mutex
+	boards map[string]string
+}
+
+func openKafka(openCtx context.Context, config kafkaConfig) (*kafkaProducer, error) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.RecordDeliveryTimeout(config.DeliveryTimeout),
+		kgo.ProducerBatchCompression(kgo.Lz4Compression()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create Kafka client: %w", err)
+	}
+	if err := client.Ping(openCtx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to Kafka: %w", err)
+	}
+	return &kafkaProducer{client: client, prefix: config.TopicPrefix, boards: map[string]string{}}, nil
+}
+
+// produce publishes messages and waits until the brokers acknowledged all
+// of them, so a slow cluster holds the batchers back like slow inserts do.
+func (producer *kafkaProducer) produce(produceCtx context.Context, topic string, messages []kafkaMessage) (err error) {
+	if len(messages) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("kafka."+topic, len(messages), started, err) }()
+	records := make([]*kgo.Record, 0, len(messages))
+	for _, message := range messages {
+		value, err := json.Marshal(message.value)
+		if err != nil {
+			return fmt.Errorf("encode %s message: %w", topic, err)
+		}
+		records = append(records, &kgo.Record{
+			Topic: producer.prefix + topic,
+			Key:   []byte(message.board + ":" + message.secCode),
+			Value: value,
+		})
+	}
+	if err := producer.client.ProduceSync(produceCtx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("produce to %s: %w", producer.prefix+topic, err)
+	}
+	return nil
+}
+
+func (producer *kafkaProducer) rememberBoards(securities []commands.Security) {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	for _, sec := range securities {
+		producer.boards[sec.SecCode] = sec.Board
+	}
+}
+
+func (producer *kafkaProducer) board(secCode string) string {
+	producer.lock.Lock()
+	defer producer.lock.Unlock()
+	return producer.boards[secCode]
+}
+
+func tradeMessages(batch []commands.AllTrades) []kafkaMessage {
+	var messages []kafkaMessage
+	for _, row := range tradeRecords(batch) {
+		messages = append(messages, kafkaMessage{board: row.Board, secCode: row.SecCode, value: row})
+	}
+	return messages
+}
+
+func quoteMessages(batch []commands.Quotes) []kafkaMessage {
+	var messages []kafkaMessage
+	for _, row := range quoteRecords(batch) {
+		messages = append(messages, kafkaMessage{board: row.Board, secCode: row.SecCode, value: row})
+	}
+	return messages
+}
+
+// candleMessages keys the candles by the board of the candle, the row has
+// the columns of transaq_candles, which has none.
+func candleMessages(batch [][]aggregatedCandle) []kafkaMessage {
+	var boards []string
+	for _, candles := range batch {
+		for _, candle := range candles {
+			boards = append(boards, candle.Board)
+		}
+	}
+	rows := candleRecords(batch)
+	messages := make([]kafkaMessage, 0, len(rows))
+	for i, row := range rows {
+		messages = append(messages, kafkaMessage{board: boards[i], secCode: row.SecCode, value: row})
+	}
+	return messages
+}
+
+func historyCandleMessages(event historyCandlesEvent) []kafkaMessage {
+	rows := historyCandleRecords(event)
+	messages := make([]kafkaMessage, 0, len(rows))
+	for _, row := range rows {
+		messages = append(messages, kafkaMessage{board: event.Candles.Board, secCode: row.SecCode, value: row})
+	}
+	return messages
+}
+
+// openKafkaSink publishes trades, quote deltas, candles and security info.
+// Unacknowledged batches are retried with the retry settings of the inserts,
+// then spooled in the kafka subdirectory of spool.dir and published again
+// once the brokers answer; batches the brokers reject go to the dead letter.
+func openKafkaSink(openCtx context.Context, config kafkaConfig) (sink, error) {
+	producer, err := openKafka(openCtx, config)
+	if err != nil {
+		return sink{}, err
+	}
+	resilience, err := openSinkSpool(settings.Load().Spool, sinkKafka)
+	if err != nil {
+		producer.client.Close()
+		return sink{}, err
+	}
+	out := sink{
+		name: sinkKafka,
+		trades: sinkWrite(resilience, spoolKindTrades, func(produceCtx context.Context, batch []commands.AllTrades) error {
+			return producer.produce(produceCtx, kafkaTopicTrades, tradeMessages(batch))
+		}),
+		quotes: sinkWrite(resilience, spoolKindQuotes, func(produceCtx context.Context, batch []commands.Quotes) error {
+			return producer.produce(produceCtx, kafkaTopicQuotes, quoteMessages(batch))
+		}),
+		candles: sinkWrite(resilience, spoolKindCandles, func(produceCtx context.Context, batch [][]aggregatedCandle) error {
+			return producer.produce(produceCtx, kafkaTopicCandles, candleMessages(batch))
+		}),
+		historyCandles: sinkWrite(resilience, spoolKindHistoryCandles, func(produceCtx context.Context, event historyCandlesEvent) error {
+			return producer.produce(produceCtx, kafkaTopicCandles, historyCandleMessages(event))
+		}),
+		securities: func(_ context.Context, securities []commands.Security) error {
+			producer.rememberBoards(securities)
+			return nil
+		},
+		secInfo: sinkWrite(resilience, spoolKindSecInfo, func(produceCtx context.Context, info commands.SecInfo) error {
+			return producer.produce(produceCtx, kafkaTopicSecInfo, []kafkaMessage{{board: producer.board(info.SecCode), secCode: info.SecCode, value: secInfoRecord(info)}})
+		}),
+		close: func() error {
+			producer.client.Close()
+			return resilience.close()
+		},
+	}
+	resilience.replay(openCtx, producer.client.Ping)
+	return out, nil
+}
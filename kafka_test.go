@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestKafkaSinkPublishesKeyedMessagesPerTopic(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1,
+		"transaq.trades", "transaq.quotes", "transaq.candles", "transaq.sec_info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	testCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out, err := openKafkaSink(testCtx, kafkaConfig{Brokers: cluster.ListenAddrs(), TopicPrefix: "transaq.", DeliveryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.trades(testCtx, []commands.AllTrades{{Items: []commands.Trade{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", TradeNo: 10, Time: "14.08.2026 12:00:00", Price: 300},
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.historyCandles(testCtx, historyCandlesEvent{PeriodSeconds: 60, Candles: commands.Candles{
+		Board: "FUT", SecCode: "SiU6", Items: []commands.Candle{{Date: "14.08.2026 12:00:00", Close: 90000}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.securities(testCtx, []commands.Security{{SecCode: "GAZP", Board: "TQBR"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.secInfo(testCtx, commands.SecInfo{SecCode: "GAZP", Isin: "RU0007661625"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics("transaq.trades", "transaq.candles", "transaq.sec_info"),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	received := map[string]*kgo.Record{}
+	for len(received) < 3 {
+		fetches := consumer.PollFetches(testCtx)
+		if err := testCtx.Err(); err != nil {
+			t.Fatalf("received %d topics: %v", len(received), err)
+		}
+		fetches.EachRecord(func(record *kgo.Record) { received[record.Topic] = record })
+	}
+
+	for topic, wantKey := range map[string]string{
+		"transaq.trades":   "TQBR:SBER",
+		"transaq.candles":  "FUT:SiU6",
+		"transaq.sec_info": "TQBR:GAZP",
+	} {
+		if key := string(received[topic].Key); key != wantKey {
+			t.Fatalf("%s key = %q, want %q", topic, key, wantKey)
+		}
+	}
+	var trade tradeRow
+	if err := json.Unmarshal(received["transaq.trades"].Value, &trade); err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeNo != 10 || trade.Price != 300 {
+		t.Fatalf("trade = %+v", trade)
+	}
+}
+
+func TestKafkaErrorsRetriedByProtocolFlag(t *testing.T) {
+	if isRetryableError(kerr.MessageTooLarge) {
+		t.Fatal("message too large is retryable")
+	}
+	if !isRetryableError(kerr.NotLeaderForPartition) {
+		t.Fatal("leader change is not retryable")
+	}
+}
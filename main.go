@@ -5,10 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"slices"
-	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,26 +21,25 @@ var (
 	connect              driver.Conn
 	quotations           = []commands.SubSecurity{}
 	positions            = commands.Positions{}
-	quotationCandles     = make(map[int]commands.Candle)
-	dataCandleCount      = ExportCandleCount
-	dataCandleCountLock  = sync.RWMutex{}
 	isAllTradesPositions = false
 	allTrades            = commands.SubAllTrades{}
 	getSecuritiesInfo    = []int{}
-	exportSecInfoNames   = []string{}
+	historySeries        = []candleSeries{}
+	// settings is the running config. A reload stores a new one, readers in
+	// other goroutines load a snapshot and never change it.
+	settings atomic.Pointer[exporterConfig]
 )
 
 func init() {
+	config := defaultExporterConfig()
+	settings.Store(&config)
 	if lvl, err := log.ParseLevel(os.Getenv(EnvKeyLogLevel)); err == nil {
 		log.SetLevel(lvl)
 	}
 }
 
 func openClickHouse(openCtx context.Context) (driver.Conn, error) {
-	clickhouseUrl := "tcp://127.0.0.1:9000"
-	if chUrl := os.Getenv("CLICKHOUSE_URL"); chUrl != "" {
-		clickhouseUrl = chUrl
-	}
+	clickhouseUrl := settings.Load().ClickHouse.URL
 	clickhouseOptions, err := clickhouse.ParseDSN(clickhouseUrl)
 	if err != nil {
 		return nil, fmt.Errorf("parse ClickHouse DSN: %w", err)
@@ -76,7 +72,12 @@ func openClickHouse(openCtx context.Context) (driver.Conn, error) {
 		return nil, fmt.Errorf("connect to ClickHouse after 10 attempts: %w", pingErr)
 	}
 
-	for _, ddl := range []string{candlesDDL, securitiesDDL, securitiesInfoDDL, tradesDDL, quotesDDL} {
+	for _, ddl := range []string{
+		candlesDDL, candlesMigrationDDL, candleBackfillDDL,
+		securitiesDDL, securitiesInfoDDL, securitiesInfoUpdDDL, tradesDDL, tradeGapsDDL, quotesDDL, quotationsDDL, orderBookSnapshotsDDL, deadLetterDDL,
+		ordersDDL, stopOrdersDDL, myTradesDDL,
+		secPositionsDDL, moneyPositionsDDL, fortsPositionsDDL, unitedLimitsDDL, portfolioDDL,
+	} {
 		if err := conn.Exec(openCtx, ddl); err != nil {
 			_ = conn.Close()
 			return nil, fmt.Errorf("initialize ClickHouse schema: %w", err)
@@ -97,151 +98,25 @@ func waitForClickHouseRetry(waitCtx context.Context, delay time.Duration) error
 }
 
 func updateSecurities(client *tcClient.TCClient) error {
-	isAllTradesPositions = false
-	quotations = quotations[:0]
-	allTrades.Items = allTrades.Items[:0]
-	getSecuritiesInfo = getSecuritiesInfo[:0]
-	exportSecInfoNames = exportSecInfoNames[:0]
+	export := settings.Load().Export
+	selection := selectSecurities(export, client.Data.Securities.Items)
+	controlChanges.apply(&selection, client.Data.Securities.Items)
+	isAllTradesPositions = export.allTradesPositions()
+	quotations = append(quotations[:0], selection.quotations...)
+	allTrades.Items = append(allTrades.Items[:0], selection.allTrades...)
+	getSecuritiesInfo = append(getSecuritiesInfo[:0], selection.secInfo...)
 
-	exportAllTradesSec := []string{}
-	if envAllTrades := os.Getenv("EXPORT_ALL_TRADES"); envAllTrades != "" {
-		for _, sec := range strings.Split(envAllTrades, ",") {
-			if sec == "positions" {
-				isAllTradesPositions = true
-				continue
-			}
-			exportAllTradesSec = append(exportAllTradesSec, sec)
-		}
-	}
-	// Get History data for all sec
-	exportCandleCount := ExportCandleCount
-	if eCandleCount, err := strconv.Atoi(os.Getenv("EXPORT_CANDLE_COUNT")); err == nil && eCandleCount > -2 {
-		exportCandleCount = eCandleCount
-	}
-	exportSecBoards := []string{"TQBR", "TQCB", "FUT"}
-	if eSecBoards := os.Getenv("EXPORT_SEC_BOARDS"); eSecBoards != "" {
-		exportSecBoards = strings.Split(eSecBoards, ",")
-	}
-	exportSecCodes := []string{}
-	if eSecCodes := os.Getenv("EXPORT_SEC_CODES"); eSecCodes != "" {
-		exportSecCodes = strings.Split(eSecCodes, ",")
-	}
-	if names := os.Getenv("EXPORT_SEC_INFO_NAMES"); names != "" {
-		exportSecInfoNames = strings.Split(names, ",")
-	}
-	exportPeriodSeconds := []string{}
-	if ePeriodSeconds := os.Getenv("EXPORT_PERIOD_SECONDS"); ePeriodSeconds != "" {
-		exportPeriodSeconds = strings.Split(ePeriodSeconds, ",")
-	}
-	batchSec, err := connect.PrepareBatch(ctx, ChSecuritiesInsertQuery)
-	if err != nil {
-		return fmt.Errorf("prepare securities batch: %w", err)
-	}
-	// TODO update allTRades if get message
-	// Feb 21 12:01:57 rock-5b transaq_clickhouse_exporter[3732508]: time="2025-02-21T12:01:57+05:00" level=info msg="secInfoUpd {XMLName:{Space: Local:sec_info_upd} SecId:30338 Market:4 SecCode:CR9BC5 MinPrice:0 MaxPrice:0 BuyDeposit:0 Sell
+	exported := make([]commands.Security, 0, len(client.Data.Securities.Items))
 	for _, sec := range client.Data.Securities.Items {
-		exportSecBoardFound := false
-		if slices.Contains(exportSecBoards, sec.Board) {
-			exportSecBoardFound = true
-		}
-		if exportSecBoardFound && slices.Contains(exportAllTradesSec, sec.SecCode) {
-			allTrades.Items = append(allTrades.Items, sec.SecId)
-			//allTrades.Items = append(allTrades.Items, SubSecurity{Board: sec.Board, SecCode: sec.SecCode})
-		}
-		if sec.SecType == "BOND" {
-			for _, secInfoName := range exportSecInfoNames {
-				if strings.HasSuffix(sec.ShortName, secInfoName) {
-					getSecuritiesInfo = append(getSecuritiesInfo, sec.SecId)
-				}
-			}
-		}
-		if sec.SecId == 0 || sec.Active != "true" || len(sec.SecCode) > 16 {
-			continue
-		}
-		log.Debugf("%+v", sec)
-
-		if err := batchSec.Append(uint16(sec.SecId),
-			sec.SecCode,
-			sec.InstrClass,
-			sec.Board,
-			uint8(sec.Market),
-			sec.ShortName,
-			uint8(sec.Decimals),
-			float32(sec.MinStep),
-			uint32(sec.LotSize),
-			uint16(sec.LotDivider),
-			float32(sec.PointCost),
-			sec.SecType,
-			uint8(sec.QuotesType)); err != nil {
-			log.Error(err)
-		}
-		if !exportSecBoardFound {
-			continue
-		}
-		if len(exportSecCodes) == 0 {
-			continue
-		}
-		exportSecCodeFound := false
-		for _, exportSecCode := range exportSecCodes {
-			if exportSecCode == sec.SecCode || strings.Contains(sec.SecCode, exportSecCode) || exportSecCode == sec.ShortName || exportSecCode == "ALL" {
-				exportSecCodeFound = true
-				break
-			}
-		}
-		if !exportSecCodeFound {
-			continue
-		}
-		quotations = append(quotations, commands.SubSecurity{SecId: sec.SecId})
-		for _, kind := range client.Data.CandleKinds.Items {
-			if len(exportPeriodSeconds) > 0 {
-				exportPeriodSecondFound := false
-				for _, exportPeriodSecond := range exportPeriodSeconds {
-					if exportPeriodSecond == strconv.Itoa(kind.Period) {
-						exportPeriodSecondFound = true
-					}
-				}
-				if !exportPeriodSecondFound {
-					continue
-				}
-			}
-			if exportCandleCount == 0 {
-				continue
-			} else if exportCandleCount > 0 {
-				log.Debugf("gethistorydata sec %s period %d name %s seconds %d", sec.SecCode, kind.ID, kind.Name, kind.Period)
-				if err = client.SendCommand(commands.Command{
-					Id:     "gethistorydata",
-					Period: kind.ID,
-					SecId:  sec.SecId,
-					Count:  exportCandleCount,
-					Reset:  "true",
-				}); err != nil {
-					log.Error(err)
-				}
-				// Export All Candles
-			} else {
-				for ExportCandleCount == dataCandleCount {
-					log.Debugf("loop get history %d == %d", ExportCandleCount, dataCandleCount)
-					if err = client.SendCommand(commands.Command{
-						Id:     "gethistorydata",
-						Period: kind.ID,
-						SecId:  sec.SecId,
-						Count:  ExportCandleCount,
-						Reset:  "false",
-					}); err != nil {
-						log.Error(err)
-					}
-					time.Sleep(2 * time.Second)
-				}
-				log.Debugf("exit loop get history %d == %d", ExportCandleCount, dataCandleCount)
-				dataCandleCountLock.Lock()
-				dataCandleCount = ExportCandleCount
-				dataCandleCountLock.Unlock()
-			}
+		if isExportableSecurity(sec) {
+			log.Debugf("%+v", sec)
+			exported = append(exported, sec)
 		}
 	}
-	if batchSec.Rows() > 0 {
-		if err := batchSec.Send(); err != nil {
-			return fmt.Errorf("send securities batch: %w", err)
+	historySeries = selectCandleSeries(export, quotations, client.Data.Securities.Items, client.Data.CandleKinds.Items)
+	if exportSink.securities != nil && len(exported) > 0 {
+		if err := exportSink.securities(ctx, exported); err != nil {
+			return fmt.Errorf("write securities: %w", err)
 		}
 	}
 	return nil
@@ -252,19 +127,53 @@ func main() {
 	defer stop()
 	ctx = runCtx
 
-	var err error
-	connect, err = openClickHouse(runCtx)
+	configPath := os.Getenv(EnvKeyConfigFile)
+	config, err := loadConfig(configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func() { _ = connect.Close() }()
+	settings.Store(&config)
+	// The ClickHouse spool is opened before the sinks, their inserts spool
+	// into it. The other sinks keep their spools in subdirectories.
+	if config.Spool.Dir != "" && config.clickHouseEnabled() {
+		if eventSpool, err = openSpool(config.Spool.Dir, config.Spool.SegmentSizeMB<<20); err != nil {
+			log.Fatal(err)
+		}
+		defer func() { _ = eventSpool.close() }()
+	}
+	if exportSink, err = openSinks(runCtx, config); err != nil {
+		log.Fatal(err)
+	}
+	if eventSpool != nil {
+		go runSpoolReplayer(runCtx, eventSpool, config.Spool.ReplayInterval, "ClickHouse", connect.Ping, clickHouseSpoolReplayHandlers())
+	}
+	go runSystemdWatchdog(runCtx.Done())
 
-	if err := runTransaq(
+	sessionConfig := defaultTransaqSessionConfig()
+	sessionConfig.reloads = watchConfigReloads(runCtx, configPath)
+	if config.HTTP.Listen != "" {
+		go serveHTTP(runCtx, config.HTTP.Listen, newHTTPMux(sessionConfig.eventHandlers.orderBooks))
+	}
+	if config.GRPC.Listen != "" {
+		go serveGRPC(runCtx, config.GRPC.Listen, liveData)
+	}
+
+	runErr := runTransaq(
 		runCtx,
 		tcClient.NewTCClient,
-		defaultTransaqSessionConfig(),
+		sessionConfig,
 		tcClient.DefaultReconnectConfig(),
-	); err != nil {
-		log.Fatal(err)
+	)
+	// Write the batched tail before exiting on SIGTERM.
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), batchFlushTimeout)
+	if err := sessionConfig.eventHandlers.flush(flushCtx); err != nil {
+		log.Errorf("Flush batched events: %v", err)
+	}
+	cancelFlush()
+	if err := exportSink.close(); err != nil {
+		log.Errorf("Close sinks: %v", err)
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
 	}
 }
@@ -0,0 +1,597 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: marketdata.proto
+
+package marketdata
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// SecurityFilter matches the securities of a board with a code, an empty
+// field matches any.
+type SecurityFilter struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Board         string                 `protobuf:"bytes,1,opt,name=board,proto3" json:"board,omitempty"`
+	SecCode       string                 `protobuf:"bytes,2,opt,name=sec_code,json=secCode,proto3" json:"sec_code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SecurityFilter) Reset() {
+	*x = SecurityFilter{}
+	mi := &file_marketdata_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SecurityFilter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SecurityFilter) ProtoMessage() {}
+
+func (x *SecurityFilter) ProtoReflect() protoreflect.Message {
+	mi := &file_marketdata_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SecurityFilter.ProtoReflect.Descriptor instead.
+func (*SecurityFilter) Descriptor() ([]byte, []int) {
+	return file_marketdata_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SecurityFilter) GetBoard() string {
+	if x != nil {
+		return x.Board
+	}
+	return ""
+}
+
+func (x *SecurityFilter) GetSecCode() string {
+	if x != nil {
+		return x.SecCode
+	}
+	return ""
+}
+
+type StreamRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// securities selects what is streamed, all exported securities when empty.
+	Securities    []*SecurityFilter `protobuf:"bytes,1,rep,name=securities,proto3" json:"securities,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamRequest) Reset() {
+	*x = StreamRequest{}
+	mi := &file_marketdata_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamRequest) ProtoMessage() {}
+
+func (x *StreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_marketdata_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamRequest.ProtoReflect.Descriptor instead.
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return file_marketdata_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StreamRequest) GetSecurities() []*SecurityFilter {
+	if x != nil {
+		return x.Securities
+	}
+	return nil
+}
+
+type Trade struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	Secid         int32                  `protobuf:"varint,2,opt,name=secid,proto3" json:"secid,omitempty"`
+	Board         string                 `protobuf:"bytes,3,opt,name=board,proto3" json:"board,omitempty"`
+	SecCode       string                 `protobuf:"bytes,4,opt,name=sec_code,json=secCode,proto3" json:"sec_code,omitempty"`
+	TradeNo       int64                  `protobuf:"varint,5,opt,name=trade_no,json=tradeNo,proto3" json:"trade_no,omitempty"`
+	Price         float64                `protobuf:"fixed64,6,opt,name=price,proto3" json:"price,omitempty"`
+	Quantity      int32                  `protobuf:"varint,7,opt,name=quantity,proto3" json:"quantity,omitempty"`
+	BuySell       string                 `protobuf:"bytes,8,opt,name=buy_sell,json=buySell,proto3" json:"buy_sell,omitempty"`
+	OpenInterest  int32                  `protobuf:"varint,9,opt,name=open_interest,json=openInterest,proto3" json:"open_interest,omitempty"`
+	Period        string                 `protobuf:"bytes,10,opt,name=period,proto3" json:"period,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Trade) Reset() {
+	*x = Trade{}
+	mi := &file_marketdata_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Trade) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Trade) ProtoMessage() {}
+
+func (x *Trade) ProtoReflect() protoreflect.Message {
+	mi := &file_marketdata_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Trade.ProtoReflect.Descriptor instead.
+func (*Trade) Descriptor() ([]byte, []int) {
+	return file_marketdata_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Trade) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Trade) GetSecid() int32 {
+	if x != nil {
+		return x.Secid
+	}
+	return 0
+}
+
+func (x *Trade) GetBoard() string {
+	if x != nil {
+		return x.Board
+	}
+	return ""
+}
+
+func (x *Trade) GetSecCode() string {
+	if x != nil {
+		return x.SecCode
+	}
+	return ""
+}
+
+func (x *Trade) GetTradeNo() int64 {
+	if x != nil {
+		return x.TradeNo
+	}
+	return 0
+}
+
+func (x *Trade) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *Trade) GetQuantity() int32 {
+	if x != nil {
+		return x.Quantity
+	}
+	return 0
+}
+
+func (x *Trade) GetBuySell() string {
+	if x != nil {
+		return x.BuySell
+	}
+	return ""
+}
+
+func (x *Trade) GetOpenInterest() int32 {
+	if x != nil {
+		return x.OpenInterest
+	}
+	return 0
+}
+
+func (x *Trade) GetPeriod() string {
+	if x != nil {
+		return x.Period
+	}
+	return ""
+}
+
+type Quote struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// time is when the exporter received the change.
+	Time          *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	Secid         int32                  `protobuf:"varint,2,opt,name=secid,proto3" json:"secid,omitempty"`
+	Board         string                 `protobuf:"bytes,3,opt,name=board,proto3" json:"board,omitempty"`
+	SecCode       string                 `protobuf:"bytes,4,opt,name=sec_code,json=secCode,proto3" json:"sec_code,omitempty"`
+	Price         float64                `protobuf:"fixed64,5,opt,name=price,proto3" json:"price,omitempty"`
+	Source        string                 `protobuf:"bytes,6,opt,name=source,proto3" json:"source,omitempty"`
+	Yield         int32                  `protobuf:"varint,7,opt,name=yield,proto3" json:"yield,omitempty"`
+	Buy           int32                  `protobuf:"varint,8,opt,name=buy,proto3" json:"buy,omitempty"`
+	Sell          int32                  `protobuf:"varint,9,opt,name=sell,proto3" json:"sell,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Quote) Reset() {
+	*x = Quote{}
+	mi := &file_marketdata_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Quote) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Quote) ProtoMessage() {}
+
+func (x *Quote) ProtoReflect() protoreflect.Message {
+	mi := &file_marketdata_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Quote.ProtoReflect.Descriptor instead.
+func (*Quote) Descriptor() ([]byte, []int) {
+	return file_marketdata_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Quote) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Quote) GetSecid() int32 {
+	if x != nil {
+		return x.Secid
+	}
+	return 0
+}
+
+func (x *Quote) GetBoard() string {
+	if x != nil {
+		return x.Board
+	}
+	return ""
+}
+
+func (x *Quote) GetSecCode() string {
+	if x != nil {
+		return x.SecCode
+	}
+	return ""
+}
+
+func (x *Quote) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+func (x *Quote) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Quote) GetYield() int32 {
+	if x != nil {
+		return x.Yield
+	}
+	return 0
+}
+
+func (x *Quote) GetBuy() int32 {
+	if x != nil {
+		return x.Buy
+	}
+	return 0
+}
+
+func (x *Quote) GetSell() int32 {
+	if x != nil {
+		return x.Sell
+	}
+	return 0
+}
+
+type Candle struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	Board         string                 `protobuf:"bytes,2,opt,name=board,proto3" json:"board,omitempty"`
+	SecCode       string                 `protobuf:"bytes,3,opt,name=sec_code,json=secCode,proto3" json:"sec_code,omitempty"`
+	PeriodSeconds int32                  `protobuf:"varint,4,opt,name=period_seconds,json=periodSeconds,proto3" json:"period_seconds,omitempty"`
+	// source is trades or quotations.
+	Source        string  `protobuf:"bytes,5,opt,name=source,proto3" json:"source,omitempty"`
+	Open          float64 `protobuf:"fixed64,6,opt,name=open,proto3" json:"open,omitempty"`
+	High          float64 `protobuf:"fixed64,7,opt,name=high,proto3" json:"high,omitempty"`
+	Low           float64 `protobuf:"fixed64,8,opt,name=low,proto3" json:"low,omitempty"`
+	Close         float64 `protobuf:"fixed64,9,opt,name=close,proto3" json:"close,omitempty"`
+	Volume        int64   `protobuf:"varint,10,opt,name=volume,proto3" json:"volume,omitempty"`
+	Trades        int32   `protobuf:"varint,11,opt,name=trades,proto3" json:"trades,omitempty"`
+	Vwap          float64 `protobuf:"fixed64,12,opt,name=vwap,proto3" json:"vwap,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Candle) Reset() {
+	*x = Candle{}
+	mi := &file_marketdata_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Candle) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Candle) ProtoMessage() {}
+
+func (x *Candle) ProtoReflect() protoreflect.Message {
+	mi := &file_marketdata_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Candle.ProtoReflect.Descriptor instead.
+func (*Candle) Descriptor() ([]byte, []int) {
+	return file_marketdata_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Candle) GetStart() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Start
+	}
+	return nil
+}
+
+func (x *Candle) GetBoard() string {
+	if x != nil {
+		return x.Board
+	}
+	return ""
+}
+
+func (x *Candle) GetSecCode() string {
+	if x != nil {
+		return x.SecCode
+	}
+	return ""
+}
+
+func (x *Candle) GetPeriodSeconds() int32 {
+	if x != nil {
+		return x.PeriodSeconds
+	}
+	return 0
+}
+
+func (x *Candle) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Candle) GetOpen() float64 {
+	if x != nil {
+		return x.Open
+	}
+	return 0
+}
+
+func (x *Candle) GetHigh() float64 {
+	if x != nil {
+		return x.High
+	}
+	return 0
+}
+
+func (x *Candle) GetLow() float64 {
+	if x != nil {
+		return x.Low
+	}
+	return 0
+}
+
+func (x *Candle) GetClose() float64 {
+	if x != nil {
+		return x.Close
+	}
+	return 0
+}
+
+func (x *Candle) GetVolume() int64 {
+	if x != nil {
+		return x.Volume
+	}
+	return 0
+}
+
+func (x *Candle) GetTrades() int32 {
+	if x != nil {
+		return x.Trades
+	}
+	return 0
+}
+
+func (x *Candle) GetVwap() float64 {
+	if x != nil {
+		return x.Vwap
+	}
+	return 0
+}
+
+var File_marketdata_proto protoreflect.FileDescriptor
+
+const file_marketdata_proto_rawDesc = "" +
+	"\n" +
+	"\x10marketdata.proto\x12\x15transaq.marketdata.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"A\n" +
+	"\x0eSecurityFilter\x12\x14\n" +
+	"\x05board\x18\x01 \x01(\tR\x05board\x12\x19\n" +
+	"\bsec_code\x18\x02 \x01(\tR\asecCode\"V\n" +
+	"\rStreamRequest\x12E\n" +
+	"\n" +
+	"securities\x18\x01 \x03(\v2%.transaq.marketdata.v1.SecurityFilterR\n" +
+	"securities\"\xa3\x02\n" +
+	"\x05Trade\x12.\n" +
+	"\x04time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x14\n" +
+	"\x05secid\x18\x02 \x01(\x05R\x05secid\x12\x14\n" +
+	"\x05board\x18\x03 \x01(\tR\x05board\x12\x19\n" +
+	"\bsec_code\x18\x04 \x01(\tR\asecCode\x12\x19\n" +
+	"\btrade_no\x18\x05 \x01(\x03R\atradeNo\x12\x14\n" +
+	"\x05price\x18\x06 \x01(\x01R\x05price\x12\x1a\n" +
+	"\bquantity\x18\a \x01(\x05R\bquantity\x12\x19\n" +
+	"\bbuy_sell\x18\b \x01(\tR\abuySell\x12#\n" +
+	"\ropen_interest\x18\t \x01(\x05R\fopenInterest\x12\x16\n" +
+	"\x06period\x18\n" +
+	" \x01(\tR\x06period\"\xe8\x01\n" +
+	"\x05Quote\x12.\n" +
+	"\x04time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x14\n" +
+	"\x05secid\x18\x02 \x01(\x05R\x05secid\x12\x14\n" +
+	"\x05board\x18\x03 \x01(\tR\x05board\x12\x19\n" +
+	"\bsec_code\x18\x04 \x01(\tR\asecCode\x12\x14\n" +
+	"\x05price\x18\x05 \x01(\x01R\x05price\x12\x16\n" +
+	"\x06source\x18\x06 \x01(\tR\x06source\x12\x14\n" +
+	"\x05yield\x18\a \x01(\x05R\x05yield\x12\x10\n" +
+	"\x03buy\x18\b \x01(\x05R\x03buy\x12\x12\n" +
+	"\x04sell\x18\t \x01(\x05R\x04sell\"\xbe\x02\n" +
+	"\x06Candle\x120\n" +
+	"\x05start\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x05start\x12\x14\n" +
+	"\x05board\x18\x02 \x01(\tR\x05board\x12\x19\n" +
+	"\bsec_code\x18\x03 \x01(\tR\asecCode\x12%\n" +
+	"\x0eperiod_seconds\x18\x04 \x01(\x05R\rperiodSeconds\x12\x16\n" +
+	"\x06source\x18\x05 \x01(\tR\x06source\x12\x12\n" +
+	"\x04open\x18\x06 \x01(\x01R\x04open\x12\x12\n" +
+	"\x04high\x18\a \x01(\x01R\x04high\x12\x10\n" +
+	"\x03low\x18\b \x01(\x01R\x03low\x12\x14\n" +
+	"\x05close\x18\t \x01(\x01R\x05close\x12\x16\n" +
+	"\x06volume\x18\n" +
+	" \x01(\x03R\x06volume\x12\x16\n" +
+	"\x06trades\x18\v \x01(\x05R\x06trades\x12\x12\n" +
+	"\x04vwap\x18\f \x01(\x01R\x04vwap2\x90\x02\n" +
+	"\n" +
+	"MarketData\x12T\n" +
+	"\fStreamTrades\x12$.transaq.marketdata.v1.StreamRequest\x1a\x1c.transaq.marketdata.v1.Trade0\x01\x12T\n" +
+	"\fStreamQuotes\x12$.transaq.marketdata.v1.StreamRequest\x1a\x1c.transaq.marketdata.v1.Quote0\x01\x12V\n" +
+	"\rStreamCandles\x12$.transaq.marketdata.v1.StreamRequest\x1a\x1d.transaq.marketdata.v1.Candle0\x01B=Z;github.com/kmlebedev/transaq-clickhouse-exporter/marketdatab\x06proto3"
+
+var (
+	file_marketdata_proto_rawDescOnce sync.Once
+	file_marketdata_proto_rawDescData []byte
+)
+
+func file_marketdata_proto_rawDescGZIP() []byte {
+	file_marketdata_proto_rawDescOnce.Do(func() {
+		file_marketdata_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_marketdata_proto_rawDesc), len(file_marketdata_proto_rawDesc)))
+	})
+	return file_marketdata_proto_rawDescData
+}
+
+var file_marketdata_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_marketdata_proto_goTypes = []any{
+	(*SecurityFilter)(nil),        // 0: transaq.marketdata.v1.SecurityFilter
+	(*StreamRequest)(nil),         // 1: transaq.marketdata.v1.StreamRequest
+	(*Trade)(nil),                 // 2: transaq.marketdata.v1.Trade
+	(*Quote)(nil),                 // 3: transaq.marketdata.v1.Quote
+	(*Candle)(nil),                // 4: transaq.marketdata.v1.Candle
+	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+}
+var file_marketdata_proto_depIdxs = []int32{
+	0, // 0: transaq.marketdata.v1.StreamRequest.securities:type_name -> transaq.marketdata.v1.SecurityFilter
+	5, // 1: transaq.marketdata.v1.Trade.time:type_name -> google.protobuf.Timestamp
+	5, // 2: transaq.marketdata.v1.Quote.time:type_name -> google.protobuf.Timestamp
+	5, // 3: transaq.marketdata.v1.Candle.start:type_name -> google.protobuf.Timestamp
+	1, // 4: transaq.marketdata.v1.MarketData.StreamTrades:input_type -> transaq.marketdata.v1.StreamRequest
+	1, // 5: transaq.marketdata.v1.MarketData.StreamQuotes:input_type -> transaq.marketdata.v1.StreamRequest
+	1, // 6: transaq.marketdata.v1.MarketData.StreamCandles:input_type -> transaq.marketdata.v1.StreamRequest
+	2, // 7: transaq.marketdata.v1.MarketData.StreamTrades:output_type -> transaq.marketdata.v1.Trade
+	3, // 8: transaq.marketdata.v1.MarketData.StreamQuotes:output_type -> transaq.marketdata.v1.Quote
+	4, // 9: transaq.marketdata.v1.MarketData.StreamCandles:output_type -> transaq.marketdata.v1.Candle
+	7, // [7:10] is the sub-list for method output_type
+	4, // [4:7] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_marketdata_proto_init() }
+func file_marketdata_proto_init() {
+	if File_marketdata_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_marketdata_proto_rawDesc), len(file_marketdata_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_marketdata_proto_goTypes,
+		DependencyIndexes: file_marketdata_proto_depIdxs,
+		MessageInfos:      file_marketdata_proto_msgTypes,
+	}.Build()
+	File_marketdata_proto = out.File
+	file_marketdata_proto_goTypes = nil
+	file_marketdata_proto_depIdxs = nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace    = "transaq_exporter"
+	httpShutdownTimeout = 5 * time.Second
+)
+
+var (
+	eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "TRANSAQ events received per channel.",
+	}, []string{"channel"})
+	rowsInserted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_inserted_total",
+		Help:      "Rows inserted into ClickHouse per table.",
+	}, []string{"table"})
+	insertFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "insert_failures_total",
+		Help:      "Failed ClickHouse batch inserts per table.",
+	}, []string{"table"})
+	insertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "insert_duration_seconds",
+		Help:      "ClickHouse batch insert latency per table.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"table"})
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Events waiting in the in-memory queue of a TRANSAQ event worker.",
+	}, []string{"queue"})
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconnects_total",
+		Help:      "TRANSAQ sessions started after the first one.",
+	})
+	lastTradeTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_trade_timestamp_seconds",
+		Help:      "Exchange time of the last trade seen per security.",
+	}, []string{"board", "sec_code"})
+	tradeGaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trade_gaps_total",
+		Help:      "Suspected gaps in the all trades stream per reason.",
+	}, []string{"reason"})
+	tradesOutOfOrder = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trades_out_of_order_total",
+		Help:      "Trades not newer than the last trade_no seen for their security.",
+	})
+	candleBackfillComplete = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "candle_backfill_complete",
+		Help:      "1 once the full history backfill of a candle series reached its start.",
+	}, []string{"sec_code", "period_seconds"})
+	candleGapsMissing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "candle_gaps_missing",
+		Help:      "History candle bars still missing in trading sessions after the last gap repair.",
+	}, []string{"sec_code", "period_seconds"})
+	grpcSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_subscribers",
+		Help:      "Open gRPC market data streams per stream.",
+	}, []string{"stream"})
+	grpcSlowSubscribers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_slow_subscribers_total",
+		Help:      "gRPC subscribers disconnected for falling behind per stream.",
+	}, []string{"stream"})
+	websocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_clients",
+		Help:      "Connected WebSocket dashboard clients.",
+	})
+	websocketSlowClients = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_slow_clients_total",
+		Help:      "WebSocket clients disconnected for falling behind.",
+	})
+)
+
+// observeInsert records the outcome of one ClickHouse batch insert.
+func observeInsert(table string, rows int, started time.Time, err error) {
+	insertDuration.WithLabelValues(table).Observe(time.Since(started).Seconds())
+	if err != nil {
+		insertFailures.WithLabelValues(table).Inc()
+		return
+	}
+	rowsInserted.WithLabelValues(table).Add(float64(rows))
+}
+
+func newHTTPMux(orderBookSet *orderBooks) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	mux.HandleFunc("POST /orderbook/snapshot", handleOrderBookSnapshot(orderBookSet))
+	mux.HandleFunc("GET /ws", handleWebSocket)
+	if control := settings.Load().Control; control.Enabled {
+		handleControlRoutes(mux, control)
+	}
+	return mux
+}
+
+// serveHTTP runs the exporter's HTTP endpoints until serveCtx is done.
+func serveHTTP(serveCtx context.Context, listen string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Shutdown leaves hijacked WebSocket connections open, their handlers
+		// end with serveCtx.
+		BaseContext: func(net.Listener) context.Context { return serveCtx },
+	}
+	go func() {
+		<-serveCtx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	log.Infof("Serve HTTP on %s", listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("HTTP server: %v", err)
+	}
+}
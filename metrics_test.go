@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveInsertCountsRowsAndFailures(t *testing.T) {
+	rowsBefore := testutil.ToFloat64(rowsInserted.WithLabelValues("transaq_test"))
+	failuresBefore := testutil.ToFloat64(insertFailures.WithLabelValues("transaq_test"))
+
+	observeInsert("transaq_test", 3, time.Now(), nil)
+	observeInsert("transaq_test", 5, time.Now(), errors.New("clickhouse is down"))
+
+	if rows := testutil.ToFloat64(rowsInserted.WithLabelValues("transaq_test")) - rowsBefore; rows != 3 {
+		t.Fatalf("rows inserted = %v, want 3", rows)
+	}
+	if failures := testutil.ToFloat64(insertFailures.WithLabelValues("transaq_test")) - failuresBefore; failures != 1 {
+		t.Fatalf("insert failures = %v, want 1", failures)
+	}
+
+	recorder := httptest.NewRecorder()
+	newHTTPMux(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `transaq_exporter_rows_inserted_total{table="transaq_test"}`) {
+		t.Fatalf("/metrics does not expose inserted rows:\n%s", recorder.Body.String())
+	}
+}
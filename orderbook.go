@@ -0,0 +1,299 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// quoteRemoved in buy or sell of a quote removes that side of the level.
+const quoteRemoved = -1
+
+type orderBookConfig struct {
+	// Interval between snapshots of the order books that changed, 0 disables
+	// the timer. The books are kept anyway for the WebSocket best feed and
+	// the snapshots on request.
+	Interval time.Duration `yaml:"interval"`
+	// Depth is the number of levels per side in a snapshot.
+	Depth int `yaml:"depth"`
+}
+
+// orderBook is the depth of market of one security, volumes by price.
+type orderBook struct {
+	secId   int
+	board   string
+	secCode string
+	bids    map[float64]int
+	asks    map[float64]int
+}
+
+type orderBookLevel struct {
+	Price  float64
+	Volume int
+}
+
+// orderBookSnapshot is the top of an order book at one moment.
+type orderBookSnapshot struct {
+	Time    time.Time
+	SecId   int
+	Board   string
+	SecCode string
+	Bids    []orderBookLevel
+	Asks    []orderBookLevel
+}
+
+func (snapshot orderBookSnapshot) bestBid() float64 {
+	if len(snapshot.Bids) == 0 {
+		return 0
+	}
+	return snapshot.Bids[0].Price
+}
+
+func (snapshot orderBookSnapshot) bestAsk() float64 {
+	if len(snapshot.Asks) == 0 {
+		return 0
+	}
+	return snapshot.Asks[0].Price
+}
+
+func (snapshot orderBookSnapshot) spread() float64 {
+	if len(snapshot.Bids) == 0 || len(snapshot.Asks) == 0 {
+		return 0
+	}
+	return snapshot.bestAsk() - snapshot.bestBid()
+}
+
+// imbalance is (bid volume - ask volume) / (bid volume + ask volume) over
+// the levels of the snapshot, from -1 (only asks) to 1 (only bids).
+func (snapshot orderBookSnapshot) imbalance() float64 {
+	bidVolume, askVolume := 0, 0
+	for _, level := range snapshot.Bids {
+		bidVolume += level.Volume
+	}
+	for _, level := range snapshot.Asks {
+		askVolume += level.Volume
+	}
+	if bidVolume+askVolume == 0 {
+		return 0
+	}
+	return float64(bidVolume-askVolume) / float64(bidVolume+askVolume)
+}
+
+func topLevels(levels map[float64]int, depth int, better func(a, b float64) int) []orderBookLevel {
+	prices := slices.SortedFunc(maps.Keys(levels), better)
+	top := make([]orderBookLevel, 0, min(depth, len(prices)))
+	for _, price := range prices[:min(depth, len(prices))] {
+		top = append(top, orderBookLevel{Price: price, Volume: levels[price]})
+	}
+	return top
+}
+
+func (book *orderBook) snapshot(at time.Time, depth int) orderBookSnapshot {
+	return orderBookSnapshot{
+		Time:    at,
+		SecId:   book.secId,
+		Board:   book.board,
+		SecCode: book.secCode,
+		Bids:    topLevels(book.bids, depth, func(a, b float64) int { return cmp.Compare(b, a) }),
+		Asks:    topLevels(book.asks, depth, cmp.Compare[float64]),
+	}
+}
+
+// orderBooks rebuilds the order books from quotes deltas and writes top
+// snapshots of the changed ones every config.Interval.
+type orderBooks struct {
+	config orderBookConfig
+	write  func(context.Context, []orderBookSnapshot) error
+	now    func() time.Time
+
+	lock    sync.Mutex
+	books   map[string]*orderBook
+	changed map[string]bool
+	timer   *time.Timer
+	// closed stops the timer snapshots, writing tracks the one in progress.
+	closed  bool
+	writing sync.WaitGroup
+}
+
+func newOrderBooks(config orderBookConfig, write func(context.Context, []orderBookSnapshot) error) *orderBooks {
+	return &orderBooks{config: config, write: write, now: time.Now, books: map[string]*orderBook{}, changed: map[string]bool{}}
+}
+
+// apply merges a quotes message. A quote sets the bid or ask volume at its
+// price, quoteRemoved deletes that side of the level.
+func (set *orderBooks) apply(quotes commands.Quotes) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	for _, quote := range quotes.Items {
+		key := quote.Board + ":" + quote.SecCode
+		book := set.books[key]
+		if book == nil {
+			book = &orderBook{secId: quote.SecId, board: quote.Board, secCode: quote.SecCode, bids: map[float64]int{}, asks: map[float64]int{}}
+			set.books[key] = book
+		}
+		applyQuoteSide(book.bids, quote.Price, quote.Buy)
+		applyQuoteSide(book.asks, quote.Price, quote.Sell)
+		if set.config.Interval > 0 {
+			set.changed[key] = true
+		}
+	}
+	if set.timer == nil && !set.closed && len(set.changed) > 0 {
+		set.timer = time.AfterFunc(set.config.Interval, set.snapshotOnTimer)
+	}
+}
+
+func applyQuoteSide(levels map[float64]int, price float64, volume int) {
+	switch {
+	case volume == quoteRemoved:
+		delete(levels, price)
+	case volume > 0:
+		levels[price] = volume
+	}
+}
+
+// tops returns the best bid and ask of the order books a quotes message
+// changed.
+func (set *orderBooks) tops(quotes commands.Quotes) []orderBookSnapshot {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	now := set.now()
+	var tops []orderBookSnapshot
+	seen := map[string]bool{}
+	for _, quote := range quotes.Items {
+		key := quote.Board + ":" + quote.SecCode
+		if book := set.books[key]; book != nil && !seen[key] {
+			seen[key] = true
+			tops = append(tops, book.snapshot(now, 1))
+		}
+	}
+	return tops
+}
+
+// snapshots returns the top of the changed order books, or of all of them.
+func (set *orderBooks) snapshots(all bool) []orderBookSnapshot {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	now := set.now()
+	var snapshots []orderBookSnapshot
+	for key, book := range set.books {
+		if all || set.changed[key] {
+			snapshots = append(snapshots, book.snapshot(now, set.config.Depth))
+		}
+	}
+	clear(set.changed)
+	return snapshots
+}
+
+func (set *orderBooks) snapshotOnTimer() {
+	set.lock.Lock()
+	set.timer = nil
+	if set.closed {
+		set.lock.Unlock()
+		return
+	}
+	set.writing.Add(1)
+	set.lock.Unlock()
+	defer set.writing.Done()
+	if err := set.flush(context.Background(), false); err != nil {
+		log.Errorf("Write order book snapshots: %v", err)
+	}
+}
+
+// flush writes the snapshots of the changed order books, or of all of them.
+func (set *orderBooks) flush(flushCtx context.Context, all bool) error {
+	snapshots := set.snapshots(all)
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return set.write(flushCtx, snapshots)
+}
+
+// close stops the timer snapshots and writes the changed order books. No
+// snapshot is written after it returned.
+func (set *orderBooks) close(closeCtx context.Context) error {
+	set.lock.Lock()
+	set.closed = true
+	if set.timer != nil {
+		set.timer.Stop()
+		set.timer = nil
+	}
+	set.lock.Unlock()
+	set.writing.Wait()
+	return set.flush(closeCtx, false)
+}
+
+// reset forgets the order books, after a disconnect TRANSAQ sends them anew.
+func (set *orderBooks) reset() {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	clear(set.books)
+	clear(set.changed)
+}
+
+// handleOrderBookSnapshot writes snapshots of all order books of set right
+// away.
+func handleOrderBookSnapshot(set *orderBooks) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if set == nil {
+			http.Error(writer, "order books are disabled", http.StatusNotFound)
+			return
+		}
+		if err := set.flush(request.Context(), true); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func insertOrderBookSnapshots(insertCtx context.Context, snapshots []orderBookSnapshot) (err error) {
+	started := time.Now()
+	defer func() { observeInsert("transaq_orderbook_snapshots", len(snapshots), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChOrderBookSnapshotsInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare order book snapshots batch: %w", err)
+	}
+	defer batch.Close()
+	for _, snapshot := range snapshots {
+		bidPrices, bidVolumes := levelColumns(snapshot.Bids)
+		askPrices, askVolumes := levelColumns(snapshot.Asks)
+		if err := batch.Append(
+			snapshot.Time,
+			uint16(snapshot.SecId),
+			snapshot.Board,
+			snapshot.SecCode,
+			bidPrices,
+			bidVolumes,
+			askPrices,
+			askVolumes,
+			snapshot.bestBid(),
+			snapshot.bestAsk(),
+			snapshot.spread(),
+			snapshot.imbalance(),
+		); err != nil {
+			return fmt.Errorf("append %s order book snapshot: %w", snapshot.SecCode, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send order book snapshots batch: %w", err)
+	}
+	return nil
+}
+
+func levelColumns(levels []orderBookLevel) ([]float64, []int64) {
+	prices := make([]float64, 0, len(levels))
+	volumes := make([]int64, 0, len(levels))
+	for _, level := range levels {
+		prices = append(prices, level.Price)
+		volumes = append(volumes, int64(level.Volume))
+	}
+	return prices, volumes
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestOrderBooksRebuildTopFromQuotesDeltas(t *testing.T) {
+	var written []orderBookSnapshot
+	set := newOrderBooks(orderBookConfig{Interval: time.Hour, Depth: 2}, func(_ context.Context, snapshots []orderBookSnapshot) error {
+		written = append(written, snapshots...)
+		return nil
+	})
+	defer set.reset()
+	quote := func(price float64, buy, sell int) commands.Quote {
+		return commands.Quote{SecId: 1, Board: "TQBR", SecCode: "SBER", Price: price, Buy: buy, Sell: sell}
+	}
+	set.apply(commands.Quotes{Items: []commands.Quote{
+		quote(99, 10, 0), quote(98, 20, 0), quote(97, 30, 0),
+		quote(101, 0, 5), quote(102, 0, 15),
+	}})
+	set.apply(commands.Quotes{Items: []commands.Quote{
+		quote(99, quoteRemoved, 0), // best bid left
+		quote(100, 0, 7),           // new best ask
+	}})
+
+	if err := set.flush(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("snapshots = %+v", written)
+	}
+	snapshot := written[0]
+	if len(snapshot.Bids) != 2 || snapshot.Bids[0] != (orderBookLevel{Price: 98, Volume: 20}) || snapshot.Bids[1].Price != 97 {
+		t.Fatalf("bids = %+v", snapshot.Bids)
+	}
+	if len(snapshot.Asks) != 2 || snapshot.Asks[0] != (orderBookLevel{Price: 100, Volume: 7}) || snapshot.Asks[1].Price != 101 {
+		t.Fatalf("asks = %+v", snapshot.Asks)
+	}
+	if snapshot.spread() != 2 || snapshot.imbalance() != float64(50-12)/float64(50+12) {
+		t.Fatalf("spread = %v, imbalance = %v", snapshot.spread(), snapshot.imbalance())
+	}
+
+	// Unchanged books are only written on request.
+	written = nil
+	if err := set.flush(context.Background(), false); err != nil || len(written) != 0 {
+		t.Fatalf("unchanged flush = %+v, %v", written, err)
+	}
+	recorder := httptest.NewRecorder()
+	handleOrderBookSnapshot(set)(recorder, httptest.NewRequest(http.MethodPost, "/orderbook/snapshot", nil))
+	if recorder.Code != http.StatusNoContent || len(written) != 1 {
+		t.Fatalf("snapshot on request: status %d, snapshots %+v", recorder.Code, written)
+	}
+}
+
+func TestOrderBooksKeepTopsWithoutSnapshots(t *testing.T) {
+	var written []orderBookSnapshot
+	set := newOrderBooks(orderBookConfig{Interval: 0, Depth: 2}, func(_ context.Context, snapshots []orderBookSnapshot) error {
+		written = append(written, snapshots...)
+		return nil
+	})
+	quotes := commands.Quotes{Items: []commands.Quote{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Price: 99, Buy: 10},
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Price: 101, Sell: 5},
+	}}
+	set.apply(quotes)
+
+	tops := set.tops(quotes)
+	if len(tops) != 1 || tops[0].Bids[0] != (orderBookLevel{Price: 99, Volume: 10}) || tops[0].Asks[0] != (orderBookLevel{Price: 101, Volume: 5}) {
+		t.Fatalf("tops = %+v", tops)
+	}
+	// The interval only controls the timer, snapshots on request still work.
+	recorder := httptest.NewRecorder()
+	handleOrderBookSnapshot(set)(recorder, httptest.NewRequest(http.MethodPost, "/orderbook/snapshot", nil))
+	if recorder.Code != http.StatusNoContent || len(written) != 1 {
+		t.Fatalf("snapshot on request: status %d, snapshots %+v", recorder.Code, written)
+	}
+	if err := set.close(context.Background()); err != nil || len(written) != 1 {
+		t.Fatalf("snapshots with interval 0 = %+v, %v", written, err)
+	}
+}
+
+func TestOrderBooksWriteNoTimerSnapshotAfterClose(t *testing.T) {
+	var written []orderBookSnapshot
+	set := newOrderBooks(orderBookConfig{Interval: 10 * time.Millisecond, Depth: 1}, func(_ context.Context, snapshots []orderBookSnapshot) error {
+		written = append(written, snapshots...)
+		return nil
+	})
+	set.apply(commands.Quotes{Items: []commands.Quote{{SecId: 1, Board: "TQBR", SecCode: "SBER", Price: 99, Buy: 10}}})
+	if err := set.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("snapshots on close = %+v", written)
+	}
+	set.apply(commands.Quotes{Items: []commands.Quote{{SecId: 1, Board: "TQBR", SecCode: "SBER", Price: 98, Buy: 10}}})
+	time.Sleep(50 * time.Millisecond)
+	if len(written) != 1 {
+		t.Fatalf("snapshots after close = %+v", written)
+	}
+}
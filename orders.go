@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+// ordersEvent is an orders message stamped with the time the exporter got
+// it. TRANSAQ resends the whole order on every status change, the receive
+// time orders those transitions in transaq_orders.
+type ordersEvent struct {
+	Received time.Time
+	Orders   commands.Orders
+}
+
+func parseTableTime(value string) string {
+	parsed, _ := time.Parse(tradeTimeLayout, value)
+	return parsed.Format(tableTimeLayout)
+}
+
+func insertOrders(insertCtx context.Context, event ordersEvent) error {
+	return errors.Join(
+		insertOrderRows(insertCtx, event.Received, event.Orders.Items),
+		insertStopOrderRows(insertCtx, event.Received, event.Orders.StopOrders),
+	)
+}
+
+func insertOrderRows(insertCtx context.Context, received time.Time, orders []commands.Order) (err error) {
+	if len(orders) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_orders", len(orders), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChOrdersInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare orders batch: %w", err)
+	}
+	defer batch.Close()
+	for _, order := range orders {
+		if err := batch.Append(
+			received,
+			uint64(order.TransactionId),
+			int64(order.OrderNo),
+			uint16(order.SecId),
+			order.Board,
+			order.SecCode,
+			order.Client,
+			order.Union,
+			order.Status,
+			order.BuySell,
+			parseTableTime(order.Time),
+			parseTableTime(order.WithdrawTime),
+			float64(order.Price),
+			uint32(order.Quantity),
+			uint32(order.Balance),
+			float64(order.Value),
+			order.Result,
+		); err != nil {
+			return fmt.Errorf("append order %d: %w", order.TransactionId, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send orders batch: %w", err)
+	}
+	return nil
+}
+
+func insertStopOrderRows(insertCtx context.Context, received time.Time, stopOrders []commands.StopOrder) (err error) {
+	if len(stopOrders) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_stoporders", len(stopOrders), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChStopOrdersInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare stop orders batch: %w", err)
+	}
+	defer batch.Close()
+	for _, stopOrder := range stopOrders {
+		if err := batch.Append(
+			received,
+			uint64(stopOrder.TransactionId),
+			int64(stopOrder.ActiveOrderNo),
+			uint16(stopOrder.SecId),
+			stopOrder.Board,
+			stopOrder.SecCode,
+			stopOrder.Client,
+			stopOrder.Union,
+			stopOrder.Status,
+			stopOrder.BuySell,
+			stopOrder.Canceller,
+			int64(stopOrder.AllTradeNo),
+			stopOrder.ValidBefore,
+			stopOrder.Author,
+			parseTableTime(stopOrder.AcceptTime),
+			int64(stopOrder.LinkedOrderNo),
+			parseTableTime(stopOrder.ExpDate),
+			stopOrder.Result,
+		); err != nil {
+			return fmt.Errorf("append stop order %d: %w", stopOrder.TransactionId, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send stop orders batch: %w", err)
+	}
+	return nil
+}
+
+func insertMyTrades(insertCtx context.Context, trades commands.ClientTrades) (err error) {
+	if len(trades.Items) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_my_trades", len(trades.Items), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChMyTradesInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare my trades batch: %w", err)
+	}
+	defer batch.Close()
+	for _, trade := range trades.Items {
+		if err := batch.Append(
+			parseTableTime(trade.Time),
+			int64(trade.TradeNo),
+			int64(trade.OrderNo),
+			uint16(trade.SecId),
+			trade.Board,
+			trade.SecCode,
+			trade.Client,
+			trade.Union,
+			trade.BuySell,
+			float64(trade.Price),
+			uint32(trade.Quantity),
+			float64(trade.Value),
+			float64(trade.Comission),
+			float64(trade.Yield),
+			float64(trade.AccruedInt),
+			trade.TradeType,
+			trade.SettleCode,
+			trade.BrokerRef,
+			int64(trade.CurrentPos),
+		); err != nil {
+			return fmt.Errorf("append my trade %d: %w", trade.TradeNo, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send my trades batch: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	"github.com/parquet-go/parquet-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// parquetPendingSuffix marks a file still being written, it has no footer
+	// and cannot be read yet.
+	parquetPendingSuffix = ".tmp"
+	// parquetRowGroupRows bounds the rows a writer buffers in memory before it
+	// writes them out as a row group.
+	parquetRowGroupRows = 64 * 1024
+)
+
+type parquetConfig struct {
+	// Dir holds the trades and candles tables.
+	Dir string `yaml:"dir"`
+	// RollInterval finishes a file that is open this long and starts the next
+	// part, a crash loses at most this much of a partition.
+	RollInterval time.Duration `yaml:"roll_interval"`
+}
+
+type parquetPartitionKey struct {
+	date    string
+	secCode string
+}
+
+type parquetPartition[T any] struct {
+	date   string
+	opened time.Time
+	path   string
+	file   *os.File
+	writer *parquet.GenericWriter[T]
+}
+
+func (partition *parquetPartition[T]) close() error {
+	if err := partition.writer.Close(); err != nil {
+		_ = partition.file.Close()
+		return err
+	}
+	if err := partition.file.Sync(); err != nil {
+		_ = partition.file.Close()
+		return err
+	}
+	if err := partition.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partition.path+parquetPendingSuffix, partition.path)
+}
+
+// parquetTable streams the rows of a table into a file per Moscow date and
+// security, <dir>/<table>/date=YYYY-MM-DD/sec_code=XXX/part-<n>.parquet. The
+// files are finished after rollInterval, once their day is over and on
+// shutdown, files of past days right after their rows are written. A row
+// arriving for a finished file starts the next part.
+type parquetTable[T any] struct {
+	dir          string
+	name         string
+	partition    func(T) (time.Time, string)
+	rollInterval time.Duration
+	now          func() time.Time
+
+	lock       sync.Mutex
+	partitions map[parquetPartitionKey]*parquetPartition[T]
+	timer      *time.Timer
+}
+
+func newParquetTable[T any](dir, name string, rollInterval time.Duration, partition func(T) (time.Time, string)) *parquetTable[T] {
+	return &parquetTable[T]{
+		dir:          filepath.Join(dir, name),
+		name:         name,
+		partition:    partition,
+		rollInterval: rollInterval,
+		now:          time.Now,
+		partitions:   map[parquetPartitionKey]*parquetPartition[T]{},
+	}
+}
+
+func (table *parquetTable[T]) write(rows []T) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert(table.name+".parquet", len(rows), started, err) }()
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	var keys []parquetPartitionKey
+	grouped := map[parquetPartitionKey][]T{}
+	for _, row := range rows {
+		date, secCode := table.partition(row)
+		key := parquetPartitionKey{date: date.In(moscowLocation).Format(time.DateOnly), secCode: secCode}
+		if _, ok := grouped[key]; !ok {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], row)
+	}
+	// A page of history candles spans many past days. Their files are
+	// finished right after their rows, only today's stay open.
+	today := table.now().In(moscowLocation).Format(time.DateOnly)
+	var errs []error
+	for _, key := range keys {
+		partition, err := table.openLocked(key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := partition.writer.Write(grouped[key]); err != nil {
+			errs = append(errs, fmt.Errorf("write %s: %w", partition.path, err))
+		}
+		if key.date < today {
+			if err := partition.close(); err != nil {
+				errs = append(errs, fmt.Errorf("finish %s: %w", partition.path, err))
+			}
+			delete(table.partitions, key)
+		}
+	}
+	errs = append(errs, table.finishLocked(false))
+	if table.timer == nil && len(table.partitions) > 0 {
+		table.timer = time.AfterFunc(table.untilNextFinish(), table.finishOnTimer)
+	}
+	return errors.Join(errs...)
+}
+
+func (table *parquetTable[T]) openLocked(key parquetPartitionKey) (*parquetPartition[T], error) {
+	if partition := table.partitions[key]; partition != nil {
+		return partition, nil
+	}
+	dir := filepath.Join(table.dir, "date="+key.date, "sec_code="+strings.ReplaceAll(key.secCode, string(filepath.Separator), "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %s partition: %w", table.name, err)
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "part-*.parquet*"))
+	if err != nil {
+		return nil, err
+	}
+	next := 1
+	for _, path := range existing {
+		number, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(path), "part-"), ".")
+		if part, err := strconv.Atoi(number); err == nil && part >= next {
+			next = part + 1
+		}
+	}
+	path := filepath.Join(dir, fmt.Sprintf("part-%d.parquet", next))
+	file, err := os.OpenFile(path+parquetPendingSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s partition file: %w", table.name, err)
+	}
+	partition := &parquetPartition[T]{
+		date:   key.date,
+		opened: table.now(),
+		path:   path,
+		file:   file,
+		writer: parquet.NewGenericWriter[T](file, parquet.Compression(&parquet.Zstd), parquet.MaxRowsPerRowGroup(parquetRowGroupRows)),
+	}
+	table.partitions[key] = partition
+	return partition, nil
+}
+
+// finishLocked finishes the files of the days before today and the files
+// open for rollInterval, or all of them.
+func (table *parquetTable[T]) finishLocked(all bool) error {
+	now := table.now()
+	today := now.In(moscowLocation).Format(time.DateOnly)
+	var errs []error
+	for key, partition := range table.partitions {
+		rolled := table.rollInterval > 0 && now.Sub(partition.opened) >= table.rollInterval
+		if !all && !rolled && partition.date >= today {
+			continue
+		}
+		if err := partition.close(); err != nil {
+			errs = append(errs, fmt.Errorf("finish %s: %w", partition.path, err))
+		}
+		delete(table.partitions, key)
+	}
+	return errors.Join(errs...)
+}
+
+func (table *parquetTable[T]) finishOnTimer() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.timer = nil
+	if err := table.finishLocked(false); err != nil {
+		log.Errorf("Finish %s parquet files: %v", table.name, err)
+	}
+	if len(table.partitions) > 0 {
+		table.timer = time.AfterFunc(table.untilNextFinish(), table.finishOnTimer)
+	}
+}
+
+// untilNextFinish is the time left until the next day or the roll of the
+// oldest open file.
+func (table *parquetTable[T]) untilNextFinish() time.Duration {
+	now := table.now()
+	next := untilNextMoscowDay(now)
+	if table.rollInterval > 0 {
+		for _, partition := range table.partitions {
+			next = min(next, max(partition.opened.Add(table.rollInterval).Sub(now), 0))
+		}
+	}
+	return next
+}
+
+func (table *parquetTable[T]) close() error {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.timer != nil {
+		table.timer.Stop()
+		table.timer = nil
+	}
+	return table.finishLocked(true)
+}
+
+// untilNextMoscowDay is the time left until shortly after midnight in Moscow.
+func untilNextMoscowDay(now time.Time) time.Duration {
+	now = now.In(moscowLocation)
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, moscowLocation)
+	return midnight.Sub(now) + time.Minute
+}
+
+// removePendingParquet deletes the unfinished files a crash left behind,
+// they have no footer and cannot be read.
+func removePendingParquet(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(path, parquetPendingSuffix) {
+			log.Warnf("Remove unfinished parquet file %s", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// openParquetSink writes trades and candles to Parquet files under
+// config.Dir with the columns of transaq_trades and transaq_candles.
+func openParquetSink(config parquetConfig) (sink, error) {
+	if err := removePendingParquet(config.Dir); err != nil {
+		return sink{}, fmt.Errorf("clean parquet directory: %w", err)
+	}
+	trades := newParquetTable(config.Dir, "trades", config.RollInterval, func(row tradeRow) (time.Time, string) {
+		return row.Time, row.SecCode
+	})
+	candles := newParquetTable(config.Dir, "candles", config.RollInterval, func(row candleRow) (time.Time, string) {
+		return row.Date, row.SecCode
+	})
+	return sink{
+		name: sinkParquet,
+		trades: func(_ context.Context, batch []commands.AllTrades) error {
+			return trades.write(tradeRecords(batch))
+		},
+		candles: func(_ context.Context, batch [][]aggregatedCandle) error {
+			return candles.write(candleRecords(batch))
+		},
+		historyCandles: func(_ context.Context, event historyCandlesEvent) error {
+			return candles.write(historyCandleRecords(event))
+		},
+		close: func() error {
+			return errors.Join(trades.close(), candles.close())
+		},
+	}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetTableFinishesPartitionsOfPastDays(t *testing.T) {
+	dir := t.TempDir()
+	table := newParquetTable(dir, "trades", 0, func(row tradeRow) (time.Time, string) { return row.Time, row.SecCode })
+	now := time.Date(2026, 8, 14, 23, 0, 0, 0, moscowLocation)
+	table.now = func() time.Time { return now }
+	trade := func(secCode string, tradeNo int64, at string) commands.Trade {
+		return commands.Trade{SecId: 1, Board: "TQBR", SecCode: secCode, TradeNo: tradeNo, Time: at, Price: 100, Quantity: 1, BuySell: "B"}
+	}
+
+	if err := table.write(tradeRecords([]commands.AllTrades{{Items: []commands.Trade{
+		trade("SBER", 1, "14.08.2026 22:59:58"),
+		trade("GAZP", 2, "14.08.2026 22:59:59"),
+		trade("SBER", 3, "14.08.2026 23:00:00"),
+	}}})); err != nil {
+		t.Fatal(err)
+	}
+	sberDay := filepath.Join(dir, "trades", "date=2026-08-14", "sec_code=SBER")
+	if _, err := os.Stat(filepath.Join(sberDay, "part-1.parquet"+parquetPendingSuffix)); err != nil {
+		t.Fatalf("open partition: %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := table.write(tradeRecords([]commands.AllTrades{{Items: []commands.Trade{
+		trade("SBER", 4, "15.08.2026 10:00:00"),
+	}}})); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.ReadFile[tradeRow](filepath.Join(sberDay, "part-1.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].TradeNo != 1 || rows[1].TradeNo != 3 || rows[1].BuySell != "B" ||
+		!rows[1].Time.Equal(time.Date(2026, 8, 14, 23, 0, 0, 0, moscowLocation)) {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "trades", "date=2026-08-14", "sec_code=GAZP", "part-1.parquet")); err != nil {
+		t.Fatalf("finished GAZP partition: %v", err)
+	}
+
+	// A late row for a finished day goes to the next part.
+	if err := table.write(tradeRecords([]commands.AllTrades{{Items: []commands.Trade{
+		trade("SBER", 5, "14.08.2026 23:49:59"),
+	}}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(sberDay, "part-2.parquet"),
+		filepath.Join(dir, "trades", "date=2026-08-15", "sec_code=SBER", "part-1.parquet"),
+	} {
+		if rows, err := parquet.ReadFile[tradeRow](path); err != nil || len(rows) != 1 {
+			t.Fatalf("%s: rows %+v, err %v", path, rows, err)
+		}
+	}
+}
+
+func TestParquetTableRollsPartsByInterval(t *testing.T) {
+	dir := t.TempDir()
+	table := newParquetTable(dir, "trades", 10*time.Minute, func(row tradeRow) (time.Time, string) { return row.Time, row.SecCode })
+	now := time.Date(2026, 8, 14, 10, 0, 0, 0, moscowLocation)
+	table.now = func() time.Time { return now }
+	defer func() { _ = table.close() }()
+	write := func(tradeNo int64) {
+		t.Helper()
+		if err := table.write(tradeRecords([]commands.AllTrades{{Items: []commands.Trade{
+			{SecId: 1, Board: "TQBR", SecCode: "SBER", TradeNo: tradeNo, Time: "14.08.2026 10:00:00", Price: 100, Quantity: 1},
+		}}})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1)
+	if next := table.untilNextFinish(); next != 10*time.Minute {
+		t.Fatalf("next finish in %s", next)
+	}
+	now = now.Add(10 * time.Minute)
+	write(2)
+
+	sberDay := filepath.Join(dir, "trades", "date=2026-08-14", "sec_code=SBER")
+	if rows, err := parquet.ReadFile[tradeRow](filepath.Join(sberDay, "part-1.parquet")); err != nil || len(rows) != 2 {
+		t.Fatalf("rolled part: rows %+v, err %v", rows, err)
+	}
+	write(3)
+	if _, err := os.Stat(filepath.Join(sberDay, "part-2.parquet"+parquetPendingSuffix)); err != nil {
+		t.Fatalf("next part: %v", err)
+	}
+}
+
+func TestParquetTableFinishesPastDaysOfOneWriteRightAway(t *testing.T) {
+	dir := t.TempDir()
+	table := newParquetTable(dir, "candles", 0, func(row candleRow) (time.Time, string) { return row.Date, row.SecCode })
+	now := time.Date(2026, 8, 14, 12, 0, 0, 0, moscowLocation)
+	table.now = func() time.Time { return now }
+	defer func() { _ = table.close() }()
+
+	// One history page of daily candles, the last one of today.
+	var page []candleRow
+	for day := 30; day >= 0; day-- {
+		page = append(page, candleRow{Date: now.AddDate(0, 0, -day).Truncate(24 * time.Hour), SecCode: "SBER", Source: candleSourceHistory, PeriodSeconds: 86400})
+	}
+	if err := table.write(page); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.partitions) != 1 {
+		t.Fatalf("open partitions = %d, want only today's", len(table.partitions))
+	}
+	rows, err := parquet.ReadFile[candleRow](filepath.Join(dir, "candles", "date="+now.AddDate(0, 0, -30).Format(time.DateOnly), "sec_code=SBER", "part-1.parquet"))
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("past day: rows %+v, err %v", rows, err)
+	}
+}
+
+func TestParquetSinkRemovesUnfinishedFiles(t *testing.T) {
+	dir := t.TempDir()
+	pending := filepath.Join(dir, "candles", "date=2026-08-14", "sec_code=SBER", "part-1.parquet"+parquetPendingSuffix)
+	if err := os.MkdirAll(filepath.Dir(pending), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pending, []byte("PAR1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := openParquetSink(parquetConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pending); !os.IsNotExist(err) {
+		t.Fatalf("unfinished file: %v", err)
+	}
+	if err := out.candles(context.Background(), [][]aggregatedCandle{{{
+		Start: time.Date(2026, 8, 14, 10, 0, 0, 0, moscowLocation), SecCode: "SBER", PeriodSeconds: 60,
+		Source: candleSourceTrades, Open: 100, High: 101, Low: 99, Close: 100.5, Volume: 10, Trades: 2, Turnover: 1003,
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.ReadFile[candleRow](filepath.Join(filepath.Dir(pending), "part-1.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Vwap != 100.3 || rows[0].Source != candleSourceTrades || rows[0].PeriodSeconds != 60 {
+		t.Fatalf("rows = %+v", rows)
+	}
+}
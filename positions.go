@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+const (
+	portfolioSourceUnitedPortfolio = "united_portfolio"
+	portfolioSourceUnitedEquity    = "united_equity"
+)
+
+// positionsEvent is one positions response with the time it was received.
+// TRANSAQ only sends the positions that changed, every row is the state of
+// that position at the snapshot time.
+type positionsEvent struct {
+	Snapshot  time.Time
+	Positions commands.Positions
+}
+
+// portfolioEvent is a united_portfolio or united_equity response reduced to
+// the columns of transaq_portfolio. united_equity only carries equity.
+type portfolioEvent struct {
+	Snapshot   time.Time
+	Source     string
+	Union      string
+	OpenEquity float64
+	Equity     float64
+	InitReq    float64
+	MaintReq   float64
+	VmCurrent  float64
+	FinRes     float64
+	Go         float64
+}
+
+func newUnitedPortfolioEvent(snapshot time.Time, portfolio commands.UnitedPortfolio) portfolioEvent {
+	return portfolioEvent{
+		Snapshot:   snapshot,
+		Source:     portfolioSourceUnitedPortfolio,
+		Union:      portfolio.Union,
+		OpenEquity: float64(portfolio.OpenEquity),
+		Equity:     float64(portfolio.Equity),
+		InitReq:    float64(portfolio.InitReq),
+		MaintReq:   float64(portfolio.MaintReq),
+		VmCurrent:  float64(portfolio.VmCurrent),
+		FinRes:     float64(portfolio.FinRes),
+		Go:         float64(portfolio.Go),
+	}
+}
+
+func newUnitedEquityEvent(snapshot time.Time, equity commands.UnitedEquity) portfolioEvent {
+	return portfolioEvent{
+		Snapshot: snapshot,
+		Source:   portfolioSourceUnitedEquity,
+		Union:    equity.Union,
+		Equity:   float64(equity.Equity),
+	}
+}
+
+func insertPositions(insertCtx context.Context, event positionsEvent) error {
+	return errors.Join(
+		insertPositionRows(insertCtx, "transaq_sec_positions", ChSecPositionsInsert, event.Positions.SecPositions,
+			func(position commands.SecPosition) []any {
+				return []any{
+					event.Snapshot,
+					uint16(position.SecId),
+					uint8(position.Market),
+					position.SecCode,
+					position.Register,
+					position.Client,
+					position.Union,
+					position.ShortName,
+					float64(position.Saldoin),
+					float64(position.Bought),
+					float64(position.Sold),
+					float64(position.Saldo),
+					float64(position.OrdBuy),
+					float64(position.OrdSell),
+					float64(position.Amount),
+					float64(position.Equity),
+				}
+			}),
+		insertPositionRows(insertCtx, "transaq_money_positions", ChMoneyPositionsInsert, event.Positions.MoneyPosition,
+			func(position commands.MoneyPosition) []any {
+				return []any{
+					event.Snapshot,
+					position.Asset,
+					position.Register,
+					position.Client,
+					position.Union,
+					position.ShortName,
+					float64(position.Saldoin),
+					float64(position.Bought),
+					float64(position.Sold),
+					float64(position.Saldo),
+					float64(position.OrdBuy),
+					float64(position.OrdBuyCond),
+					float64(position.Comission),
+				}
+			}),
+		insertPositionRows(insertCtx, "transaq_forts_positions", ChFortsPositionsInsert, event.Positions.FortsPosition,
+			func(position commands.FortsPosition) []any {
+				return []any{
+					event.Snapshot,
+					uint16(position.SecId),
+					position.SecCode,
+					position.Client,
+					position.Union,
+					int64(position.StartNet),
+					int64(position.OpenBuys),
+					int64(position.OpenSells),
+					int64(position.TotalNet),
+					int64(position.TodayBuy),
+					int64(position.TodaySell),
+					float64(position.OptMargin),
+					float64(position.VarMargin),
+					int64(position.ExpirationPos),
+					float64(position.Netto),
+					float64(position.Kgo),
+				}
+			}),
+		insertPositionRows(insertCtx, "transaq_united_limits", ChUnitedLimitsInsert, event.Positions.UnitedLimits,
+			func(limits commands.UnitedLimits) []any {
+				return []any{
+					event.Snapshot,
+					limits.Union,
+					float64(limits.OpenEquity),
+					float64(limits.Equity),
+					float64(limits.Requirements),
+					float64(limits.Free),
+					float64(limits.VarMargin),
+					float64(limits.FinRes),
+					float64(limits.Go),
+				}
+			}),
+	)
+}
+
+func insertPositionRows[T any](insertCtx context.Context, table, query string, items []T, row func(T) []any) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert(table, len(items), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, query)
+	if err != nil {
+		return fmt.Errorf("prepare %s batch: %w", table, err)
+	}
+	defer batch.Close()
+	for _, item := range items {
+		if err := batch.Append(row(item)...); err != nil {
+			return fmt.Errorf("append %s row: %w", table, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send %s batch: %w", table, err)
+	}
+	return nil
+}
+
+func insertPortfolio(insertCtx context.Context, event portfolioEvent) error {
+	return insertPositionRows(insertCtx, "transaq_portfolio", ChPortfolioInsert, []portfolioEvent{event},
+		func(event portfolioEvent) []any {
+			return []any{
+				event.Snapshot,
+				event.Source,
+				event.Union,
+				event.OpenEquity,
+				event.Equity,
+				event.InitReq,
+				event.MaintReq,
+				event.VmCurrent,
+				event.FinRes,
+				event.Go,
+			}
+		})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// postgresSchemes are the DSN schemes accepted in postgres.url.
+var postgresSchemes = []string{"postgres", "postgresql"}
+
+// permanentPostgresClasses are the SQLSTATE classes of data, schema and
+// access errors, sending the same rows again cannot succeed.
+var permanentPostgresClasses = []string{
+	"22", // data exception
+	"23", // integrity constraint violation
+	"28", // invalid authorization specification
+	"3D", // invalid catalog name
+	"42", // syntax error or access rule violation
+}
+
+func isPostgresURL(databaseURL string) bool {
+	parsed, err := url.Parse(databaseURL)
+	return err == nil && slices.Contains(postgresSchemes, parsed.Scheme)
+}
+
+// postgresTable is a PostgreSQL table equivalent to a ClickHouse table of
+// db.go. The primary key is the ReplacingMergeTree sorting key, a row with
+// the key of a stored row replaces it.
+type postgresTable struct {
+	name    string
+	columns []string
+	key     []string
+	// timeColumn partitions the table as a hypertable when TimescaleDB is
+	// installed. Only tables with the time in the key can be hypertables.
+	timeColumn string
+	ddl        string
+}
+
+var (
+	postgresTrades = postgresTable{
+		name:       "transaq_trades",
+		columns:    []string{"time", "secid", "sec_code", "trade_no", "board", "price", "quantity", "buy_sell", "open_interest", "period"},
+		key:        []string{"secid", "board", "sec_code", "trade_no", "time", "buy_sell"},
+		timeColumn: "time",
+		ddl: `CREATE TABLE IF NOT EXISTS transaq_trades (
+		time timestamptz NOT NULL,
+		secid integer NOT NULL,
+		sec_code text NOT NULL,
+		trade_no bigint NOT NULL,
+		board text NOT NULL,
+		price double precision NOT NULL,
+		quantity integer NOT NULL,
+		buy_sell text NOT NULL,
+		open_interest integer NOT NULL,
+		period text NOT NULL,
+		PRIMARY KEY (secid, board, sec_code, trade_no, time, buy_sell)
+	)`,
+	}
+
+	// transaq_quotes keeps the last volume of every order book level, the
+	// time is not part of the key.
+	postgresQuotes = postgresTable{
+		name:    "transaq_quotes",
+		columns: []string{"time", "secid", "board", "sec_code", "price", "source", "yield", "buy", "sell"},
+		key:     []string{"sec_code", "board", "price", "source"},
+		ddl: `CREATE TABLE IF NOT EXISTS transaq_quotes (
+		time timestamptz NOT NULL,
+		secid integer NOT NULL,
+		board text NOT NULL,
+		sec_code text NOT NULL,
+		price double precision NOT NULL,
+		source text NOT NULL,
+		yield integer NOT NULL,
+		buy integer NOT NULL,
+		sell integer NOT NULL,
+		PRIMARY KEY (sec_code, board, price, source)
+	)`,
+	}
+
+	postgresCandles = postgresTable{
+		name:       "transaq_candles",
+		columns:    []string{"date", "sec_code", "period", "open", "close", "high", "low", "volume", "source", "period_seconds", "trades", "vwap"},
+		key:        []string{"date", "sec_code", "period", "source", "period_seconds"},
+		timeColumn: "date",
+		ddl: `CREATE TABLE IF NOT EXISTS transaq_candles (
+		date timestamptz NOT NULL,
+		sec_code text NOT NULL,
+		period integer NOT NULL,
+		open double precision NOT NULL,
+		close double precision NOT NULL,
+		high double precision NOT NULL,
+		low double precision NOT NULL,
+		volume bigint NOT NULL,
+		source text NOT NULL DEFAULT 'history',
+		period_seconds integer NOT NULL,
+		trades integer NOT NULL,
+		vwap double precision NOT NULL,
+		PRIMARY KEY (date, sec_code, period, source, period_seconds)
+	)`,
+	}
+
+	postgresSecurities = postgresTable{
+		name: "transaq_securities",
+		columns: []string{"secid", "seccode", "instrclass", "board", "market", "shortname", "decimals", "minstep",
+			"lotsize", "lotdivider", "point_cost", "sectype", "quotestype"},
+		key: []string{"seccode", "instrclass", "board", "market", "sectype", "quotestype"},
+		ddl: `CREATE TABLE IF NOT EXISTS transaq_securities (
+		secid integer NOT NULL,
+		seccode text NOT NULL,
+		instrclass text NOT NULL,
+		board text NOT NULL,
+		market integer NOT NULL,
+		shortname text NOT NULL,
+		decimals integer NOT NULL,
+		minstep double precision NOT NULL,
+		lotsize integer NOT NULL,
+		lotdivider integer NOT NULL,
+		point_cost double precision NOT NULL,
+		sectype text NOT NULL,
+		quotestype integer NOT NULL,
+		PRIMARY KEY (seccode, instrclass, board, market, sectype, quotestype)
+	)`,
+	}
+
+	// transaq_securities_info leaves the dates TRANSAQ did not send NULL.
+	postgresSecInfo = postgresTable{
+		name: "transaq_securities_info",
+		columns: []string{"secid", "sec_name", "sec_code", "market", "pname", "mat_date", "clearing_price", "minprice",
+			"maxprice", "buy_deposit", "sell_deposit", "bgo_c", "bgo_nc", "bgo_buy", "accruedint", "coupon_value",
+			"coupon_date", "coupon_period", "facevalue", "put_call", "point_cost", "opt_type", "lot_volume", "isin",
+			"regnumber", "buybackprice", "buybackdate", "currencyid"},
+		key: []string{"sec_code", "market", "regnumber", "isin"},
+		ddl: `CREATE TABLE IF NOT EXISTS transaq_securities_info (
+		secid integer NOT NULL,
+		sec_name text NOT NULL,
+		sec_code text NOT NULL,
+		market integer NOT NULL,
+		pname text NOT NULL,
+		mat_date timestamptz,
+		clearing_price double precision NOT NULL,
+		minprice double precision NOT NULL,
+		maxprice double precision NOT NULL,
+		buy_deposit double precision NOT NULL,
+		sell_deposit double precision NOT NULL,
+		bgo_c double precision NOT NULL,
+		bgo_nc double precision NOT NULL,
+		bgo_buy double precision NOT NULL,
+		accruedint double precision NOT NULL,
+		coupon_value double precision NOT NULL,
+		coupon_date timestamptz,
+		coupon_period integer NOT NULL,
+		facevalue double precision NOT NULL,
+		put_call text NOT NULL,
+		point_cost double precision NOT NULL,
+		opt_type text NOT NULL,
+		lot_volume integer NOT NULL,
+		isin text NOT NULL,
+		regnumber text NOT NULL,
+		buybackprice double precision NOT NULL,
+		buybackdate timestamptz,
+		currencyid text NOT NULL,
+		PRIMARY KEY (sec_code, market, regnumber, isin)
+	)`,
+	}
+
+	postgresTables = []postgresTable{postgresTrades, postgresQuotes, postgresCandles, postgresSecurities, postgresSecInfo}
+)
+
+func (table postgresTable) loadTable() string {
+	return table.name + "_load"
+}
+
+// upsertQuery moves the rows copied into the load table over to the table.
+// Of rows with one key the last copied wins, as in ReplacingMergeTree.
+func (table postgresTable) upsertQuery() string {
+	columns := strings.Join(table.columns, ", ")
+	key := strings.Join(table.key, ", ")
+	var updates []string
+	for _, column := range table.columns {
+		if !slices.Contains(table.key, column) {
+			updates = append(updates, column+" = EXCLUDED."+column)
+		}
+	}
+	conflict := "DO NOTHING"
+	if len(updates) > 0 {
+		conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (%s) %s FROM %s ORDER BY %s, ctid DESC ON CONFLICT (%s) %s",
+		table.name, columns, key, columns, table.loadTable(), key, key, conflict)
+}
+
+func openPostgres(openCtx context.Context, databaseURL string) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(openCtx, databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("open PostgreSQL: %w", err)
+	}
+	if err := pool.Ping(openCtx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("connect to PostgreSQL: %w", err)
+	}
+	var timescale bool
+	if err := pool.QueryRow(openCtx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&timescale); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("check TimescaleDB: %w", err)
+	}
+	if !timescale {
+		log.Info("TimescaleDB is not installed, PostgreSQL tables are created without hypertables")
+	}
+	for _, table := range postgresTables {
+		if _, err := pool.Exec(openCtx, table.ddl); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("initialize PostgreSQL schema: %w", err)
+		}
+		if timescale && table.timeColumn != "" {
+			if _, err := pool.Exec(openCtx, "SELECT create_hypertable($1::regclass, $2::name, if_not_exists => TRUE)", table.name, table.timeColumn); err != nil {
+				pool.Close()
+				return nil, fmt.Errorf("create %s hypertable: %w", table.name, err)
+			}
+		}
+	}
+	return pool, nil
+}
+
+// copyUpsert copies rows into a temporary table and upserts them from there
+// in one transaction, COPY alone cannot replace stored rows.
+func copyUpsert(copyCtx context.Context, pool *pgxpool.Pool, table postgresTable, rows [][]any) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("postgres."+table.name, len(rows), started, err) }()
+	tx, err := pool.Begin(copyCtx)
+	if err != nil {
+		return fmt.Errorf("begin %s transaction: %w", table.name, err)
+	}
+	defer func() { _ = tx.Rollback(copyCtx) }()
+	if _, err := tx.Exec(copyCtx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", table.loadTable(), table.name)); err != nil {
+		return fmt.Errorf("create %s: %w", table.loadTable(), err)
+	}
+	if _, err := tx.CopyFrom(copyCtx, pgx.Identifier{table.loadTable()}, table.columns, pgx.CopyFromRows(rows)); err != nil {
+		return fmt.Errorf("copy %s rows: %w", table.name, err)
+	}
+	if _, err := tx.Exec(copyCtx, table.upsertQuery()); err != nil {
+		return fmt.Errorf("upsert %s rows: %w", table.name, err)
+	}
+	if err := tx.Commit(copyCtx); err != nil {
+		return fmt.Errorf("commit %s rows: %w", table.name, err)
+	}
+	return nil
+}
+
+func tradeValues(rows []tradeRow) [][]any {
+	values := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, []any{row.Time, row.SecId, row.SecCode, row.TradeNo, row.Board, row.Price, row.Quantity,
+			row.BuySell, row.OpenInterest, row.Period})
+	}
+	return values
+}
+
+func quoteValues(rows []quoteRow) [][]any {
+	values := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, []any{row.Time, row.SecId, row.Board, row.SecCode, row.Price, row.Source, row.Yield, row.Buy, row.Sell})
+	}
+	return values
+}
+
+func candleValues(rows []candleRow) [][]any {
+	values := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, []any{row.Date, row.SecCode, row.Period, row.Open, row.Close, row.High, row.Low, row.Volume,
+			row.Source, row.PeriodSeconds, row.Trades, row.Vwap})
+	}
+	return values
+}
+
+func securityValues(rows []securityRow) [][]any {
+	values := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		values = append(values, []any{row.SecId, row.SecCode, row.InstrClass, row.Board, row.Market, row.ShortName, row.Decimals,
+			row.MinStep, row.LotSize, row.LotDivider, row.PointCost, row.SecType, row.QuotesType})
+	}
+	return values
+}
+
+func secInfoValues(row secInfoRow) [][]any {
+	return [][]any{{row.SecId, row.SecName, row.SecCode, row.Market, row.PName, row.MatDate, row.ClearingPrice, row.MinPrice,
+		row.MaxPrice, row.BuyDeposit, row.SellDeposit, row.BgoC, row.BgoNc, row.BgoBuy, row.AccruedInt, row.CouponValue,
+		row.CouponDate, row.CouponPeriod, row.FaceValue, row.PutCall, row.PointCost, row.OptType, row.LotVolume, row.Isin,
+		row.RegNumber, row.BuybackPrice, row.BuybackDate, row.CurrencyId}}
+}
+
+// openPostgresSink writes trades, quotes, candles, securities and security
+// info to PostgreSQL. Failed writes are retried like ClickHouse inserts, then
+// spooled in the postgres subdirectory of spool.dir and replayed once
+// PostgreSQL answers again; rows it rejects go to the dead letter.
+func openPostgresSink(openCtx context.Context, databaseURL string) (sink, error) {
+	pool, err := openPostgres(openCtx, databaseURL)
+	if err != nil {
+		return sink{}, err
+	}
+	resilience, err := openSinkSpool(settings.Load().Spool, sinkPostgres)
+	if err != nil {
+		pool.Close()
+		return sink{}, err
+	}
+	securities := retried("postgres "+postgresSecurities.name, settings.Load().Retry, func(writeCtx context.Context, batch []commands.Security) error {
+		return copyUpsert(writeCtx, pool, postgresSecurities, securityValues(securityRecords(batch)))
+	})
+	out := sink{
+		name: sinkPostgres,
+		trades: sinkWrite(resilience, spoolKindTrades, func(writeCtx context.Context, batch []commands.AllTrades) error {
+			return copyUpsert(writeCtx, pool, postgresTrades, tradeValues(tradeRecords(batch)))
+		}),
+		quotes: sinkWrite(resilience, spoolKindQuotes, func(writeCtx context.Context, batch []commands.Quotes) error {
+			return copyUpsert(writeCtx, pool, postgresQuotes, quoteValues(quoteRecords(batch)))
+		}),
+		candles: sinkWrite(resilience, spoolKindCandles, func(writeCtx context.Context, batch [][]aggregatedCandle) error {
+			return copyUpsert(writeCtx, pool, postgresCandles, candleValues(candleRecords(batch)))
+		}),
+		historyCandles: sinkWrite(resilience, spoolKindHistoryCandles, func(writeCtx context.Context, event historyCandlesEvent) error {
+			return copyUpsert(writeCtx, pool, postgresCandles, candleValues(historyCandleRecords(event)))
+		}),
+		// Securities are sent again on every connect, like for ClickHouse
+		// they are not spooled.
+		securities: securities,
+		secInfo: sinkWrite(resilience, spoolKindSecInfo, func(writeCtx context.Context, info commands.SecInfo) error {
+			return copyUpsert(writeCtx, pool, postgresSecInfo, secInfoValues(secInfoRecord(info)))
+		}),
+		close: func() error {
+			pool.Close()
+			return resilience.close()
+		},
+	}
+	resilience.replay(openCtx, pool.Ping)
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestPostgresUpsertReplacesRowsByDedupKey(t *testing.T) {
+	query := postgresQuotes.upsertQuery()
+	for _, want := range []string{
+		"INSERT INTO transaq_quotes (time, secid, board, sec_code, price, source, yield, buy, sell)",
+		"SELECT DISTINCT ON (sec_code, board, price, source)",
+		"FROM transaq_quotes_load ORDER BY sec_code, board, price, source, ctid DESC",
+		"ON CONFLICT (sec_code, board, price, source) DO UPDATE SET time = EXCLUDED.time, secid = EXCLUDED.secid,",
+		"sell = EXCLUDED.sell",
+	} {
+		if !strings.Contains(query, want) {
+			t.Fatalf("upsert query %q lacks %q", query, want)
+		}
+	}
+}
+
+func TestPostgresValuesMatchTableColumns(t *testing.T) {
+	received := time.Date(2026, 8, 14, 12, 0, 0, 0, moscowLocation)
+	for table, values := range map[string][][]any{
+		postgresTrades.name: tradeValues(tradeRecords([]commands.AllTrades{{Items: []commands.Trade{{SecCode: "SBER", Time: "14.08.2026 12:00:00"}}}})),
+		postgresQuotes.name: quoteValues(quoteRecords([]commands.Quotes{{Time: received, Items: []commands.Quote{{SecCode: "SBER"}}}})),
+		postgresCandles.name: candleValues(historyCandleRecords(historyCandlesEvent{
+			Candles: commands.Candles{SecCode: "SBER", Items: []commands.Candle{{Date: "14.08.2026 12:00:00"}}},
+		})),
+		postgresSecurities.name: securityValues(securityRecords([]commands.Security{{SecCode: "SBER"}})),
+		postgresSecInfo.name:    secInfoValues(secInfoRecord(commands.SecInfo{SecCode: "SBER", MatDate: "15.12.2026"})),
+	} {
+		var columns []string
+		for _, candidate := range postgresTables {
+			if candidate.name == table {
+				columns = candidate.columns
+			}
+		}
+		if len(values) != 1 || len(values[0]) != len(columns) {
+			t.Fatalf("%s: %d values for %d columns", table, len(values[0]), len(columns))
+		}
+	}
+}
+
+func TestPostgresURLSelectsBackendAndErrorClass(t *testing.T) {
+	for databaseURL, want := range map[string]bool{
+		"postgres://exporter@127.0.0.1:5432/market":   true,
+		"postgresql://exporter@127.0.0.1:5432/market": true,
+		"tcp://127.0.0.1:9000":                        false,
+		"clickhouse://default@127.0.0.1:9000/default": false,
+	} {
+		if got := isPostgresURL(databaseURL); got != want {
+			t.Fatalf("isPostgresURL(%q) = %v", databaseURL, got)
+		}
+	}
+	if isRetryableError(&pgconn.PgError{Code: "22P02"}) {
+		t.Fatal("invalid text representation is retryable")
+	}
+	if !isRetryableError(&pgconn.PgError{Code: "40001"}) {
+		t.Fatal("serialization failure is not retryable")
+	}
+}
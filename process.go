@@ -4,7 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"slices"
+	"sync"
 	"time"
 
 	tcClient "github.com/kmlebedev/txmlconnector/client"
@@ -17,12 +18,40 @@ var errResponseStreamClosed = errors.New("txmlconnector response stream closed")
 type transaqSessionConfig struct {
 	restore       func(*tcClient.TCClient) error
 	eventHandlers transaqEventHandlers
+	// reloads delivers configs re-read on SIGHUP, reload applies them to a
+	// session whose subscriptions are already restored.
+	reloads <-chan exporterConfig
+	reload  func(*tcClient.TCClient, exporterConfig) error
+	// backfill pages history candles once subscriptions are restored, next
+	// to live streaming. It gets the candles from eventHandlers.historyCandles.
+	backfill *candleBackfill
+	// gapRepair rescans the history candles once the backfill is done.
+	gapRepair *candleGapRepair
+	// controls delivers the requests of the control API, they are run once
+	// subscriptions are restored.
+	controls <-chan controlRequest
 }
 
 func defaultTransaqSessionConfig() transaqSessionConfig {
+	config := settings.Load()
+	backfill := newCandleBackfill(config.Backfill)
+	eventHandlers := defaultTransaqEventHandlers(exportSink)
+	eventHandlers.historyCandles = backfill.observe(eventHandlers.historyCandles)
+	gapRepair := newCandleGapRepair(config.Gaps, backfill)
+	if !config.clickHouseEnabled() {
+		// Checkpoints and stored candles are read from ClickHouse. Without it
+		// the backfill pages the whole history again on every start.
+		backfill.load = func(context.Context) ([]backfillCheckpoint, error) { return nil, nil }
+		backfill.save = func(context.Context, backfillCheckpoint) error { return nil }
+		gapRepair = nil
+	}
 	return transaqSessionConfig{
 		restore:       restoreSubscriptions,
-		eventHandlers: defaultTransaqEventHandlers(),
+		eventHandlers: eventHandlers,
+		reload:        reloadSubscriptions,
+		backfill:      backfill,
+		gapRepair:     gapRepair,
+		controls:      controlRequests,
 	}
 }
 
@@ -32,10 +61,14 @@ func runTransaq(
 	sessionConfig transaqSessionConfig,
 	reconnectConfig tcClient.ReconnectConfig,
 ) error {
+	sessions := 0
 	return tcClient.RunWithReconnect(
 		runCtx,
 		newClient,
 		func(sessionCtx context.Context, client *tcClient.TCClient) error {
+			if sessions++; sessions > 1 {
+				reconnects.Inc()
+			}
 			return processTransaq(sessionCtx, client, sessionConfig)
 		},
 		reconnectConfig,
@@ -46,8 +79,33 @@ func processTransaq(processCtx context.Context, client *tcClient.TCClient, confi
 	if config.restore == nil {
 		return errors.New("TRANSAQ subscription restore callback is required")
 	}
+	if config.eventHandlers.reset != nil {
+		// Runs after the workers stopped, the next session starts clean.
+		defer config.eventHandlers.reset()
+	}
 	eventWorkers := startTransaqEventWorkers(processCtx, client, config.eventHandlers)
 	defer eventWorkers.stop()
+	defer health.setSession(false, false)
+	// Backfills started by the control API end with the session, before the
+	// workers that feed them stop.
+	controlCtx, cancelControl := context.WithCancel(processCtx)
+	var controlRuns sync.WaitGroup
+	defer func() {
+		cancelControl()
+		controlRuns.Wait()
+	}()
+	session := controlSession{client: client, backfill: func(candleCount int, series []candleSeries) error {
+		if config.backfill == nil {
+			return errBackfillDisabled
+		}
+		controlRuns.Add(1)
+		go func() {
+			defer controlRuns.Done()
+			config.backfill.run(controlCtx, client.SendCommand, candleCount, series)
+		}()
+		return nil
+	}}
+	var controls <-chan controlRequest
 	subscriptionsRestored := false
 	for {
 		select {
@@ -61,22 +119,55 @@ func processTransaq(processCtx context.Context, client *tcClient.TCClient, confi
 				if subscriptionsRestored {
 					continue
 				}
+				health.setSession(true, false)
 				if err := config.restore(client); err != nil {
 					return fmt.Errorf("restore TRANSAQ subscriptions: %w", err)
 				}
 				subscriptionsRestored = true
+				controls = config.controls
+				health.setSession(true, true)
 				log.Info("TRANSAQ subscriptions restored")
+				if config.backfill != nil {
+					backfillCtx, cancelBackfill := context.WithCancel(processCtx)
+					backfillDone := make(chan struct{})
+					go func(candleCount int, series []candleSeries) {
+						defer close(backfillDone)
+						config.backfill.run(backfillCtx, client.SendCommand, candleCount, series)
+						if config.gapRepair != nil {
+							config.gapRepair.run(backfillCtx, client.SendCommand, series)
+						}
+					}(settings.Load().Export.CandleCount, slices.Clone(historySeries))
+					defer func() {
+						cancelBackfill()
+						<-backfillDone
+					}()
+				}
 			case "false", "error":
 				return fmt.Errorf("TRANSAQ terminal is not connected: %+v", status)
 			default:
 				log.Infof("Status %+v", status)
 			}
+		case next := <-config.reloads:
+			if !subscriptionsRestored || config.reload == nil {
+				// The next restore picks the new selection up as a whole.
+				settings.Store(&next)
+				continue
+			}
+			if err := config.reload(client, next); err != nil {
+				return fmt.Errorf("reload TRANSAQ subscriptions: %w", err)
+			}
+		case request := <-controls:
+			value, err := request.run(session)
+			request.reply <- controlReply{value: value, err: err}
 		case resp := <-client.ResponseChannel:
+			health.eventProcessed()
 			switch resp {
 			case "united_portfolio":
-				log.Infof("UnitedPortfolio: ```\n%+v\n```", client.Data.UnitedPortfolio)
+				log.Debugf("UnitedPortfolio: %+v", client.Data.UnitedPortfolio)
+				dispatch(processCtx, eventWorkers.portfolio, newUnitedPortfolioEvent(time.Now(), client.Data.UnitedPortfolio))
 			case "united_equity":
-				log.Infof("UnitedEquity: ```\n%+v\n```", client.Data.UnitedEquity)
+				log.Debugf("UnitedEquity: %+v", client.Data.UnitedEquity)
+				dispatch(processCtx, eventWorkers.portfolio, newUnitedEquityEvent(time.Now(), client.Data.UnitedEquity))
 			case "positions":
 				// Todo avoid overwrite if only change field
 				if client.Data.Positions.UnitedLimits != nil && len(client.Data.Positions.UnitedLimits) > 0 {
@@ -105,75 +196,38 @@ func processTransaq(processCtx context.Context, client *tcClient.TCClient, confi
 						allTrades.Items = appendUniqueSecID(allTrades.Items, secPosition.SecId)
 					}
 				}
-				log.Infof("Positions: \n%+v\n", client.Data.Positions)
+				log.Debugf("Positions: %+v", client.Data.Positions)
+				// Money, collaterals and spot limits of FORTS are not stored,
+				// only the positions of the four position tables are sent on.
+				received := commands.Positions{
+					UnitedLimits:  slices.Clone(client.Data.Positions.UnitedLimits),
+					SecPositions:  slices.Clone(client.Data.Positions.SecPositions),
+					MoneyPosition: slices.Clone(client.Data.Positions.MoneyPosition),
+					FortsPosition: slices.Clone(client.Data.Positions.FortsPosition),
+				}
+				dispatch(processCtx, eventWorkers.positions, positionsEvent{Snapshot: time.Now(), Positions: received})
 
+			case "orders":
+				orders := client.Data.Orders
+				orders.Items = slices.Clone(orders.Items)
+				orders.StopOrders = slices.Clone(orders.StopOrders)
+				dispatch(processCtx, eventWorkers.orders, ordersEvent{Received: time.Now(), Orders: orders})
+			case "trades":
+				myTrades := client.Data.Trades
+				myTrades.Items = slices.Clone(myTrades.Items)
+				dispatch(processCtx, eventWorkers.myTrades, myTrades)
 			case "candles":
-				batch, _ := connect.PrepareBatch(ctx, ChCandlesInsertQuery)
-				dataCandleCountLock.Lock()
-				dataCandleCount = len(client.Data.Candles.Items)
-				dataCandleCountLock.Unlock()
-				for _, candle := range client.Data.Candles.Items {
-					candleDate, _ := time.Parse("02.01.2006 15:04:05", candle.Date)
-					if err := batch.Append(
-						fmt.Sprint(candleDate.Format("2006-01-02 15:04:05")),
-						client.Data.Candles.SecCode,
-						uint16(client.Data.Candles.Period),
-						float32(candle.Open),
-						float32(candle.Close),
-						float32(candle.High),
-						float32(candle.Low),
-						uint64(candle.Volume),
-					); err != nil {
-						log.Error(err)
-					}
-				}
-				if err := batch.Send(); err != nil {
-					log.Error(err)
-				}
+				candles := client.Data.Candles
+				candles.Items = slices.Clone(candles.Items)
+				dispatch(processCtx, eventWorkers.historyCandles, historyCandlesEvent{
+					Candles:       candles,
+					PeriodSeconds: candleKindSeconds(client.Data.CandleKinds.Items, candles.Period),
+				})
 			case "quotations":
-				timeNow := time.Now()
-				batch, _ := connect.PrepareBatch(ctx, ChCandlesInsertQuery)
-				for _, quotation := range client.Data.Quotations.Items {
-					quotationCandle, quotationCandleExist := quotationCandles[quotation.SecId]
-					if strings.HasSuffix(quotation.Time, ":00") && quotation.Last > 0 && quotationCandleExist {
-						if err := batch.Append(
-							fmt.Sprintf("%s %s", timeNow.Format("2006-01-02"), quotation.Time),
-							quotation.SecCode,
-							uint8(1),
-							float32(quotationCandles[quotation.SecId].Open),
-							float32(quotation.Last), // Close
-							float32(quotationCandles[quotation.SecId].High),
-							float32(quotationCandles[quotation.SecId].Low),
-							uint64(quotationCandles[quotation.SecId].Volume),
-						); err != nil {
-							log.Fatal(err)
-						}
-						quotationCandles[quotation.SecId] = commands.Candle{}
-					} else {
-						if quotationCandleExist {
-							if quotationCandle.Open == 0 && quotation.Open != 0 {
-								quotationCandle.Open = quotation.Open
-							}
-							if quotation.Last > quotationCandle.High {
-								quotationCandle.High = quotation.Last
-							}
-							if quotation.Last < quotationCandle.Low || quotationCandle.Low == 0 {
-								quotationCandle.Low = quotation.Last
-							}
-							quotationCandle.Volume += int64(quotation.Quantity)
-						} else {
-							quotationCandles[quotation.SecId] = commands.Candle{
-								Open:   quotation.Last,
-								Low:    quotation.Last,
-								High:   quotation.Last,
-								Volume: int64(quotation.Quantity),
-							}
-						}
-					}
-				}
-				if err := batch.Send(); err != nil {
-					log.Error(err)
-				}
+				dispatch(processCtx, eventWorkers.quotations, quotationsEvent{
+					Received: time.Now(),
+					Items:    slices.Clone(client.Data.Quotations.Items),
+				})
 			default:
 				log.Debugf("receive %s", resp)
 			}
@@ -182,9 +236,6 @@ func processTransaq(processCtx context.Context, client *tcClient.TCClient, confi
 }
 
 func restoreSubscriptions(client *tcClient.TCClient) error {
-	// A disconnect leaves an incomplete minute in memory. Do not merge fresh
-	// quotations into a candle that contains a gap in the source stream.
-	clear(quotationCandles)
 	if err := updateSecurities(client); err != nil {
 		return err
 	}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+// quotationStates merges the field deltas of quotations into the full L1
+// state of every security. TRANSAQ only sends the fields that changed, a
+// field missing from a quotation keeps its last value.
+//
+// The client hands quotations over decoded, without the XML, so a missing
+// field is told by its zero value. A real change to 0, such as change,
+// deltapositions, numbids or biddepth of an emptied book, is taken for a
+// missing field: the state keeps the last value and transaq_quotations shows
+// it as current until the field changes to a value other than 0.
+type quotationStates struct {
+	lock   sync.Mutex
+	states map[string]commands.Quotation
+}
+
+func newQuotationStates() *quotationStates {
+	return &quotationStates{states: map[string]commands.Quotation{}}
+}
+
+// merge applies a quotations message and returns the merged states of the
+// securities it touched.
+func (set *quotationStates) merge(event quotationsEvent) quotationsEvent {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	merged := quotationsEvent{Received: event.Received, Items: make([]commands.Quotation, 0, len(event.Items))}
+	for _, quotation := range event.Items {
+		key := quotation.Board + ":" + quotation.SecCode
+		state := mergeQuotation(set.states[key], quotation)
+		set.states[key] = state
+		merged.Items = append(merged.Items, state)
+	}
+	return merged
+}
+
+// reset forgets the states, TRANSAQ sends them whole after a resubscription.
+func (set *quotationStates) reset() {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	clear(set.states)
+}
+
+func mergeValue[T comparable](state *T, delta T) {
+	var zero T
+	if delta != zero {
+		*state = delta
+	}
+}
+
+func mergeQuotation(state, delta commands.Quotation) commands.Quotation {
+	mergeValue(&state.SecId, delta.SecId)
+	mergeValue(&state.Board, delta.Board)
+	mergeValue(&state.SecCode, delta.SecCode)
+	mergeValue(&state.PointCost, delta.PointCost)
+	mergeValue(&state.AccruedIntValue, delta.AccruedIntValue)
+	mergeValue(&state.Open, delta.Open)
+	mergeValue(&state.WaPrice, delta.WaPrice)
+	mergeValue(&state.BidDepth, delta.BidDepth)
+	mergeValue(&state.BidDepthT, delta.BidDepthT)
+	mergeValue(&state.NumBids, delta.NumBids)
+	mergeValue(&state.OfferDepth, delta.OfferDepth)
+	mergeValue(&state.OfferDepthT, delta.OfferDepthT)
+	mergeValue(&state.Bid, delta.Bid)
+	mergeValue(&state.Offer, delta.Offer)
+	mergeValue(&state.NumOffers, delta.NumOffers)
+	mergeValue(&state.NumTrades, delta.NumTrades)
+	mergeValue(&state.VolToday, delta.VolToday)
+	mergeValue(&state.OpenPositions, delta.OpenPositions)
+	mergeValue(&state.DeltaPositions, delta.DeltaPositions)
+	mergeValue(&state.Last, delta.Last)
+	mergeValue(&state.Quantity, delta.Quantity)
+	mergeValue(&state.Time, delta.Time)
+	mergeValue(&state.Change, delta.Change)
+	mergeValue(&state.ValToday, delta.ValToday)
+	mergeValue(&state.Yield, delta.Yield)
+	mergeValue(&state.YieldAtWaPrice, delta.YieldAtWaPrice)
+	mergeValue(&state.MarketPriceToday, delta.MarketPriceToday)
+	mergeValue(&state.HighBid, delta.HighBid)
+	mergeValue(&state.LowOffer, delta.LowOffer)
+	mergeValue(&state.High, delta.High)
+	mergeValue(&state.Low, delta.Low)
+	mergeValue(&state.ClosePrice, delta.ClosePrice)
+	mergeValue(&state.CloseYield, delta.CloseYield)
+	mergeValue(&state.Status, delta.Status)
+	mergeValue(&state.TradingStatus, delta.TradingStatus)
+	mergeValue(&state.BuyDeposit, delta.BuyDeposit)
+	mergeValue(&state.SellDeposit, delta.SellDeposit)
+	mergeValue(&state.Volatility, delta.Volatility)
+	mergeValue(&state.TheoreticalPrice, delta.TheoreticalPrice)
+	return state
+}
+
+func quotationRows(event quotationsEvent) int {
+	return len(event.Items)
+}
+
+func insertQuotationsBatch(insertCtx context.Context, batch []quotationsEvent) (err error) {
+	rows := 0
+	for _, event := range batch {
+		rows += len(event.Items)
+	}
+	if rows == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observeInsert("transaq_quotations", rows, started, err) }()
+	quotationsBatch, err := connect.PrepareBatch(insertCtx, ChQuotationsInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare quotations batch: %w", err)
+	}
+	defer quotationsBatch.Close()
+	for _, event := range batch {
+		for _, quotation := range event.Items {
+			var lastTime *time.Time
+			if at, err := quotationTime(event.Received, quotation.Time); err == nil {
+				lastTime = &at
+			}
+			if err := quotationsBatch.Append(
+				event.Received,
+				uint16(quotation.SecId),
+				quotation.Board,
+				quotation.SecCode,
+				float64(quotation.Bid),
+				int64(quotation.BidDepth),
+				int64(quotation.BidDepthT),
+				int64(quotation.NumBids),
+				float64(quotation.Offer),
+				int64(quotation.OfferDepth),
+				int64(quotation.OfferDepthT),
+				int64(quotation.NumOffers),
+				float64(quotation.Last),
+				int64(quotation.Quantity),
+				lastTime,
+				float64(quotation.Change),
+				float64(quotation.Open),
+				float64(quotation.High),
+				float64(quotation.Low),
+				float64(quotation.WaPrice),
+				int64(quotation.NumTrades),
+				int64(quotation.VolToday),
+				float64(quotation.ValToday),
+				int64(quotation.OpenPositions),
+				int64(quotation.DeltaPositions),
+				float64(quotation.Yield),
+				float64(quotation.AccruedIntValue),
+				quotation.Status,
+				quotation.TradingStatus,
+			); err != nil {
+				return fmt.Errorf("append %s quotation: %w", quotation.SecCode, err)
+			}
+		}
+	}
+	if err := quotationsBatch.Send(); err != nil {
+		return fmt.Errorf("send quotations batch: %w", err)
+	}
+	return nil
+}
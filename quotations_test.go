@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestQuotationStatesKeepUnchangedFields(t *testing.T) {
+	states := newQuotationStates()
+	received := time.Date(2026, 8, 14, 12, 0, 1, 0, moscowLocation)
+	states.merge(quotationsEvent{Received: received, Items: []commands.Quotation{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Bid: 99, Offer: 101, Last: 100, Time: "12:00:00", Status: "A"},
+	}})
+	merged := states.merge(quotationsEvent{Received: received, Items: []commands.Quotation{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Offer: 100.5},
+	}})
+
+	if len(merged.Items) != 1 {
+		t.Fatalf("merged = %+v", merged.Items)
+	}
+	quotation := merged.Items[0]
+	if quotation.Bid != 99 || quotation.Offer != 100.5 || quotation.Last != 100 || quotation.Time != "12:00:00" || quotation.Status != "A" {
+		t.Fatalf("quotation = %+v", quotation)
+	}
+
+	states.reset()
+	merged = states.merge(quotationsEvent{Received: received, Items: []commands.Quotation{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", Offer: 100.5},
+	}})
+	if merged.Items[0].Bid != 0 {
+		t.Fatalf("bid after reset = %v", merged.Items[0].Bid)
+	}
+}
+
+func TestInsertQuotationsWritesMergedRows(t *testing.T) {
+	previousConnect := connect
+	recorder := &recordingConn{}
+	connect = recorder
+	defer func() { connect = previousConnect }()
+
+	received := time.Date(2026, 8, 14, 12, 0, 1, 0, moscowLocation)
+	err := insertQuotationsBatch(context.Background(), []quotationsEvent{
+		{Received: received, Items: []commands.Quotation{
+			{SecId: 1, Board: "TQBR", SecCode: "SBER", Bid: 99, Offer: 101, Last: 100, Time: "12:00:00"},
+			{SecId: 2, Board: "TQBR", SecCode: "GAZP", Bid: 150},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.query != ChQuotationsInsertQuery {
+		t.Fatalf("query = %q", recorder.query)
+	}
+	if len(recorder.batch.rows) != 2 || len(recorder.batch.rows[0]) != 29 {
+		t.Fatalf("rows = %+v", recorder.batch.rows)
+	}
+	if lastTime, ok := recorder.batch.rows[0][14].(*time.Time); !ok || lastTime == nil || lastTime.Hour() != 12 {
+		t.Fatalf("last_time = %v", recorder.batch.rows[0][14])
+	}
+	if lastTime := recorder.batch.rows[1][14].(*time.Time); lastTime != nil {
+		t.Fatalf("last_time without a trade = %v", lastTime)
+	}
+	if !recorder.batch.sent {
+		t.Fatal("quotations batch was not sent")
+	}
+}
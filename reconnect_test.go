@@ -255,3 +255,50 @@ func TestRunTransaqDelegatesReconnectToClient(t *testing.T) {
 		t.Fatalf("created clients = %d, want 2", created)
 	}
 }
+
+func TestProcessTransaqAppliesConfigReloadWithoutReconnect(t *testing.T) {
+	defer settings.Store(settings.Load())
+
+	client := newTestTCClient(newFakeConnectServiceClient())
+	restored := make(chan struct{})
+	reloads := make(chan exporterConfig, 1)
+	reloaded := make(chan exporterConfig, 1)
+	processCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- processTransaq(processCtx, client, transaqSessionConfig{
+			restore: func(*tcClient.TCClient) error {
+				close(restored)
+				return nil
+			},
+			reloads: reloads,
+			reload: func(_ *tcClient.TCClient, next exporterConfig) error {
+				reloaded <- next
+				return nil
+			},
+		})
+	}()
+
+	client.ServerStatusChan <- commands.ServerStatus{Connected: "true"}
+	select {
+	case <-restored:
+	case <-time.After(time.Second):
+		t.Fatal("subscriptions were not restored")
+	}
+	next := defaultExporterConfig()
+	next.Export.AllTrades = []string{"SBER"}
+	reloads <- next
+	select {
+	case got := <-reloaded:
+		if len(got.Export.AllTrades) != 1 {
+			t.Fatalf("reloaded config = %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("config reload was not applied to the session")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("processTransaq error = %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/column"
+	"github.com/jackc/pgx/v5/pgconn"
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+const deadLetterInsertTimeout = 10 * time.Second
+
+// permanentExceptionCodes are ClickHouse exceptions caused by the data or the
+// schema. Sending the same batch again cannot succeed, so these go straight to
+// the dead letter.
+var permanentExceptionCodes = []int32{
+	6,   // CANNOT_PARSE_TEXT
+	8,   // THERE_IS_NO_COLUMN
+	10,  // NOT_FOUND_COLUMN_IN_BLOCK
+	16,  // NO_SUCH_COLUMN_IN_TABLE
+	26,  // CANNOT_PARSE_QUOTED_STRING
+	27,  // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	38,  // CANNOT_PARSE_DATE
+	41,  // CANNOT_PARSE_DATETIME
+	43,  // ILLEGAL_TYPE_OF_ARGUMENT
+	44,  // ILLEGAL_COLUMN
+	47,  // UNKNOWN_IDENTIFIER
+	53,  // TYPE_MISMATCH
+	60,  // UNKNOWN_TABLE
+	62,  // SYNTAX_ERROR
+	69,  // ARGUMENT_OUT_OF_BOUND
+	70,  // CANNOT_CONVERT_TYPE
+	81,  // UNKNOWN_DATABASE
+	131, // TOO_LARGE_STRING_SIZE
+	497, // ACCESS_DENIED
+	516, // AUTHENTICATION_FAILED
+}
+
+type retryConfig struct {
+	Attempts int           `yaml:"attempts"`
+	MinDelay time.Duration `yaml:"min_delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+type deadLetterConfig struct {
+	// File receives dead letters ClickHouse could not store either, and all
+	// of them when the clickhouse sink is not enabled.
+	File string `yaml:"file"`
+}
+
+// isRetryableError reports whether an insert failure is transient: network
+// errors, timeouts, overload (TOO_MANY_PARTS, memory limits) and cancelled
+// inserts. Schema and data errors, of ClickHouse and PostgreSQL, are
+// permanent, as are the Kafka errors the protocol marks not retriable.
+func isRetryableError(err error) bool {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return !slices.Contains(permanentExceptionCodes, exception.Code)
+	}
+	var postgresErr *pgconn.PgError
+	if errors.As(err, &postgresErr) {
+		return !slices.Contains(permanentPostgresClasses, postgresErr.Code[:min(2, len(postgresErr.Code))])
+	}
+	var kafkaErr *kerr.Error
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.Retriable
+	}
+	var converterErr *column.ColumnConverterError
+	if errors.As(err, &converterErr) {
+		return false
+	}
+	var unsupportedErr *column.UnsupportedColumnTypeError
+	return !errors.As(err, &unsupportedErr)
+}
+
+// retried wraps an insert with exponential backoff. Permanent errors and a
+// cancelled context end the retries early.
+func retried[T any](kind string, policy retryConfig, insert func(context.Context, T) error) func(context.Context, T) error {
+	return func(insertCtx context.Context, event T) error {
+		delay := policy.MinDelay
+		var err error
+		for attempt := 1; ; attempt++ {
+			if err = insert(insertCtx, event); err == nil {
+				return nil
+			}
+			if attempt >= policy.Attempts || !isRetryableError(err) || insertCtx.Err() != nil {
+				return err
+			}
+			log.Warnf("Insert %s failed (attempt %d/%d), retry in %s: %v", kind, attempt, policy.Attempts, delay, err)
+			if waitErr := waitForClickHouseRetry(insertCtx, delay); waitErr != nil {
+				return err
+			}
+			delay = min(2*delay, policy.MaxDelay)
+		}
+	}
+}
+
+// deadLettered stores events whose insert finally failed in the dead letter
+// table, or in the dead letter file when ClickHouse refuses that too or is
+// not a sink. With
+// permanentOnly, transient errors are returned to the caller instead, which
+// lets the spool replayer keep them for the next attempt.
+func deadLettered[T any](kind string, permanentOnly bool, insert func(context.Context, T) error) func(context.Context, T) error {
+	return func(insertCtx context.Context, event T) error {
+		err := insert(insertCtx, event)
+		if err == nil || (permanentOnly && isRetryableError(err)) {
+			return err
+		}
+		if deadLetterErr := writeDeadLetter(insertCtx, kind, event, err); deadLetterErr != nil {
+			log.Errorf("Lost %s event %+v", kind, event)
+			return errors.Join(err, deadLetterErr)
+		}
+		log.Errorf("Moved %s event to dead letter: %v", kind, err)
+		return nil
+	}
+}
+
+type deadLetter struct {
+	Time    time.Time       `json:"time"`
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+	Error   string          `json:"error"`
+}
+
+var deadLetterFileLock sync.Mutex
+
+func writeDeadLetter(writeCtx context.Context, kind string, event any, cause error) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode %s dead letter: %w", kind, err)
+	}
+	letter := deadLetter{Time: time.Now(), Kind: kind, Payload: payload, Error: cause.Error()}
+
+	// Without the clickhouse sink there is no dead letter table and the
+	// file is the only place left.
+	insertErr := errors.New("ClickHouse is not open")
+	if connect != nil {
+		// The session context is already cancelled on shutdown, which must
+		// not stop the last events from reaching the dead letter.
+		insertCtx, cancel := context.WithTimeout(context.WithoutCancel(writeCtx), deadLetterInsertTimeout)
+		defer cancel()
+		if insertErr = connect.AsyncInsert(insertCtx, ChDeadLetterInsertQuery, true,
+			letter.Time, letter.Kind, string(letter.Payload), letter.Error); insertErr == nil {
+			return nil
+		}
+	}
+	deadLetterFile := settings.Load().DeadLetter.File
+	if deadLetterFile == "" {
+		return fmt.Errorf("insert dead letter: %w", insertErr)
+	}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("encode %s dead letter: %w", kind, err)
+	}
+	deadLetterFileLock.Lock()
+	defer deadLetterFileLock.Unlock()
+	file, err := os.OpenFile(deadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return errors.Join(fmt.Errorf("insert dead letter: %w", insertErr), fmt.Errorf("open dead letter file: %w", err))
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return errors.Join(fmt.Errorf("insert dead letter: %w", insertErr), fmt.Errorf("write dead letter file: %w", err))
+	}
+	return file.Sync()
+}
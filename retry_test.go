@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+type asyncInsertConn struct {
+	driver.Conn
+	err  error
+	args [][]any
+}
+
+func (conn *asyncInsertConn) AsyncInsert(_ context.Context, _ string, _ bool, args ...any) error {
+	conn.args = append(conn.args, args)
+	return conn.err
+}
+
+func TestRetriedClassifiesClickHouseErrors(t *testing.T) {
+	policy := retryConfig{Attempts: 3, MinDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	for name, test := range map[string]struct {
+		err      error
+		attempts int
+	}{
+		"schema error":   {err: &clickhouse.Exception{Code: 60, Message: "Table transaq_trades does not exist"}, attempts: 1},
+		"too many parts": {err: &clickhouse.Exception{Code: 252, Message: "Too many parts"}, attempts: 3},
+		"network error":  {err: errors.New("read: connection reset by peer"), attempts: 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			insert := retried("trades", policy, func(context.Context, commands.AllTrades) error {
+				attempts++
+				return test.err
+			})
+			if err := insert(context.Background(), commands.AllTrades{}); !errors.Is(err, test.err) {
+				t.Fatalf("insert error = %v", err)
+			}
+			if attempts != test.attempts {
+				t.Fatalf("attempts = %d, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestDeadLetteredFallsBackToFile(t *testing.T) {
+	previousConnect, previousSettings := connect, settings.Load()
+	defer func() {
+		connect = previousConnect
+		settings.Store(previousSettings)
+	}()
+	recorder := &asyncInsertConn{err: errors.New("clickhouse is down")}
+	connect = recorder
+	config := *previousSettings
+	config.DeadLetter.File = filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	settings.Store(&config)
+
+	schemaErr := &clickhouse.Exception{Code: 16, Message: "No such column"}
+	insert := deadLettered("trades", false, func(context.Context, commands.AllTrades) error { return schemaErr })
+	if err := insert(context.Background(), commands.AllTrades{Items: []commands.Trade{{TradeNo: 42}}}); err != nil {
+		t.Fatalf("dead lettered insert error = %v", err)
+	}
+	if len(recorder.args) != 1 {
+		t.Fatalf("dead letter inserts = %d, want 1", len(recorder.args))
+	}
+	data, err := os.ReadFile(config.DeadLetter.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Kind != "trades" || !strings.Contains(letter.Error, "No such column") || !strings.Contains(string(letter.Payload), "42") {
+		t.Fatalf("dead letter = %+v", letter)
+	}
+
+	transient := deadLettered("trades", true, func(context.Context, commands.AllTrades) error {
+		return errors.New("connection refused")
+	})
+	if err := transient(context.Background(), commands.AllTrades{}); err == nil {
+		t.Fatal("transient error was dead lettered instead of returned")
+	}
+}
+
+func TestDeadLetterWithoutClickHouseGoesToFile(t *testing.T) {
+	previousConnect, previousSettings := connect, settings.Load()
+	defer func() {
+		connect = previousConnect
+		settings.Store(previousSettings)
+	}()
+	connect = nil
+	config := *previousSettings
+	config.DeadLetter.File = filepath.Join(t.TempDir(), "dead_letter.jsonl")
+	settings.Store(&config)
+
+	if err := writeDeadLetter(context.Background(), "kafka/trade_batches", commands.AllTrades{}, errors.New("brokers are down")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.DeadLetter.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(data, &letter); err != nil || letter.Kind != "kafka/trade_batches" {
+		t.Fatalf("dead letter = %+v, %v", letter, err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+// The row types are the exported data flattened into the columns of the
+// ClickHouse tables of db.go, for the sinks writing files. Trades and candles
+// also go to Parquet.
+
+type tradeRow struct {
+	Time         time.Time `json:"time" parquet:"time,timestamp(millisecond)"`
+	SecId        int       `json:"secid" parquet:"secid"`
+	SecCode      string    `json:"sec_code" parquet:"sec_code,dict"`
+	TradeNo      int64     `json:"trade_no" parquet:"trade_no"`
+	Board        string    `json:"board" parquet:"board,dict"`
+	Price        float64   `json:"price" parquet:"price"`
+	Quantity     int       `json:"quantity" parquet:"quantity"`
+	BuySell      string    `json:"buy_sell" parquet:"buy_sell,dict"`
+	OpenInterest int       `json:"open_interest" parquet:"open_interest"`
+	Period       string    `json:"period" parquet:"period"`
+}
+
+type quoteRow struct {
+	Time    time.Time `json:"time"`
+	SecId   int       `json:"secid"`
+	Board   string    `json:"board"`
+	SecCode string    `json:"sec_code"`
+	Price   float64   `json:"price"`
+	Source  string    `json:"source"`
+	Yield   int       `json:"yield"`
+	Buy     int       `json:"buy"`
+	Sell    int       `json:"sell"`
+}
+
+type candleRow struct {
+	Date          time.Time `json:"date" parquet:"date,timestamp(millisecond)"`
+	SecCode       string    `json:"sec_code" parquet:"sec_code,dict"`
+	Period        int       `json:"period" parquet:"period"`
+	Open          float64   `json:"open" parquet:"open"`
+	Close         float64   `json:"close" parquet:"close"`
+	High          float64   `json:"high" parquet:"high"`
+	Low           float64   `json:"low" parquet:"low"`
+	Volume        int64     `json:"volume" parquet:"volume"`
+	Source        string    `json:"source" parquet:"source,dict"`
+	PeriodSeconds int       `json:"period_seconds" parquet:"period_seconds"`
+	Trades        int       `json:"trades" parquet:"trades"`
+	Vwap          float64   `json:"vwap" parquet:"vwap"`
+}
+
+type securityRow struct {
+	SecId      int     `json:"secid"`
+	SecCode    string  `json:"seccode"`
+	InstrClass string  `json:"instrclass"`
+	Board      string  `json:"board"`
+	Market     int     `json:"market"`
+	ShortName  string  `json:"shortname"`
+	Decimals   int     `json:"decimals"`
+	MinStep    float64 `json:"minstep"`
+	LotSize    int     `json:"lotsize"`
+	LotDivider int     `json:"lotdivider"`
+	PointCost  float64 `json:"point_cost"`
+	SecType    string  `json:"sectype"`
+	QuotesType int     `json:"quotestype"`
+}
+
+// secInfoRow leaves out the dates TRANSAQ did not send.
+type secInfoRow struct {
+	SecId         int        `json:"secid"`
+	SecName       string     `json:"sec_name"`
+	SecCode       string     `json:"sec_code"`
+	Market        int        `json:"market"`
+	PName         string     `json:"pname"`
+	MatDate       *time.Time `json:"mat_date,omitempty"`
+	ClearingPrice float64    `json:"clearing_price"`
+	MinPrice      float64    `json:"minprice"`
+	MaxPrice      float64    `json:"maxprice"`
+	BuyDeposit    float64    `json:"buy_deposit"`
+	SellDeposit   float64    `json:"sell_deposit"`
+	BgoC          float64    `json:"bgo_c"`
+	BgoNc         float64    `json:"bgo_nc"`
+	BgoBuy        float64    `json:"bgo_buy"`
+	AccruedInt    float64    `json:"accruedint"`
+	CouponValue   float64    `json:"coupon_value"`
+	CouponDate    *time.Time `json:"coupon_date,omitempty"`
+	CouponPeriod  int        `json:"coupon_period"`
+	FaceValue     float64    `json:"facevalue"`
+	PutCall       string     `json:"put_call"`
+	PointCost     float64    `json:"point_cost"`
+	OptType       string     `json:"opt_type"`
+	LotVolume     int        `json:"lot_volume"`
+	Isin          string     `json:"isin"`
+	RegNumber     string     `json:"regnumber"`
+	BuybackPrice  float64    `json:"buybackprice"`
+	BuybackDate   *time.Time `json:"buybackdate,omitempty"`
+	CurrencyId    string     `json:"currencyid"`
+}
+
+func tradeRecords(batch []commands.AllTrades) []tradeRow {
+	var rows []tradeRow
+	for _, trades := range batch {
+		for _, trade := range trades.Items {
+			tradeTime, _ := time.ParseInLocation(tradeTimeLayout, trade.Time, moscowLocation)
+			rows = append(rows, tradeRow{
+				Time:         tradeTime,
+				SecId:        trade.SecId,
+				SecCode:      trade.SecCode,
+				TradeNo:      trade.TradeNo,
+				Board:        trade.Board,
+				Price:        trade.Price,
+				Quantity:     trade.Quantity,
+				BuySell:      trade.BuySell,
+				OpenInterest: trade.OpenInterest,
+				Period:       trade.Period,
+			})
+		}
+	}
+	return rows
+}
+
+func quoteRecords(batch []commands.Quotes) []quoteRow {
+	var rows []quoteRow
+	for _, quotes := range batch {
+		for _, quote := range quotes.Items {
+			rows = append(rows, quoteRow{
+				Time:    quotes.Time,
+				SecId:   quote.SecId,
+				Board:   quote.Board,
+				SecCode: quote.SecCode,
+				Price:   quote.Price,
+				Source:  quote.Source,
+				Yield:   quote.Yield,
+				Buy:     quote.Buy,
+				Sell:    quote.Sell,
+			})
+		}
+	}
+	return rows
+}
+
+func candleRecords(batch [][]aggregatedCandle) []candleRow {
+	var rows []candleRow
+	for _, candles := range batch {
+		for _, candle := range candles {
+			rows = append(rows, candleRow{
+				Date:          candle.Start.In(moscowLocation),
+				SecCode:       candle.SecCode,
+				Open:          candle.Open,
+				Close:         candle.Close,
+				High:          candle.High,
+				Low:           candle.Low,
+				Volume:        candle.Volume,
+				Source:        candle.Source,
+				PeriodSeconds: candle.PeriodSeconds,
+				Trades:        candle.Trades,
+				Vwap:          candle.vwap(),
+			})
+		}
+	}
+	return rows
+}
+
+func historyCandleRecords(event historyCandlesEvent) []candleRow {
+	rows := make([]candleRow, 0, len(event.Candles.Items))
+	for _, candle := range event.Candles.Items {
+		candleDate, _ := time.ParseInLocation(tradeTimeLayout, candle.Date, moscowLocation)
+		rows = append(rows, candleRow{
+			Date:          candleDate,
+			SecCode:       event.Candles.SecCode,
+			Period:        event.Candles.Period,
+			Open:          candle.Open,
+			Close:         candle.Close,
+			High:          candle.High,
+			Low:           candle.Low,
+			Volume:        int64(candle.Volume),
+			Source:        candleSourceHistory,
+			PeriodSeconds: event.PeriodSeconds,
+		})
+	}
+	return rows
+}
+
+func securityRecords(securities []commands.Security) []securityRow {
+	rows := make([]securityRow, 0, len(securities))
+	for _, sec := range securities {
+		rows = append(rows, securityRow{
+			SecId:      sec.SecId,
+			SecCode:    sec.SecCode,
+			InstrClass: sec.InstrClass,
+			Board:      sec.Board,
+			Market:     sec.Market,
+			ShortName:  sec.ShortName,
+			Decimals:   sec.Decimals,
+			MinStep:    sec.MinStep,
+			LotSize:    sec.LotSize,
+			LotDivider: sec.LotDivider,
+			PointCost:  sec.PointCost,
+			SecType:    sec.SecType,
+			QuotesType: sec.QuotesType,
+		})
+	}
+	return rows
+}
+
+func secInfoRecord(secInfo commands.SecInfo) secInfoRow {
+	optionalDate := func(value string) *time.Time {
+		date, err := time.ParseInLocation(dateLayout, value, moscowLocation)
+		if err != nil {
+			return nil
+		}
+		return &date
+	}
+	return secInfoRow{
+		SecId:         secInfo.SecId,
+		SecName:       secInfo.SecName,
+		SecCode:       secInfo.SecCode,
+		Market:        secInfo.Market,
+		PName:         secInfo.PName,
+		MatDate:       optionalDate(secInfo.MatDate),
+		ClearingPrice: secInfo.ClearingPrice,
+		MinPrice:      secInfo.MinPrice,
+		MaxPrice:      secInfo.MaxPrice,
+		BuyDeposit:    secInfo.BuyDeposit,
+		SellDeposit:   secInfo.SellDeposit,
+		BgoC:          secInfo.BgoC,
+		BgoNc:         secInfo.BgoNc,
+		BgoBuy:        secInfo.BgoBuy,
+		AccruedInt:    secInfo.AccruedInt,
+		CouponValue:   secInfo.CouponValue,
+		CouponDate:    optionalDate(secInfo.CouponDate),
+		CouponPeriod:  secInfo.CouponPeriod,
+		FaceValue:     secInfo.FaceValue,
+		PutCall:       secInfo.PutCall,
+		PointCost:     secInfo.PointCost,
+		OptType:       secInfo.OptType,
+		LotVolume:     secInfo.LotVolume,
+		Isin:          secInfo.Isin,
+		RegNumber:     secInfo.RegNumber,
+		BuybackPrice:  secInfo.BuybackPrice,
+		BuybackDate:   optionalDate(secInfo.BuybackDate),
+		CurrencyId:    secInfo.CurrencyId,
+	}
+}
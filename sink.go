@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the sinks in the sinks list of the config.
+const (
+	sinkClickHouse = "clickhouse"
+	sinkPostgres   = "postgres"
+	sinkJSONL      = "jsonl"
+	sinkParquet    = "parquet"
+	sinkKafka      = "kafka"
+)
+
+// knownSinks are the sinks the exporter can write to.
+var knownSinks = []string{sinkClickHouse, sinkPostgres, sinkJSONL, sinkParquet, sinkKafka}
+
+// sink stores the exported data. The event handlers batch and merge events
+// once and hand them to every enabled sink. A nil field means the sink does
+// not store that kind of data.
+type sink struct {
+	name           string
+	trades         func(context.Context, []commands.AllTrades) error
+	quotes         func(context.Context, []commands.Quotes) error
+	quotations     func(context.Context, []quotationsEvent) error
+	candles        func(context.Context, [][]aggregatedCandle) error
+	historyCandles func(context.Context, historyCandlesEvent) error
+	securities     func(context.Context, []commands.Security) error
+	secInfo        func(context.Context, commands.SecInfo) error
+	secInfoUpd     func(context.Context, secInfoUpdEvent) error
+	tradeGaps      func(context.Context, []tradeGap) error
+	orderBook      func(context.Context, []orderBookSnapshot) error
+	orders         func(context.Context, ordersEvent) error
+	myTrades       func(context.Context, commands.ClientTrades) error
+	positions      func(context.Context, positionsEvent) error
+	portfolio      func(context.Context, portfolioEvent) error
+	// close writes out what the sink holds back and releases it, it is called
+	// once on shutdown after the event handlers were flushed.
+	close func() error
+}
+
+// exportSink is the combination of the sinks enabled in the config.
+var exportSink sink
+
+// clickHouseSink writes to the tables of db.go. Failed inserts are retried,
+// spooled and dead-lettered.
+func clickHouseSink() sink {
+	return sink{
+		name:           sinkClickHouse,
+		trades:         resilientInsert(spoolKindTrades, insertTradesBatch),
+		quotes:         resilientInsert(spoolKindQuotes, insertQuotesBatch),
+		quotations:     resilientInsert(spoolKindQuotations, insertQuotationsBatch),
+		candles:        resilientInsert(spoolKindCandles, insertCandlesBatch),
+		historyCandles: resilientInsert(spoolKindHistoryCandles, insertHistoryCandles),
+		securities:     insertSecurities,
+		secInfo:        resilientInsert(spoolKindSecInfo, insertSecInfo),
+		secInfoUpd:     resilientInsert(spoolKindSecInfoUpd, insertSecInfoUpd),
+		tradeGaps:      resilientInsert(spoolKindTradeGaps, insertTradeGaps),
+		orderBook:      resilientInsert(spoolKindOrderBook, insertOrderBookSnapshots),
+		orders:         resilientInsert(spoolKindOrders, insertOrders),
+		myTrades:       resilientInsert(spoolKindMyTrades, insertMyTrades),
+		positions:      resilientInsert(spoolKindPositions, insertPositions),
+		portfolio:      resilientInsert(spoolKindPortfolio, insertPortfolio),
+		close:          func() error { return connect.Close() },
+	}
+}
+
+// openSinks opens the sinks listed in the config in order.
+func openSinks(openCtx context.Context, config exporterConfig) (sink, error) {
+	opened := make([]sink, 0, len(config.Sinks))
+	for _, name := range config.Sinks {
+		var next sink
+		var err error
+		switch name {
+		case sinkClickHouse:
+			if connect, err = openClickHouse(openCtx); err == nil {
+				next = clickHouseSink()
+			}
+		case sinkPostgres:
+			next, err = openPostgresSink(openCtx, config.Postgres.URL)
+		case sinkJSONL:
+			next, err = openJSONLSink(config.JSONL)
+		case sinkParquet:
+			next, err = openParquetSink(config.Parquet)
+		case sinkKafka:
+			next, err = openKafkaSink(openCtx, config.Kafka)
+		default:
+			err = errors.New("unknown sink")
+		}
+		if err != nil {
+			_ = combineSinks(opened).close()
+			return sink{}, fmt.Errorf("open %s sink: %w", name, err)
+		}
+		log.Infof("Sink %s opened", name)
+		opened = append(opened, next)
+	}
+	// Readiness waits for all sinks, the databases among them included.
+	health.setSinksReady(true)
+	return combineSinks(opened), nil
+}
+
+// combineSinks makes one sink writing to all of the given ones. Each sink
+// is written from its own queue, so a slow sink does not hold the others
+// back.
+func combineSinks(sinks []sink) sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	queues := make([]*sinkQueue, 0, len(sinks))
+	for _, out := range sinks {
+		queues = append(queues, startSinkQueue(out.name))
+	}
+	return sink{
+		name: "combined",
+		trades: fanOut(queues, sinks, func(out sink) func(context.Context, []commands.AllTrades) error {
+			return out.trades
+		}),
+		quotes: fanOut(queues, sinks, func(out sink) func(context.Context, []commands.Quotes) error {
+			return out.quotes
+		}),
+		quotations: fanOut(queues, sinks, func(out sink) func(context.Context, []quotationsEvent) error {
+			return out.quotations
+		}),
+		candles: fanOut(queues, sinks, func(out sink) func(context.Context, [][]aggregatedCandle) error {
+			return out.candles
+		}),
+		historyCandles: fanOutWait(queues, sinks, func(out sink) func(context.Context, historyCandlesEvent) error {
+			return out.historyCandles
+		}),
+		securities: fanOut(queues, sinks, func(out sink) func(context.Context, []commands.Security) error {
+			return out.securities
+		}),
+		secInfo: fanOut(queues, sinks, func(out sink) func(context.Context, commands.SecInfo) error {
+			return out.secInfo
+		}),
+		secInfoUpd: fanOut(queues, sinks, func(out sink) func(context.Context, secInfoUpdEvent) error {
+			return out.secInfoUpd
+		}),
+		tradeGaps: fanOut(queues, sinks, func(out sink) func(context.Context, []tradeGap) error {
+			return out.tradeGaps
+		}),
+		orderBook: fanOutWait(queues, sinks, func(out sink) func(context.Context, []orderBookSnapshot) error {
+			return out.orderBook
+		}),
+		orders: fanOut(queues, sinks, func(out sink) func(context.Context, ordersEvent) error {
+			return out.orders
+		}),
+		myTrades: fanOut(queues, sinks, func(out sink) func(context.Context, commands.ClientTrades) error {
+			return out.myTrades
+		}),
+		positions: fanOut(queues, sinks, func(out sink) func(context.Context, positionsEvent) error {
+			return out.positions
+		}),
+		portfolio: fanOut(queues, sinks, func(out sink) func(context.Context, portfolioEvent) error {
+			return out.portfolio
+		}),
+		close: func() error {
+			for _, queue := range queues {
+				queue.close()
+			}
+			var errs []error
+			for _, out := range sinks {
+				if out.close == nil {
+					continue
+				}
+				if err := out.close(); err != nil {
+					errs = append(errs, fmt.Errorf("close %s sink: %w", out.name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	}
+}
+
+// sinkQueueSize bounds the writes waiting for one sink of a combination.
+// A sink falling further behind holds the writers back.
+const sinkQueueSize = 1024
+
+// sinkQueue runs the writes to one sink of a combination in order in its own
+// goroutine.
+type sinkQueue struct {
+	name   string
+	writes chan func()
+	done   chan struct{}
+}
+
+func startSinkQueue(name string) *sinkQueue {
+	queue := &sinkQueue{name: name, writes: make(chan func(), sinkQueueSize), done: make(chan struct{})}
+	depth := queueDepth.WithLabelValues("sink_" + name)
+	go func() {
+		defer close(queue.done)
+		for write := range queue.writes {
+			write()
+			depth.Set(float64(len(queue.writes)))
+			health.setQueueDepth("sink_"+name, len(queue.writes))
+		}
+	}()
+	return queue
+}
+
+// enqueue hands write to the queue unless enqueueCtx ends while it is full.
+func (queue *sinkQueue) enqueue(enqueueCtx context.Context, write func()) error {
+	select {
+	case queue.writes <- write:
+		return nil
+	case <-enqueueCtx.Done():
+		return fmt.Errorf("%s sink queue is full: %w", queue.name, enqueueCtx.Err())
+	}
+}
+
+// close waits for the queued writes and stops the goroutine.
+func (queue *sinkQueue) close() {
+	close(queue.writes)
+	<-queue.done
+}
+
+// sinkWriters picks the writers of the sinks that have one, with their
+// queues.
+func sinkWriters[T any](queues []*sinkQueue, sinks []sink, writer func(sink) func(context.Context, T) error) ([]*sinkQueue, []func(context.Context, T) error) {
+	var writerQueues []*sinkQueue
+	var writers []func(context.Context, T) error
+	for i, out := range sinks {
+		if write := writer(out); write != nil {
+			writerQueues = append(writerQueues, queues[i])
+			writers = append(writers, write)
+		}
+	}
+	return writerQueues, writers
+}
+
+// fanOut queues a value for the writer of every sink that has one and
+// returns once the queues took it. Failures are logged with the sink name, a
+// failing or slow sink does not keep the value from the others.
+func fanOut[T any](queues []*sinkQueue, sinks []sink, writer func(sink) func(context.Context, T) error) func(context.Context, T) error {
+	writerQueues, writers := sinkWriters(queues, sinks, writer)
+	if len(writers) == 0 {
+		return nil
+	}
+	return func(writeCtx context.Context, value T) error {
+		// A queued write may run after the session ended, it must not be
+		// cancelled with it.
+		queuedCtx := context.WithoutCancel(writeCtx)
+		var errs []error
+		for i, write := range writers {
+			queue := writerQueues[i]
+			errs = append(errs, queue.enqueue(writeCtx, func() {
+				if err := write(queuedCtx, value); err != nil {
+					log.Errorf("Write to %s sink: %v", queue.name, err)
+				}
+			}))
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// fanOutWait is fanOut for values whose writers must know they are stored,
+// the history candles a backfill checkpoint or gap scan reads back and the
+// order book snapshots taken on request. The sinks still write in parallel,
+// it returns once all of them are done.
+func fanOutWait[T any](queues []*sinkQueue, sinks []sink, writer func(sink) func(context.Context, T) error) func(context.Context, T) error {
+	writerQueues, writers := sinkWriters(queues, sinks, writer)
+	if len(writers) == 0 {
+		return nil
+	}
+	return func(writeCtx context.Context, value T) error {
+		queuedCtx := context.WithoutCancel(writeCtx)
+		results := make(chan error, len(writers))
+		var errs []error
+		waiting := 0
+		for i, write := range writers {
+			queue := writerQueues[i]
+			err := queue.enqueue(writeCtx, func() {
+				if err := write(queuedCtx, value); err != nil {
+					results <- fmt.Errorf("%s sink: %w", queue.name, err)
+					return
+				}
+				results <- nil
+			})
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			waiting++
+		}
+		for ; waiting > 0; waiting-- {
+			errs = append(errs, <-results)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// discardNil turns a writer a sink does not have into one that drops the
+// value, for the batchers and aggregators that always need somewhere to go.
+func discardNil[T any](write func(context.Context, T) error) func(context.Context, T) error {
+	if write == nil {
+		return func(context.Context, T) error { return nil }
+	}
+	return write
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestCombineSinksWritesToEverySink(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	recordTrades := func(name string, err error) func(context.Context, []commands.AllTrades) error {
+		return func(context.Context, []commands.AllTrades) error {
+			lock.Lock()
+			defer lock.Unlock()
+			written = append(written, name)
+			return err
+		}
+	}
+	combined := combineSinks([]sink{
+		{name: "first", trades: recordTrades("first", errors.New("disk full")), close: func() error { return nil }},
+		{name: "second", close: func() error { return nil }},
+		{name: "third", trades: recordTrades("third", nil), close: func() error { return nil }},
+	})
+
+	// A failure of one sink is logged, the others get the value anyway.
+	if err := combined.trades(context.Background(), []commands.AllTrades{{Items: []commands.Trade{{TradeNo: 1}}}}); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if combined.quotes != nil {
+		t.Fatal("quotes writer of sinks without quotes")
+	}
+	if err := combined.close(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(written)
+	if strings.Join(written, ",") != "first,third" {
+		t.Fatalf("written = %v", written)
+	}
+}
+
+func TestCombineSinksDoNotWaitForSlowSink(t *testing.T) {
+	release := make(chan struct{})
+	fast := make(chan int64, 2)
+	combined := combineSinks([]sink{
+		{name: "slow", trades: func(context.Context, []commands.AllTrades) error {
+			<-release
+			return nil
+		}, historyCandles: func(context.Context, historyCandlesEvent) error {
+			return errors.New("disk full")
+		}},
+		{name: "fast", trades: func(_ context.Context, batch []commands.AllTrades) error {
+			fast <- batch[0].Items[0].TradeNo
+			return nil
+		}, historyCandles: func(context.Context, historyCandlesEvent) error { return nil }},
+	})
+	for tradeNo := int64(1); tradeNo <= 2; tradeNo++ {
+		if err := combined.trades(context.Background(), []commands.AllTrades{{Items: []commands.Trade{{TradeNo: tradeNo}}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for want := int64(1); want <= 2; want++ {
+		select {
+		case tradeNo := <-fast:
+			if tradeNo != want {
+				t.Fatalf("fast sink got trade %d, want %d", tradeNo, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("fast sink waited for the slow one")
+		}
+	}
+
+	// History candles are written by all sinks before the writer returns.
+	close(release)
+	if err := combined.historyCandles(context.Background(), historyCandlesEvent{}); err == nil || !strings.Contains(err.Error(), "slow sink: disk full") {
+		t.Fatalf("history candles err = %v", err)
+	}
+	if err := combined.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventHandlersWriteBatchesToSink(t *testing.T) {
+	var trades []commands.AllTrades
+	handlers := defaultTransaqEventHandlers(sink{
+		name: "test",
+		trades: func(_ context.Context, batch []commands.AllTrades) error {
+			trades = append(trades, batch...)
+			return nil
+		},
+	})
+	if err := handlers.allTrades(context.Background(), commands.AllTrades{Items: []commands.Trade{
+		{SecId: 1, Board: "TQBR", SecCode: "SBER", TradeNo: 10, Time: "14.08.2026 12:00:00"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	// The sink has no quotes, they are dropped.
+	if err := handlers.quotes(context.Background(), commands.Quotes{Items: []commands.Quote{{SecId: 1, Price: 100, Buy: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlers.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handlers.reset()
+	if len(trades) != 1 || trades[0].Items[0].TradeNo != 10 {
+		t.Fatalf("trades = %+v", trades)
+	}
+}
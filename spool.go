@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Trades and quotes are spooled as the batches of the batchers.
+	spoolKindTrades         = "trade_batches"
+	spoolKindQuotes         = "quote_batches"
+	spoolKindSecInfo        = "sec_info"
+	spoolKindSecInfoUpd     = "sec_info_upd"
+	spoolKindCandles        = "candles"
+	spoolKindHistoryCandles = "history_candles"
+	spoolKindTradeGaps      = "trade_gaps"
+	spoolKindOrderBook      = "orderbook"
+	spoolKindQuotations     = "quotations"
+	spoolKindOrders         = "orders"
+	spoolKindMyTrades       = "my_trades"
+	spoolKindPositions      = "positions"
+	spoolKindPortfolio      = "portfolio"
+
+	spoolSegmentSuffix = ".spool"
+)
+
+// eventSpool is the write-ahead spool of events ClickHouse did not accept.
+// It is nil when spooling is disabled.
+var eventSpool *spool
+
+type spoolRecord struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// spool appends records to numbered segment files in a directory. Segments
+// are replayed oldest first and removed once every record has been inserted,
+// so spooled events survive both ClickHouse outages and exporter restarts.
+type spool struct {
+	dir             string
+	segmentMaxBytes int64
+
+	lock        sync.Mutex
+	current     *os.File
+	currentSize int64
+	nextSegment uint64
+}
+
+func openSpool(dir string, segmentMaxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	spooler := &spool{dir: dir, segmentMaxBytes: segmentMaxBytes}
+	segments, err := spooler.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		spooler.nextSegment = segments[len(segments)-1] + 1
+		log.Warnf("Spool %s holds %d segments from a previous run", dir, len(segments))
+	}
+	return spooler, nil
+}
+
+// append durably stores one event. The record is synced to disk before
+// append returns, so a spooled event is never acknowledged and then lost.
+func (spooler *spool) append(kind string, event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode %s spool record: %w", kind, err)
+	}
+	line, err := json.Marshal(spoolRecord{Kind: kind, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("encode %s spool record: %w", kind, err)
+	}
+	line = append(line, '\n')
+
+	spooler.lock.Lock()
+	defer spooler.lock.Unlock()
+	if spooler.current != nil && spooler.currentSize+int64(len(line)) > spooler.segmentMaxBytes {
+		if err := spooler.sealLocked(); err != nil {
+			return err
+		}
+	}
+	if spooler.current == nil {
+		name := spooler.segmentPath(spooler.nextSegment)
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("open spool segment: %w", err)
+		}
+		spooler.nextSegment++
+		spooler.current = file
+		spooler.currentSize = 0
+	}
+	if _, err := spooler.current.Write(line); err != nil {
+		return fmt.Errorf("write spool segment: %w", err)
+	}
+	spooler.currentSize += int64(len(line))
+	if err := spooler.current.Sync(); err != nil {
+		return fmt.Errorf("sync spool segment: %w", err)
+	}
+	return nil
+}
+
+func (spooler *spool) sealLocked() error {
+	if spooler.current == nil {
+		return nil
+	}
+	err := spooler.current.Close()
+	spooler.current = nil
+	if err != nil {
+		return fmt.Errorf("close spool segment: %w", err)
+	}
+	return nil
+}
+
+func (spooler *spool) close() error {
+	spooler.lock.Lock()
+	defer spooler.lock.Unlock()
+	return spooler.sealLocked()
+}
+
+func (spooler *spool) segmentPath(segment uint64) string {
+	return filepath.Join(spooler.dir, fmt.Sprintf("%020d%s", segment, spoolSegmentSuffix))
+}
+
+func (spooler *spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(spooler.dir)
+	if err != nil {
+		return nil, fmt.Errorf("list spool dir: %w", err)
+	}
+	segments := []uint64{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), spoolSegmentSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if segment, err := strconv.ParseUint(name, 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
+
+// replay inserts every spooled record through handlers in the order the
+// records were written. The segment being appended to is sealed first so it
+// can be replayed too. On the first failure the unreplayed tail of the
+// segment is kept and replay stops until the next call.
+func (spooler *spool) replay(replayCtx context.Context, handlers map[string]func(context.Context, json.RawMessage) error) (int, error) {
+	// Segments opened after this point get higher numbers and are left for
+	// the next replay.
+	spooler.lock.Lock()
+	err := spooler.sealLocked()
+	segments, listErr := spooler.segments()
+	spooler.lock.Unlock()
+	if err = errors.Join(err, listErr); err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, segment := range segments {
+		count, err := spooler.replaySegment(replayCtx, spooler.segmentPath(segment), handlers)
+		replayed += count
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (spooler *spool) replaySegment(
+	replayCtx context.Context,
+	path string,
+	handlers map[string]func(context.Context, json.RawMessage) error,
+) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read spool segment: %w", err)
+	}
+	lines := strings.FieldsFunc(string(data), func(r rune) bool { return r == '\n' })
+	for index, line := range lines {
+		var record spoolRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			// A torn write from a crash can only be the last line.
+			log.Errorf("Skip corrupted spool record in %s: %v", path, err)
+			continue
+		}
+		handle, ok := handlers[record.Kind]
+		if !ok {
+			log.Errorf("Skip spool record of unknown kind %q in %s", record.Kind, path)
+			continue
+		}
+		if err := handle(replayCtx, record.Payload); err != nil {
+			return index, errors.Join(
+				fmt.Errorf("replay %s spool record: %w", record.Kind, err),
+				rewriteSpoolSegment(path, lines[index:]),
+			)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return len(lines), fmt.Errorf("remove replayed spool segment: %w", err)
+	}
+	return len(lines), nil
+}
+
+// rewriteSpoolSegment atomically replaces a partially replayed segment with
+// its remaining records so they are not inserted twice.
+func rewriteSpoolSegment(path string, lines []string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o640); err != nil {
+		return fmt.Errorf("rewrite spool segment: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rewrite spool segment: %w", err)
+	}
+	return nil
+}
+
+// runSpoolReplayer drains the spool back into target once it answers ping
+// again.
+func runSpoolReplayer(
+	replayCtx context.Context,
+	spooler *spool,
+	interval time.Duration,
+	target string,
+	ping func(context.Context) error,
+	handlers map[string]func(context.Context, json.RawMessage) error,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-replayCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		segments, err := spooler.segments()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if len(segments) == 0 {
+			continue
+		}
+		if err := ping(replayCtx); err != nil {
+			log.Debugf("Spool replay waits for %s: %v", target, err)
+			continue
+		}
+		replayed, err := spooler.replay(replayCtx, handlers)
+		if replayed > 0 {
+			log.Infof("Replayed %d spooled events into %s", replayed, target)
+		}
+		if err != nil && replayCtx.Err() == nil {
+			log.Warnf("Spool replay: %v", err)
+		}
+	}
+}
+
+// spooled wraps an insert so that an event ClickHouse could not take because
+// of a transient failure is stored in the spool instead of being dropped.
+// Permanent errors are returned, retrying them later would fail again.
+func spooled[T any](spooler *spool, kind string, insert func(context.Context, T) error) func(context.Context, T) error {
+	if spooler == nil {
+		return insert
+	}
+	return func(insertCtx context.Context, event T) error {
+		err := insert(insertCtx, event)
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		if spoolErr := spooler.append(kind, event); spoolErr != nil {
+			return errors.Join(err, spoolErr)
+		}
+		log.Warnf("Spooled %s event after insert failure: %v", kind, err)
+		return nil
+	}
+}
+
+func spoolReplayHandler[T any](insert func(context.Context, T) error) func(context.Context, json.RawMessage) error {
+	return func(replayCtx context.Context, payload json.RawMessage) error {
+		var event T
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return fmt.Errorf("decode spooled event: %w", err)
+		}
+		return insert(replayCtx, event)
+	}
+}
+
+func clickHouseSpoolReplayHandlers() map[string]func(context.Context, json.RawMessage) error {
+	return map[string]func(context.Context, json.RawMessage) error{
+		spoolKindTrades:         spoolReplayHandler(deadLettered(spoolKindTrades, true, insertTradesBatch)),
+		spoolKindQuotes:         spoolReplayHandler(deadLettered(spoolKindQuotes, true, insertQuotesBatch)),
+		spoolKindSecInfo:        spoolReplayHandler(deadLettered(spoolKindSecInfo, true, insertSecInfo)),
+		spoolKindSecInfoUpd:     spoolReplayHandler(deadLettered(spoolKindSecInfoUpd, true, insertSecInfoUpd)),
+		spoolKindCandles:        spoolReplayHandler(deadLettered(spoolKindCandles, true, insertCandlesBatch)),
+		spoolKindHistoryCandles: spoolReplayHandler(deadLettered(spoolKindHistoryCandles, true, insertHistoryCandles)),
+		spoolKindTradeGaps:      spoolReplayHandler(deadLettered(spoolKindTradeGaps, true, insertTradeGaps)),
+		spoolKindOrderBook:      spoolReplayHandler(deadLettered(spoolKindOrderBook, true, insertOrderBookSnapshots)),
+		spoolKindQuotations:     spoolReplayHandler(deadLettered(spoolKindQuotations, true, insertQuotationsBatch)),
+		spoolKindOrders:         spoolReplayHandler(deadLettered(spoolKindOrders, true, insertOrders)),
+		spoolKindMyTrades:       spoolReplayHandler(deadLettered(spoolKindMyTrades, true, insertMyTrades)),
+		spoolKindPositions:      spoolReplayHandler(deadLettered(spoolKindPositions, true, insertPositions)),
+		spoolKindPortfolio:      spoolReplayHandler(deadLettered(spoolKindPortfolio, true, insertPortfolio)),
+	}
+}
+
+// sinkSpool makes the writes of a sink other than ClickHouse as resilient as
+// resilientInsert makes the inserts: retried, spooled in the subdirectory of
+// spool.dir named after the sink and dead-lettered. It collects the replay
+// handlers of the writes it wrapped.
+type sinkSpool struct {
+	name     string
+	spooler  *spool
+	handlers map[string]func(context.Context, json.RawMessage) error
+}
+
+// openSinkSpool opens the spool of a sink. Without spool.dir the writes are
+// retried and dead-lettered only.
+func openSinkSpool(config spoolConfig, name string) (*sinkSpool, error) {
+	resilience := &sinkSpool{name: name, handlers: map[string]func(context.Context, json.RawMessage) error{}}
+	if config.Dir == "" {
+		return resilience, nil
+	}
+	spooler, err := openSpool(filepath.Join(config.Dir, name), config.SegmentSizeMB<<20)
+	if err != nil {
+		return nil, fmt.Errorf("open %s spool: %w", name, err)
+	}
+	resilience.spooler = spooler
+	return resilience, nil
+}
+
+// sinkWrite wraps write of the given spool kind. Dead letters are tagged
+// with the sink name, the dead letter table is shared by all sinks.
+func sinkWrite[T any](resilience *sinkSpool, kind string, write func(context.Context, T) error) func(context.Context, T) error {
+	deadLetterKind := resilience.name + "/" + kind
+	resilience.handlers[kind] = spoolReplayHandler(deadLettered(deadLetterKind, true, write))
+	return deadLettered(deadLetterKind, false, spooled(resilience.spooler, kind, retried(deadLetterKind, settings.Load().Retry, write)))
+}
+
+// replay drains the spool into the sink until replayCtx is done.
+func (resilience *sinkSpool) replay(replayCtx context.Context, ping func(context.Context) error) {
+	if resilience.spooler != nil {
+		go runSpoolReplayer(replayCtx, resilience.spooler, settings.Load().Spool.ReplayInterval, resilience.name, ping, resilience.handlers)
+	}
+}
+
+func (resilience *sinkSpool) close() error {
+	if resilience.spooler == nil {
+		return nil
+	}
+	return resilience.spooler.close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestSpooledInsertReplaysInOrderAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	spooler, err := openSpool(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outage := errors.New("clickhouse is down")
+	handle := spooled(spooler, spoolKindTrades, func(context.Context, []commands.AllTrades) error { return outage })
+	for tradeNo := int64(1); tradeNo <= 5; tradeNo++ {
+		batch := []commands.AllTrades{{Items: []commands.Trade{{TradeNo: tradeNo}}}}
+		if err := handle(context.Background(), batch); err != nil {
+			t.Fatalf("spooled insert error = %v", err)
+		}
+	}
+	if err := spooler.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSpool(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := []int64{}
+	failAt := int64(3)
+	replayHandlers := clickHouseSpoolReplayHandlers()
+	replayHandlers[spoolKindTrades] = spoolReplayHandler(func(_ context.Context, batch []commands.AllTrades) error {
+		tradeNo := batch[0].Items[0].TradeNo
+		if tradeNo == failAt {
+			failAt = 0
+			return outage
+		}
+		replayed = append(replayed, tradeNo)
+		return nil
+	})
+
+	if _, err := reopened.replay(context.Background(), replayHandlers); !errors.Is(err, outage) {
+		t.Fatalf("first replay error = %v", err)
+	}
+	if _, err := reopened.replay(context.Background(), replayHandlers); err != nil {
+		t.Fatalf("second replay error = %v", err)
+	}
+	if !slices.Equal(replayed, []int64{1, 2, 3, 4, 5}) {
+		t.Fatalf("replayed trades = %v", replayed)
+	}
+	segments, err := reopened.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 0 {
+		t.Fatalf("segments left after replay = %v", segments)
+	}
+}
+
+func TestSinkWriteSpoolsInSinkDirectoryAndReplays(t *testing.T) {
+	previousSettings := settings.Load()
+	defer settings.Store(previousSettings)
+	config := *previousSettings
+	config.Retry = retryConfig{Attempts: 1, MinDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	settings.Store(&config)
+
+	dir := t.TempDir()
+	resilience, err := openSinkSpool(spoolConfig{Dir: dir, SegmentSizeMB: 1}, sinkPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resilience.close() }()
+	down := true
+	var written []int64
+	write := sinkWrite(resilience, spoolKindTrades, func(_ context.Context, batch []commands.AllTrades) error {
+		if down {
+			return errors.New("connection refused")
+		}
+		written = append(written, batch[0].Items[0].TradeNo)
+		return nil
+	})
+	if err := write(context.Background(), []commands.AllTrades{{Items: []commands.Trade{{TradeNo: 7}}}}); err != nil {
+		t.Fatalf("write during outage = %v", err)
+	}
+	if segments, err := os.ReadDir(filepath.Join(dir, sinkPostgres)); err != nil || len(segments) != 1 {
+		t.Fatalf("postgres spool segments = %v, %v", segments, err)
+	}
+
+	down = false
+	if replayed, err := resilience.spooler.replay(context.Background(), resilience.handlers); err != nil || replayed != 1 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	if !slices.Equal(written, []int64{7}) {
+		t.Fatalf("written trades = %v", written)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	tcClient "github.com/kmlebedev/txmlconnector/client"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// securitySelection is what the exporter asks TRANSAQ for, derived from the
+// export config and the securities list of the current session.
+type securitySelection struct {
+	quotations []commands.SubSecurity
+	allTrades  []int
+	secInfo    []int
+}
+
+func selectSecurities(export exportConfig, securities []commands.Security) securitySelection {
+	selection := securitySelection{}
+	allTradesSecCodes := export.allTradesSecCodes()
+	for _, sec := range securities {
+		exportSecBoardFound := slices.Contains(export.SecBoards, sec.Board)
+		if exportSecBoardFound && slices.Contains(allTradesSecCodes, sec.SecCode) {
+			selection.allTrades = append(selection.allTrades, sec.SecId)
+		}
+		if sec.SecType == "BOND" {
+			for _, secInfoName := range export.SecInfoNames {
+				if strings.HasSuffix(sec.ShortName, secInfoName) {
+					selection.secInfo = append(selection.secInfo, sec.SecId)
+				}
+			}
+		}
+		if !isExportableSecurity(sec) || !exportSecBoardFound || len(export.SecCodes) == 0 {
+			continue
+		}
+		for _, exportSecCode := range export.SecCodes {
+			if exportSecCode == sec.SecCode || strings.Contains(sec.SecCode, exportSecCode) || exportSecCode == sec.ShortName || exportSecCode == "ALL" {
+				selection.quotations = append(selection.quotations, commands.SubSecurity{SecId: sec.SecId})
+				break
+			}
+		}
+	}
+	return selection
+}
+
+func isExportableSecurity(sec commands.Security) bool {
+	return sec.SecId != 0 && sec.Active == "true" && len(sec.SecCode) <= 16
+}
+
+// subscriptionDiff holds the incremental subscribe/unsubscribe commands that
+// move the server from the current subscriptions to a new selection.
+type subscriptionDiff struct {
+	subscribe   commands.Command
+	unsubscribe commands.Command
+}
+
+func diffSubscriptions(
+	currentQuotations []commands.SubSecurity,
+	currentAllTrades []int,
+	nextQuotations []commands.SubSecurity,
+	nextAllTrades []int,
+) subscriptionDiff {
+	diff := subscriptionDiff{
+		subscribe:   commands.Command{Id: "subscribe"},
+		unsubscribe: commands.Command{Id: "unsubscribe"},
+	}
+	diff.subscribe.Quotations = subSecuritiesMissing(nextQuotations, currentQuotations)
+	diff.unsubscribe.Quotations = subSecuritiesMissing(currentQuotations, nextQuotations)
+	for _, secID := range nextAllTrades {
+		if !slices.Contains(currentAllTrades, secID) {
+			diff.subscribe.AllTrades.Items = appendUniqueSecID(diff.subscribe.AllTrades.Items, secID)
+		}
+	}
+	for _, secID := range currentAllTrades {
+		if !slices.Contains(nextAllTrades, secID) {
+			diff.unsubscribe.AllTrades.Items = appendUniqueSecID(diff.unsubscribe.AllTrades.Items, secID)
+		}
+	}
+	return diff
+}
+
+func (diff subscriptionDiff) empty() bool {
+	return isEmptySubscription(diff.subscribe) && isEmptySubscription(diff.unsubscribe)
+}
+
+func isEmptySubscription(command commands.Command) bool {
+	return len(command.Quotations) == 0 && len(command.AllTrades.Items) == 0
+}
+
+func subSecuritiesMissing(items, from []commands.SubSecurity) []commands.SubSecurity {
+	missing := []commands.SubSecurity{}
+	for _, item := range items {
+		if !slices.ContainsFunc(from, func(other commands.SubSecurity) bool { return other.SecId == item.SecId }) {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+// reloadSubscriptions applies a new config to a live session: it recomputes
+// the selection from the session's securities list and sends only the
+// difference, so the session and already flowing streams are kept.
+func reloadSubscriptions(client *tcClient.TCClient, next exporterConfig) error {
+	settings.Store(&next)
+	selection := selectSecurities(next.Export, client.Data.Securities.Items)
+	controlChanges.apply(&selection, client.Data.Securities.Items)
+	isAllTradesPositions = next.Export.allTradesPositions()
+	nextAllTrades := selection.allTrades
+	if isAllTradesPositions {
+		for _, secPosition := range positions.SecPositions {
+			nextAllTrades = appendUniqueSecID(nextAllTrades, secPosition.SecId)
+		}
+	}
+
+	diff := diffSubscriptions(quotations, allTrades.Items, selection.quotations, nextAllTrades)
+	if !isEmptySubscription(diff.unsubscribe) {
+		if err := client.SendCommand(diff.unsubscribe); err != nil {
+			return fmt.Errorf("unsubscribe: %w", err)
+		}
+		quotations = subSecuritiesMissing(quotations, diff.unsubscribe.Quotations)
+		allTrades.Items = slices.DeleteFunc(allTrades.Items, func(secID int) bool {
+			return slices.Contains(diff.unsubscribe.AllTrades.Items, secID)
+		})
+	}
+	if !isEmptySubscription(diff.subscribe) {
+		if err := client.SendCommand(diff.subscribe); err != nil {
+			return fmt.Errorf("subscribe: %w", err)
+		}
+		quotations = append(quotations, diff.subscribe.Quotations...)
+		allTrades.Items = append(allTrades.Items, diff.subscribe.AllTrades.Items...)
+	}
+	if diff.empty() {
+		log.Info("Config reloaded, subscriptions unchanged")
+	} else {
+		log.Infof("Config reloaded, subscribe %+v unsubscribe %+v", diff.subscribe, diff.unsubscribe)
+	}
+
+	for _, secID := range selection.secInfo {
+		if slices.Contains(getSecuritiesInfo, secID) {
+			continue
+		}
+		if err := client.SendCommand(commands.Command{
+			Id:    "get_securities_info",
+			SecId: secID,
+		}); err != nil {
+			return fmt.Errorf("get securities info for %d: %w", secID, err)
+		}
+	}
+	getSecuritiesInfo = selection.secInfo
+	return nil
+}
+
+// watchConfigReloads reloads the config file on SIGHUP. Only valid configs are
+// delivered; a newer config replaces one the session has not picked up yet.
+func watchConfigReloads(watchCtx context.Context, path string) <-chan exporterConfig {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	reloads := make(chan exporterConfig, 1)
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-hangups:
+			}
+			loaded, err := loadConfig(path)
+			if err != nil {
+				log.Errorf("Reload config: %v", err)
+				continue
+			}
+			next := reloadedConfig(*settings.Load(), loaded)
+			select {
+			case <-reloads:
+			default:
+			}
+			reloads <- next
+		}
+	}()
+	return reloads
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestSelectSecuritiesMatchesBoardsAndCodes(t *testing.T) {
+	securities := []commands.Security{
+		{SecId: 1, SecCode: "SBER", Board: "TQBR", Active: "true"},
+		{SecId: 2, SecCode: "GAZP", Board: "TQBR", Active: "true"},
+		{SecId: 3, SecCode: "SBER", Board: "SMAL", Active: "true"},
+		{SecId: 4, SecCode: "SBERP", Board: "TQBR", Active: "false"},
+	}
+	selection := selectSecurities(exportConfig{
+		SecBoards: []string{"TQBR"},
+		SecCodes:  []string{"SBER"},
+		AllTrades: []string{"positions", "GAZP"},
+	}, securities)
+
+	if len(selection.quotations) != 1 || selection.quotations[0].SecId != 1 {
+		t.Fatalf("quotations = %+v", selection.quotations)
+	}
+	if !slices.Equal(selection.allTrades, []int{2}) {
+		t.Fatalf("all trades = %v", selection.allTrades)
+	}
+}
+
+func TestDiffSubscriptionsSendsOnlyTheDifference(t *testing.T) {
+	diff := diffSubscriptions(
+		[]commands.SubSecurity{{SecId: 1}, {SecId: 2}},
+		[]int{10, 11},
+		[]commands.SubSecurity{{SecId: 2}, {SecId: 3}},
+		[]int{11, 12, 12},
+	)
+	if len(diff.subscribe.Quotations) != 1 || diff.subscribe.Quotations[0].SecId != 3 {
+		t.Fatalf("subscribe quotations = %+v", diff.subscribe.Quotations)
+	}
+	if len(diff.unsubscribe.Quotations) != 1 || diff.unsubscribe.Quotations[0].SecId != 1 {
+		t.Fatalf("unsubscribe quotations = %+v", diff.unsubscribe.Quotations)
+	}
+	if !slices.Equal(diff.subscribe.AllTrades.Items, []int{12}) {
+		t.Fatalf("subscribe all trades = %v", diff.subscribe.AllTrades.Items)
+	}
+	if !slices.Equal(diff.unsubscribe.AllTrades.Items, []int{10}) {
+		t.Fatalf("unsubscribe all trades = %v", diff.unsubscribe.AllTrades.Items)
+	}
+	if diff.subscribe.Id != "subscribe" || diff.unsubscribe.Id != "unsubscribe" {
+		t.Fatalf("command ids = %q, %q", diff.subscribe.Id, diff.unsubscribe.Id)
+	}
+
+	if !diffSubscriptions(nil, []int{1}, nil, []int{1}).empty() {
+		t.Fatal("identical selections produced a diff")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values of the reason column of transaq_trade_gaps.
+const (
+	tradeGapReconnect = "reconnect"
+	tradeGapSilence   = "silence"
+)
+
+type tradeGapsConfig struct {
+	// MaxSilence records a gap when a security has no trades for longer
+	// inside one trading session of gaps.sessions, 0 disables the check.
+	MaxSilence time.Duration `yaml:"max_silence"`
+}
+
+// tradeGap is a stretch of the all trades stream of a security that may
+// have lost trades.
+type tradeGap struct {
+	Detected    time.Time
+	Board       string
+	SecCode     string
+	Reason      string
+	FromTradeNo int64
+	ToTradeNo   int64
+	FromTime    time.Time
+	ToTime      time.Time
+}
+
+type tradeMark struct {
+	tradeNo int64
+	at      time.Time
+	session int
+}
+
+// tradeSequence follows trade numbers and times per security. MOEX numbers
+// trades across the whole market, so a jump of trade_no of one security is
+// no loss by itself. What is recorded is the window a reconnect left in
+// every security, silences inside trading sessions and trades going back.
+type tradeSequence struct {
+	config   tradeGapsConfig
+	calendar tradingCalendar
+	now      func() time.Time
+
+	lock    sync.Mutex
+	session int
+	last    map[string]tradeMark
+}
+
+func newTradeSequence(config tradeGapsConfig, calendar tradingCalendar) *tradeSequence {
+	return &tradeSequence{config: config, calendar: calendar, now: time.Now, last: map[string]tradeMark{}}
+}
+
+// sessionEnded makes the first trade of every security in the next session
+// close a reconnect gap.
+func (sequence *tradeSequence) sessionEnded() {
+	sequence.lock.Lock()
+	defer sequence.lock.Unlock()
+	sequence.session++
+}
+
+// observe checks an all trades message and returns the gaps it closes.
+func (sequence *tradeSequence) observe(trades commands.AllTrades) []tradeGap {
+	sequence.lock.Lock()
+	defer sequence.lock.Unlock()
+	var gaps []tradeGap
+	for _, trade := range trades.Items {
+		tradeTime, err := time.ParseInLocation(tradeTimeLayout, trade.Time, moscowLocation)
+		if err != nil {
+			continue
+		}
+		security := trade.Board + ":" + trade.SecCode
+		last, seen := sequence.last[security]
+		if seen && trade.TradeNo <= last.tradeNo {
+			tradesOutOfOrder.Inc()
+			continue
+		}
+		sequence.last[security] = tradeMark{tradeNo: trade.TradeNo, at: tradeTime, session: sequence.session}
+		if !seen {
+			continue
+		}
+		reason := ""
+		switch {
+		case last.session != sequence.session:
+			reason = tradeGapReconnect
+		case sequence.config.MaxSilence > 0 && tradeTime.Sub(last.at) > sequence.config.MaxSilence &&
+			sequence.calendar.sameSession(last.at, tradeTime):
+			reason = tradeGapSilence
+		default:
+			continue
+		}
+		tradeGaps.WithLabelValues(reason).Inc()
+		gaps = append(gaps, tradeGap{
+			Detected:    sequence.now(),
+			Board:       trade.Board,
+			SecCode:     trade.SecCode,
+			Reason:      reason,
+			FromTradeNo: last.tradeNo,
+			ToTradeNo:   trade.TradeNo,
+			FromTime:    last.at,
+			ToTime:      tradeTime,
+		})
+	}
+	return gaps
+}
+
+// observeTradeGaps records the gaps of every all trades message before
+// handing it on.
+func observeTradeGaps(
+	sequence *tradeSequence,
+	record func(context.Context, []tradeGap) error,
+	handle func(context.Context, commands.AllTrades) error,
+) func(context.Context, commands.AllTrades) error {
+	return func(handleCtx context.Context, trades commands.AllTrades) error {
+		if gaps := sequence.observe(trades); len(gaps) > 0 {
+			for _, gap := range gaps {
+				log.Warnf("Suspected %s gap in trades of %s %s: trade_no %d..%d, %s..%s", gap.Reason, gap.Board, gap.SecCode,
+					gap.FromTradeNo, gap.ToTradeNo, gap.FromTime.Format(tableTimeLayout), gap.ToTime.Format(tableTimeLayout))
+			}
+			if err := record(handleCtx, gaps); err != nil {
+				log.Errorf("Record trade gaps: %v", err)
+			}
+		}
+		return handle(handleCtx, trades)
+	}
+}
+
+func insertTradeGaps(insertCtx context.Context, gaps []tradeGap) (err error) {
+	started := time.Now()
+	defer func() { observeInsert("transaq_trade_gaps", len(gaps), started, err) }()
+	batch, err := connect.PrepareBatch(insertCtx, ChTradeGapsInsertQuery)
+	if err != nil {
+		return fmt.Errorf("prepare trade gaps batch: %w", err)
+	}
+	defer batch.Close()
+	for _, gap := range gaps {
+		if err := batch.Append(
+			gap.Detected,
+			gap.Board,
+			gap.SecCode,
+			gap.Reason,
+			gap.FromTradeNo,
+			gap.ToTradeNo,
+			gap.FromTime.Format(tableTimeLayout),
+			gap.ToTime.Format(tableTimeLayout),
+		); err != nil {
+			return fmt.Errorf("append %s trade gap: %w", gap.SecCode, err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send trade gaps batch: %w", err)
+	}
+	return nil
+}
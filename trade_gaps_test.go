@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestTradeSequenceRecordsReconnectAndSilenceGaps(t *testing.T) {
+	calendar, err := newTradingCalendar(gapsConfig{Sessions: []string{"10:00-18:40"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence := newTradeSequence(tradeGapsConfig{MaxSilence: 10 * time.Minute}, calendar)
+	trade := func(tradeNo int64, clock string) commands.AllTrades {
+		return commands.AllTrades{Items: []commands.Trade{{Board: "TQBR", SecCode: "SBER", TradeNo: tradeNo, Time: "14.08.2026 " + clock}}}
+	}
+
+	if gaps := sequence.observe(trade(100, "10:00:00")); len(gaps) != 0 {
+		t.Fatalf("first trade gaps = %+v", gaps)
+	}
+	// Another security traded in between, trade_no jumps are fine.
+	if gaps := sequence.observe(trade(250, "10:05:00")); len(gaps) != 0 {
+		t.Fatalf("trade_no jump gaps = %+v", gaps)
+	}
+	if gaps := sequence.observe(trade(240, "10:04:00")); len(gaps) != 0 {
+		t.Fatalf("out of order trade gaps = %+v", gaps)
+	}
+	gaps := sequence.observe(trade(300, "10:20:00"))
+	if len(gaps) != 1 || gaps[0].Reason != tradeGapSilence || gaps[0].FromTradeNo != 250 || gaps[0].ToTradeNo != 300 {
+		t.Fatalf("silence gaps = %+v", gaps)
+	}
+
+	sequence.sessionEnded()
+	gaps = sequence.observe(trade(400, "10:21:00"))
+	if len(gaps) != 1 || gaps[0].Reason != tradeGapReconnect || gaps[0].FromTradeNo != 300 {
+		t.Fatalf("reconnect gaps = %+v", gaps)
+	}
+	// Overnight silence is outside any session.
+	if gaps := sequence.observe(commands.AllTrades{Items: []commands.Trade{
+		{Board: "TQBR", SecCode: "SBER", TradeNo: 500, Time: "17.08.2026 10:00:00"},
+	}}); len(gaps) != 0 {
+		t.Fatalf("overnight gaps = %+v", gaps)
+	}
+}
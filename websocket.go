@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dashboardAllSecurities in a subscription selects every security.
+	dashboardAllSecurities = "*"
+	dashboardWriteTimeout  = 10 * time.Second
+)
+
+type websocketConfig struct {
+	// BufferSize is the number of messages held for a client, a client
+	// falling further behind is disconnected.
+	BufferSize int `yaml:"buffer_size"`
+	// OriginPatterns are the hosts of the dashboards allowed to connect from
+	// another origin, as in coder/websocket.AcceptOptions.
+	OriginPatterns []string `yaml:"origin_patterns"`
+}
+
+// dashboardMessage is a message pushed to the clients, Type is trade, best
+// or candle.
+type dashboardMessage struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// dashboardBest is the best bid and ask of an order book.
+type dashboardBest struct {
+	Time      time.Time `json:"time"`
+	Board     string    `json:"board"`
+	SecCode   string    `json:"sec_code"`
+	Bid       float64   `json:"bid"`
+	BidVolume int       `json:"bid_volume"`
+	Ask       float64   `json:"ask"`
+	AskVolume int       `json:"ask_volume"`
+}
+
+// dashboardCandle is a candle still being built.
+type dashboardCandle struct {
+	Board string `json:"board"`
+	candleRow
+}
+
+// dashboardRequest changes the subscriptions of a client.
+type dashboardRequest struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+// dashboardClient is one WebSocket connection. slow is closed when the
+// client was dropped for not keeping up.
+type dashboardClient struct {
+	messages chan []byte
+	slow     chan struct{}
+
+	lock     sync.Mutex
+	secCodes map[string]bool
+}
+
+func newDashboardClient(secCodes []string, bufferSize int) *dashboardClient {
+	client := &dashboardClient{messages: make(chan []byte, bufferSize), slow: make(chan struct{}), secCodes: map[string]bool{}}
+	client.apply(dashboardRequest{Subscribe: secCodes})
+	return client
+}
+
+func (client *dashboardClient) apply(request dashboardRequest) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for _, secCode := range request.Subscribe {
+		client.secCodes[secCode] = true
+	}
+	for _, secCode := range request.Unsubscribe {
+		delete(client.secCodes, secCode)
+	}
+}
+
+func (client *dashboardClient) wants(secCode string) bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.secCodes[secCode] || client.secCodes[dashboardAllSecurities]
+}
+
+// dashboard pushes live trades, best bid and ask and the candles being built
+// to the WebSocket clients. Publishing never waits for a client.
+type dashboard struct {
+	lock    sync.Mutex
+	clients map[*dashboardClient]struct{}
+	// best is the last best bid and ask sent per board:sec_code, an order book
+	// change behind the best levels is not sent.
+	best map[string]dashboardBest
+}
+
+// liveDashboard is the dashboard of the running exporter.
+var liveDashboard = newDashboard()
+
+func newDashboard() *dashboard {
+	return &dashboard{clients: map[*dashboardClient]struct{}{}, best: map[string]dashboardBest{}}
+}
+
+func (dash *dashboard) add(client *dashboardClient) {
+	dash.lock.Lock()
+	defer dash.lock.Unlock()
+	dash.clients[client] = struct{}{}
+	websocketClients.Inc()
+}
+
+func (dash *dashboard) remove(client *dashboardClient) {
+	dash.lock.Lock()
+	defer dash.lock.Unlock()
+	if _, ok := dash.clients[client]; ok {
+		delete(dash.clients, client)
+		websocketClients.Dec()
+	}
+}
+
+// active reports whether there are clients, the callers skip building
+// messages nobody receives.
+func (dash *dashboard) active() bool {
+	dash.lock.Lock()
+	defer dash.lock.Unlock()
+	return len(dash.clients) > 0
+}
+
+func (dash *dashboard) publish(secCode, kind string, data any) {
+	dash.lock.Lock()
+	defer dash.lock.Unlock()
+	var message []byte
+	for client := range dash.clients {
+		if !client.wants(secCode) {
+			continue
+		}
+		if message == nil {
+			encoded, err := json.Marshal(dashboardMessage{Type: kind, Data: data})
+			if err != nil {
+				log.Errorf("Encode dashboard %s message: %v", kind, err)
+				return
+			}
+			message = encoded
+		}
+		select {
+		case client.messages <- message:
+		default:
+			delete(dash.clients, client)
+			close(client.slow)
+			websocketClients.Dec()
+			websocketSlowClients.Inc()
+			log.Warnf("Disconnect slow dashboard client, %d messages behind", cap(client.messages))
+		}
+	}
+}
+
+func (dash *dashboard) publishTrades(trades commands.AllTrades) {
+	if !dash.active() {
+		return
+	}
+	for _, row := range tradeRecords([]commands.AllTrades{trades}) {
+		dash.publish(row.SecCode, "trade", row)
+	}
+}
+
+// publishBest sends the best bid and ask of the order books that changed
+// there.
+func (dash *dashboard) publishBest(tops []orderBookSnapshot) {
+	for _, top := range tops {
+		best := dashboardBest{Time: top.Time, Board: top.Board, SecCode: top.SecCode, Bid: top.bestBid(), Ask: top.bestAsk()}
+		if len(top.Bids) > 0 {
+			best.BidVolume = top.Bids[0].Volume
+		}
+		if len(top.Asks) > 0 {
+			best.AskVolume = top.Asks[0].Volume
+		}
+		key := top.Board + ":" + top.SecCode
+		dash.lock.Lock()
+		last, ok := dash.best[key]
+		dash.best[key] = best
+		dash.lock.Unlock()
+		// A change behind the best levels only moves the time.
+		last.Time = best.Time
+		if ok && last == best {
+			continue
+		}
+		dash.publish(top.SecCode, "best", best)
+	}
+}
+
+func (dash *dashboard) publishCandles(candles []aggregatedCandle) {
+	if !dash.active() {
+		return
+	}
+	rows := candleRecords([][]aggregatedCandle{candles})
+	for i, row := range rows {
+		dash.publish(row.SecCode, "candle", dashboardCandle{Board: candles[i].Board, candleRow: row})
+	}
+}
+
+// handleWebSocket streams the dashboard messages of the securities listed
+// in the sec_code query parameter, comma separated, and of those the client
+// subscribes to later with a dashboardRequest.
+func handleWebSocket(writer http.ResponseWriter, request *http.Request) {
+	config := settings.Load().WebSocket
+	conn, err := websocket.Accept(writer, request, &websocket.AcceptOptions{OriginPatterns: config.OriginPatterns})
+	if err != nil {
+		log.Debugf("Accept WebSocket from %s: %v", request.RemoteAddr, err)
+		return
+	}
+	defer func() { _ = conn.CloseNow() }()
+	var secCodes []string
+	for _, value := range request.URL.Query()["sec_code"] {
+		secCodes = append(secCodes, strings.Split(value, ",")...)
+	}
+	client := newDashboardClient(secCodes, config.BufferSize)
+	liveDashboard.add(client)
+	defer liveDashboard.remove(client)
+
+	connCtx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			_, data, err := conn.Read(connCtx)
+			if err != nil {
+				return
+			}
+			var subscription dashboardRequest
+			if err := json.Unmarshal(data, &subscription); err != nil {
+				_ = conn.Close(websocket.StatusUnsupportedData, "want {\"subscribe\": [...], \"unsubscribe\": [...]}")
+				return
+			}
+			client.apply(subscription)
+		}
+	}()
+	for {
+		select {
+		case <-connCtx.Done():
+			_ = conn.Close(websocket.StatusGoingAway, "")
+			return
+		case <-client.slow:
+			_ = conn.Close(websocket.StatusTryAgainLater, "client too slow")
+			return
+		case message := <-client.messages:
+			writeCtx, cancelWrite := context.WithTimeout(connCtx, dashboardWriteTimeout)
+			err := conn.Write(writeCtx, websocket.MessageText, message)
+			cancelWrite()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/kmlebedev/txmlconnector/client/commands"
+)
+
+func TestWebSocketPushesSubscribedTradesAndOpenCandles(t *testing.T) {
+	server := httptest.NewServer(newHTTPMux(nil))
+	defer server.Close()
+	testCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(testCtx, "ws"+strings.TrimPrefix(server.URL, "http")+"/ws?sec_code=SBER", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.CloseNow() }()
+	for !liveDashboard.active() {
+		if testCtx.Err() != nil {
+			t.Fatal("client did not connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	aggregator := newCandleAggregator(candleSourceTrades, []int{60}, time.Hour, func(context.Context, []aggregatedCandle) error { return nil })
+	aggregator.update = liveDashboard.publishCandles
+	defer func() { _ = aggregator.flush(context.Background()) }()
+	trades := commands.AllTrades{Items: []commands.Trade{
+		{Board: "TQBR", SecCode: "GAZP", TradeNo: 1, Time: "14.08.2026 12:00:00", Price: 150, Quantity: 1},
+		{Board: "TQBR", SecCode: "SBER", TradeNo: 2, Time: "14.08.2026 12:00:01", Price: 300, Quantity: 2},
+	}}
+	liveDashboard.publishTrades(trades)
+	if err := aggregator.addTrades(testCtx, trades); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []map[string]any
+	for range 2 {
+		_, data, err := conn.Read(testCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatal(err)
+		}
+		message.Data["type"] = message.Type
+		received = append(received, message.Data)
+	}
+	if received[0]["type"] != "trade" || received[0]["sec_code"] != "SBER" || received[0]["trade_no"] != 2.0 {
+		t.Fatalf("first message = %v", received[0])
+	}
+	if received[1]["type"] != "candle" || received[1]["board"] != "TQBR" || received[1]["close"] != 300.0 || received[1]["volume"] != 2.0 {
+		t.Fatalf("second message = %v", received[1])
+	}
+}
+
+func TestDashboardSendsBestOnChangeAndDropsSlowClients(t *testing.T) {
+	dash := newDashboard()
+	client := newDashboardClient([]string{"SBER"}, 2)
+	dash.add(client)
+	defer dash.remove(client)
+	top := func(bid float64, at time.Time) []orderBookSnapshot {
+		return []orderBookSnapshot{{Time: at, Board: "TQBR", SecCode: "SBER", Bids: []orderBookLevel{{Price: bid, Volume: 5}}, Asks: []orderBookLevel{{Price: 301, Volume: 7}}}}
+	}
+	started := time.Now()
+	dash.publishBest(top(300, started))
+	dash.publishBest(top(300, started.Add(time.Second)))
+	if len(client.messages) != 1 {
+		t.Fatalf("%d messages, want the unchanged best level sent once", len(client.messages))
+	}
+	dash.publishBest(top(299, started))
+	dash.publishBest(top(298, started))
+
+	select {
+	case <-client.slow:
+	default:
+		t.Fatal("slow client still connected")
+	}
+	if dash.active() {
+		t.Fatal("slow client left in the dashboard")
+	}
+
+	client.apply(dashboardRequest{Subscribe: []string{dashboardAllSecurities}, Unsubscribe: []string{"SBER"}})
+	if !client.wants("GAZP") || !client.wants("SBER") {
+		t.Fatal("subscription to all securities does not match")
+	}
+}